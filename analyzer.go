@@ -1,28 +1,198 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/subtle"
 	"database/sql"
+	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/text/unicode/norm"
+	_ "modernc.org/sqlite"
 )
 
 const (
-	maxStaleDuration = 5 * time.Second
-	MARGIN           = 1.08
+	maxStaleDuration     = 5 * time.Second
+	teamCacheReloadEvery = 1 * time.Minute  // Страховочная перезагрузка кэша команд
+	leagueMatchingEvery  = 5 * time.Minute  // Период поиска пар лиг по связанным командам
+	priceHistorySize     = 20               // Сколько последних цен исхода хранить по каждому букмекеру
+	movementWindow       = 30 * time.Second // Окно, в котором ищется букмекер, двинувший цену первым
+	defaultConfigFile    = "analyzer_config.json"
+	handicapConvention   = "from_kickoff_home_line" // см. HandicapConvention в парсерах
 )
 
+// Настройки анализатора. Читаются из analyzer_config.json (путь можно
+// переопределить переменной ANALYZER_CONFIG); если файла нет, действуют
+// значения по умолчанию из defaultConfig.
+type AnalyzerConfig struct {
+	Database       DatabaseConfig       `json:"database"`
+	LeagueMatching LeagueMatchingConfig `json:"leagueMatching"`
+	Devig          DevigConfig          `json:"devig"`
+	ROI            ROIConfig            `json:"roi"`
+	Quotes         QuotesConfig         `json:"quotes"`
+	Limits         LimitsConfig         `json:"limits"`
+	Frontend       FrontendConfig       `json:"frontend"`
+	Pairs          PairsConfig          `json:"pairs"`
+	Ingest         IngestConfig         `json:"ingest"`
+	Auth           AuthConfig           `json:"auth"`
+	TLS            TLSConfig            `json:"tls"`
+	Logging        LoggingConfig        `json:"logging"`
+}
+
+type DatabaseConfig struct {
+	Driver string `json:"driver"` // "mysql" или "sqlite"
+	DSN    string `json:"dsn"`    // DSN для MySQL или путь к файлу для SQLite
+}
+
+type LeagueMatchingConfig struct {
+	MinLinkedTeams int  `json:"minLinkedTeams"` // Сколько связанных команд нужно для предложения пары лиг
+	AutoCreate     bool `json:"autoCreate"`     // Создавать пары лиг без конфликтов автоматически
+}
+
+// Способ снятия маржи Pinnacle: общий и отдельно для типов рынков
+// (ключи - MarketType*: "1x2", "Total", "Handicap", ...)
+type DevigConfig struct {
+	Default string            `json:"default"`
+	Markets map[string]string `json:"markets"`
+}
+
+// Проверка свежести цен по рынкам: исходы рынков, приостановленных у
+// любого букмекера или не менявшихся у Pinnacle дольше MaxUnchangedSeconds,
+// не сравниваются (0 - не проверять давность)
+type QuotesConfig struct {
+	MaxUnchangedSeconds int `json:"maxUnchangedSeconds"`
+}
+
+// Отправка на фронтенд: пересчитанные пары накапливаются и уходят одним
+// сообщением не чаще раза в TickMillis. У каждого клиента своя очередь
+// на SendQueueSize сообщений; при переполнении SlowClientPolicy
+// "dropOldest" выбрасывает самое старое сообщение, "disconnect" отключает
+// клиента. Раз в PingSeconds клиенту уходит ping, без pong за два периода
+// соединение закрывается.
+type FrontendConfig struct {
+	TickMillis          int    `json:"tickMillis"`
+	SendQueueSize       int    `json:"sendQueueSize"`
+	SlowClientPolicy    string `json:"slowClientPolicy"`
+	PingSeconds         int    `json:"pingSeconds"`
+	WriteTimeoutSeconds int    `json:"writeTimeoutSeconds"`
+}
+
+const (
+	SlowClientDropOldest = "dropOldest"
+	SlowClientDisconnect = "disconnect"
+)
+
+// Очереди сообщений парсеров: не больше QueueSize матчей на источник,
+// отчёт о задержке фронтенду раз в StatusSeconds
+type IngestConfig struct {
+	QueueSize     int `json:"queueSize"`
+	StatusSeconds int `json:"statusSeconds"`
+}
+
+// Доступ к серверам анализатора. ParserTokens - токен каждого парсера
+// (источник -> токен), APIKeys - ключи фронтенда и /admin. Токен передаётся
+// в заголовке "Authorization: Bearer <токен>"; параметр ?token= принимается
+// только при подключении WebSocket. AllowedOrigins - страницы, с которых
+// браузер может подключаться; запросы без Origin (парсеры, manualMatch.php)
+// проверяются только токеном. Без токена парсера его сервер не запускается,
+// без APIKeys /output, /admin и /metrics отклоняют все запросы. Insecure
+// снимает оба запрета - только для локальной разработки.
+type AuthConfig struct {
+	ParserTokens   map[string]string `json:"parserTokens"`
+	APIKeys        []string          `json:"apiKeys"`
+	AllowedOrigins []string          `json:"allowedOrigins"`
+	Insecure       bool              `json:"insecure"`
+}
+
+// Сертификат и ключ для HTTPS/WSS на всех портах анализатора. Пусто - без TLS.
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+// Журнал: общий уровень Level ("debug", "info", "warn", "error"), уровни
+// отдельных модулей Modules (модуль -> уровень, см. logModules) и формат
+// Format ("text" или "json"). Уровни меняются без перезапуска через
+// /admin/logging.
+type LoggingConfig struct {
+	Level   string            `json:"level"`
+	Format  string            `json:"format"`
+	Modules map[string]string `json:"modules"`
+}
+
+// Жизнь пар матчей: пара удаляется, если от одной из сторон нет данных
+// дольше ExpireSeconds
+type PairsConfig struct {
+	ExpireSeconds int `json:"expireSeconds"`
+}
+
+// Максимальные ставки Pinnacle как мера уверенности в цене. Вес исхода -
+// MaxStake / FullConfidenceStake (не больше 1); положительный ROI умножается
+// на вес перед фильтрацией по roi.minROI. Исходы с известным лимитом ниже
+// MinStake не отправляются. Без лимита вес равен 1.
+type LimitsConfig struct {
+	FullConfidenceStake float64 `json:"fullConfidenceStake"`
+	MinStake            float64 `json:"minStake"`
+}
+
+// Формула ROI:
+// (Sansabet / (FairOdds * ExtraPercent) - 1 - FixedCosts) * 100 * Scale * (1 - ExpectedRefund)
+type ROIConfig struct {
+	ExtraPercents []ExtraPercentBand `json:"extraPercents"` // Надбавки к справедливой цене по диапазонам коэффициента Pinnacle
+	FixedCosts    float64            `json:"fixedCosts"`    // Постоянные издержки, доля от ставки
+	Scale         float64            `json:"scale"`         // Понижающий множитель
+	MinROI        float64            `json:"minROI"`        // Исходы с ROI не выше порога не отправляются
+}
+
+// Диапазон коэффициента Pinnacle [Min, Max) и надбавка для него
+type ExtraPercentBand struct {
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	ExtraPercent float64 `json:"extraPercent"`
+}
+
+// Составляющие расчета ROI исхода - отправляются вместе с исходом,
+// чтобы калькулятор и фронтенд могли показать весь расчет
+type ROIBreakdown struct {
+	Formula        string            `json:"Formula"`
+	Sansabet       float64           `json:"Sansabet"`
+	Pinnacle       float64           `json:"Pinnacle"`
+	FairOdds       float64           `json:"FairOdds"`
+	DevigMethod    string            `json:"DevigMethod"`
+	ExtraPercent   float64           `json:"ExtraPercent"`
+	ExtraBand      *ExtraPercentBand `json:"ExtraBand"` // nil, если коэффициент не попал ни в один диапазон
+	FixedCosts     float64           `json:"FixedCosts"`
+	Scale          float64           `json:"Scale"`
+	ExpectedRefund float64           `json:"ExpectedRefund"`
+	Edge           float64           `json:"Edge"` // Sansabet / (FairOdds * ExtraPercent) - 1
+	ROI            float64           `json:"ROI"`
+	MaxStake       float64           `json:"MaxStake"` // Максимальная ставка Pinnacle, 0 - неизвестна
+	Confidence     float64           `json:"Confidence"`
+	WeightedROI    float64           `json:"WeightedROI"` // ROI с учетом Confidence, по нему идет фильтрация
+}
+
 // Структуры данных
 type ParsedMessage struct {
 	MatchId    string
@@ -30,6 +200,7 @@ type ParsedMessage struct {
 	Home       string
 	Away       string
 	LeagueName string // Название лиги
+	Sport      string // Вид спорта; парсеры пока не присылают, по умолчанию Soccer
 }
 
 type MatchPair struct {
@@ -42,6 +213,80 @@ type MatchPair struct {
 	PinnacleHome string // Название домашней команды от Pinnacle
 	PinnacleAway string // Название гостевой команды от Pinnacle
 	Score        string
+
+	Key          string    // Ключ пары: SansabetId|PinnacleId|дата создания (pairEventKey)
+	CreatedAt    time.Time // Когда пара создана
+	SansabetSeen time.Time // Последние данные Sansabet по паре
+	PinnacleSeen time.Time // Последние данные Pinnacle по паре
+}
+
+// Сообщение парсера о том, что матч закончился или пропал из фида
+type RemovalMessage struct {
+	MatchId   string `json:"MatchId"`
+	MatchName string `json:"MatchName"`
+	Removed   bool   `json:"Removed"`
+}
+
+// Сообщение фронтенду. Первое сообщение клиенту - snapshot со всеми
+// матчами, дальше - delta с изменениями. Seq растёт на 1 с каждой дельтой;
+// снимок несёт seq последней дельты, вошедшей в него. Клиент, заметивший
+// пропуск, отправляет {"type": "resync"} и получает новый снимок.
+// Сообщения status (состояние очередей парсеров) идут вне нумерации.
+type FrontendMessage struct {
+	Type    string                   `json:"type"` // snapshot | delta
+	Seq     int64                    `json:"seq"`
+	Matches []map[string]interface{} `json:"matches,omitempty"` // snapshot: матчи в порядке matchPairs
+	Changes []FrontendChange         `json:"changes,omitempty"` // delta
+	Ingest  map[string]IngestStats   `json:"ingest,omitempty"`  // status: очереди парсеров
+}
+
+// Изменение одного матча (ключ - PairKey) в дельте
+type FrontendChange struct {
+	Op              string                   `json:"op"`                        // add | update | remove
+	Pair            string                   `json:"pair"`                      // PairKey
+	Match           map[string]interface{}   `json:"match,omitempty"`           // add: весь матч, update: изменившиеся поля кроме Outcomes
+	Outcomes        []map[string]interface{} `json:"outcomes,omitempty"`        // update: новые и изменившиеся исходы
+	RemovedOutcomes []string                 `json:"removedOutcomes,omitempty"` // update: названия пропавших исходов
+}
+
+// Клиент фронтенда
+type frontendClient struct {
+	needSnapshot bool                 // Следующим сообщением отправить снимок
+	subscription FrontendSubscription // Фильтры клиента, пустые - все матчи
+	sender       *clientSender
+}
+
+// Очередь сообщений одного клиента фронтенда и её горутина записи
+// (writeLoop). В соединение пишет только writeLoop, поэтому медленный
+// клиент не задерживает остальных и владельца состояния.
+type clientSender struct {
+	conn      *websocket.Conn
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	connected time.Time
+	sent      int64 // Отправлено сообщений (atomic)
+	dropped   int64 // Выброшено из переполненной очереди (atomic)
+}
+
+// Подписка клиента: {"type": "subscribe", ...}. Клиент получает только
+// исходы, прошедшие все заданные фильтры, и матчи, где такие исходы есть.
+// Пустой список или отсутствующее поле - фильтра нет.
+type FrontendSubscription struct {
+	MinROI      *float64 `json:"minRoi,omitempty"`      // ROI исхода не ниже, %
+	MinPinnacle float64  `json:"minPinnacle,omitempty"` // Цена Pinnacle не ниже
+	Leagues     []string `json:"leagues,omitempty"`     // LeagueName, без учета регистра
+	Countries   []string `json:"countries,omitempty"`   // Country, без учета регистра
+	MarketTypes []string `json:"marketTypes,omitempty"` // 1x2, Total, Handicap, DoubleChance, DrawNoBet, BothTeamsToScore
+	Periods     []string `json:"periods,omitempty"`     // Match, Time1, Time2
+}
+
+// Счетчики пар для /admin/pairs
+type PairCounters struct {
+	Active  int `json:"active"`  // Пары в matchPairs сейчас
+	Total   int `json:"total"`   // Создано пар с запуска
+	Expired int `json:"expired"` // Удалено по pairs.expireSeconds
+	Removed int `json:"removed"` // Удалено по сообщению парсера
 }
 
 type MatchData struct {
@@ -49,1440 +294,3965 @@ type MatchData struct {
 	LastUpdate time.Time // Время последнего обновления
 }
 
-// Глобальные переменные
-var (
-	db              *sql.DB
-	lastSentMutex   sync.Mutex
-	pairsMutex      sync.Mutex
-	frontendMutex   sync.Mutex
-	matchDataMutex  sync.RWMutex
-	matchData       = map[string]map[string]*MatchData{"Sansabet": {}, "Pinnacle": {}}
+// Состояние рынка от парсера (поле Markets в OneGame): время последнего
+// изменения цен (Unix, мс) и приостановка
+type MarketState struct {
+	LastChanged int64 `json:"LastChanged"`
+	Suspended   bool  `json:"Suspended"`
+}
+
+// Состояние анализатора: данные матчей, пары, кэш результатов, история
+// цен и подключения. Принадлежит одной горутине (stateActor.run), остальные
+// горутины обращаются к нему только через stateActor.do/post, поэтому
+// блокировки не нужны.
+type analyzerState struct {
+	matchData       map[string]map[string]*MatchData // источник -> ключ матча
 	matchPairs      []MatchPair
-	matchKeys       = make(map[string]bool) // Уникальные ключи матчей
-	frontendClients = make(map[*websocket.Conn]bool)
-	sansabetConns   = make(map[*websocket.Conn]bool)
-	pinnacleConns   = make(map[*websocket.Conn]bool)
-	upgrader        = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-	extraPercents   = []struct {
-		Min, Max, ExtraPercent float64
-	}{
-		{2.29, 2.75, 1.03},
-		{2.75, 3.2, 1.04},
-		{3.2, 3.7, 1.05},
-	}
-)
+	matchKeys       map[string]bool // Ключи пар (MatchPair.Key)
+	pairCounters    PairCounters
+	pairResults     map[string]map[string]interface{}                  // MatchPair.Key -> последний результат
+	dirtyPairs      map[string]bool                                    // Пары, результат которых изменился после последней отправки
+	priceHistory    map[string]map[string]map[MarketOutcome]*PriceRing // источник -> ключ матча -> исход
+	frontendClients map[*websocket.Conn]*frontendClient
+	parserConns     map[string]map[*websocket.Conn]bool // источник -> подключения парсеров
+}
 
-// Инициализация подключения к базе данных
-func initDB() {
-	var err error
-	dsn := "matchingTeams:local_password@tcp(localhost:3306)/matchingTeams"
-	db, err = sql.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("[ERROR] Ошибка подключения к базе данных: %v", err)
-	}
-	if err := db.Ping(); err != nil {
-		log.Fatalf("[ERROR] Не удалось подключиться к базе: %v", err)
-	}
-	log.Println("[DEBUG] Подключение к базе данных успешно установлено")
+// Владелец состояния: выполняет присланные функции по одной в своей горутине
+type stateActor struct {
+	inbox chan func(*analyzerState)
+	state *analyzerState
 }
 
-// Запуск анализатора
-func startAnalyzer() {
-	log.Println("[DEBUG] Анализатор запущен")
-	go startParserServer(7100, "Sansabet")
-	go startParserServer(7200, "Pinnacle")
-	go startFrontendServer()
-	go processPairs()
+// Цена исхода в момент получения от парсера
+type PricePoint struct {
+	Price float64
+	At    time.Time
 }
 
-// Сервер для приема данных от парсеров
-func startParserServer(port int, sourceName string) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("[ERROR] Ошибка подключения от %s: %v", sourceName, err)
-			return
-		}
-		defer conn.Close()
+// Кольцевой буфер последних цен исхода одного букмекера. Новая точка
+// добавляется только при изменении цены, поэтому каждая точка после
+// первой - движение линии.
+type PriceRing struct {
+	points [priceHistorySize]PricePoint
+	next   int
+	count  int
+}
 
-		log.Printf("[DEBUG] Новое подключение от парсера %s", sourceName)
+// Движение цены исхода у одного букмекера
+type BookMovement struct {
+	Price       float64 `json:"Price"`
+	Moves       int     `json:"Moves"`       // Число изменений цены в буфере
+	LastMoveAgo float64 `json:"LastMoveAgo"` // Секунд с последнего изменения, -1 - изменений не было
+	LastMove    float64 `json:"LastMove"`    // Размер последнего изменения (новая цена - старая)
+}
 
-		if sourceName == "Sansabet" {
-			sansabetConns[conn] = true
-		} else if sourceName == "Pinnacle" {
-			pinnacleConns[conn] = true
-		}
+// Сигналы движения линии исхода у обоих букмекеров. FirstMover - кто
+// первым изменил цену за последние movementWindow ("Pinnacle", "Sansabet"
+// или ""); SansabetLagging - Pinnacle двинул цену, а Sansabet после этого
+// свою не менял.
+type MovementSignals struct {
+	Pinnacle        BookMovement `json:"Pinnacle"`
+	Sansabet        BookMovement `json:"Sansabet"`
+	FirstMover      string       `json:"FirstMover"`
+	SansabetLagging bool         `json:"SansabetLagging"`
+}
 
-		for {
-			log.Printf("[DEBUG] Ожидание данных от %s", sourceName)
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				log.Printf("[ERROR] Ошибка чтения сообщения от %s: %v", sourceName, err)
-				break
-			}
-			log.Printf("[DEBUG] Получены данные от %s: %s", sourceName, string(msg))
-			saveMatchData(sourceName, msg)
-		}
+// Рынок ставок: поле OneGame, в котором его передают парсеры, период,
+// тип ставки и участник (вся игра или индивидуальный тотал команды)
+type MarketSpec struct {
+	Field       string
+	Period      string // "", "Time1" или "Time2"
+	Type        string // MarketType1x2, MarketTypeTotal или MarketTypeHandicap
+	Participant string // "", "First Team" или "Second Team"
+}
 
-		if sourceName == "Sansabet" {
-			delete(sansabetConns, conn)
-		} else if sourceName == "Pinnacle" {
-			delete(pinnacleConns, conn)
-		}
-	})
+// Исход рынка: линия (пустая для 1x2) и сторона ставки
+type MarketOutcome struct {
+	Market MarketSpec
+	Line   string
+	Side   string
+}
 
-	log.Printf("[DEBUG] Сервер для парсера %s запущен на порту %d", sourceName, port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка запуска сервера для парсера %s: %v", sourceName, err)
-	}
+// Миграция схемы базы данных
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
 }
 
-// Сервер для фронтенда
-func startFrontendServer() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/output", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("[ERROR] Ошибка подключения клиента: %v", err)
-			return
-		}
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
 
-		frontendMutex.Lock()
-		frontendClients[conn] = true
-		frontendMutex.Unlock()
+// Команда из базы сопоставления
+type StoredTeam struct {
+	Source string
+	Id     int
+	Name   string
+	League string
+	Sport  string
+}
 
-		defer func() {
-			frontendMutex.Lock()
-			delete(frontendClients, conn)
-			frontendMutex.Unlock()
-			conn.Close()
-		}()
+// Написание команды у источника, привязанное к канонической команде
+type TeamAlias struct {
+	CanonicalId int
+	Source      string
+	Sport       string
+	Name        string
+}
 
-		for {
-			if _, _, err := conn.NextReader(); err != nil {
-				break
-			}
-		}
-	})
+// Сколько связанных команд лиги Sansabet относятся к лиге Pinnacle
+type LeagueLinkStat struct {
+	SansabetLeagueId int
+	SansabetLeague   string
+	PinnacleLeagueId int
+	PinnacleLeague   string
+	LinkedTeams      int
+}
 
-	log.Println("[DEBUG] Сервер для фронтенда запущен на порту 7300")
-	err := http.ListenAndServe(":7300", mux)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка запуска сервера для фронтенда: %v", err)
-	}
+// Пара лиг из league_matches
+type LeagueMatch struct {
+	PinnacleLeagueId int
+	SansabetLeagueId int
 }
 
-// Обработка полученных данных от парсеров
-func saveMatchData(name string, msg []byte) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("[ERROR] Паника в saveMatchData: %v", r)
-		}
-	}()
+// Предложенная пара лиг
+type LeagueSuggestion struct {
+	LeagueLinkStat
+	Conflicted bool // Одна из лиг участвует в конфликте, автоматически не создаётся
+	Created    bool // Пара создана автоматически в этом проходе
+}
 
-	// Проверяем на пустое сообщение
-	if len(msg) == 0 || string(msg) == "[]" {
-		matchDataMutex.Lock()
-		for key := range matchData[name] {
-			delete(matchData[name], key)
-			log.Printf("[DEBUG] Удален матч с ключом %s из источника %s из-за пустого массива", key, name)
-		}
-		matchDataMutex.Unlock()
-		return
-	}
+// Связанные команды одной лиги указывают на разные лиги другого источника
+type LeagueConflict struct {
+	Reason     string // sansabet_league_split или pinnacle_league_split
+	Candidates []LeagueLinkStat
+}
 
-	parsedMsg, err := parseMessage(name, msg)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка парсинга сообщения от %s: %v", name, err)
-		return
-	}
+type LeagueSuggestions struct {
+	Suggestions []LeagueSuggestion
+	Conflicts   []LeagueConflict
+}
 
-	ensureTeamsExist(name, parsedMsg.Home, parsedMsg.Away, parsedMsg.LeagueName, "Soccer")
-	if name == "Sansabet" {
-		linked, linkedHome, linkedAway := linkTeamsForMatch(parsedMsg.Home, parsedMsg.Away)
-		if linked {
-			log.Printf("[DEBUG] Найдена связь для команд: Home=%s, Away=%s", linkedHome, linkedAway)
-			updateMatchPairs(parsedMsg)
-		} else {
-			log.Printf("[DEBUG] Связь для команд Home=%s и Away=%s не найдена", parsedMsg.Home, parsedMsg.Away)
-		}
-	}
+// Хранилище команд и лиг. Реализации: MySQL и встроенный SQLite,
+// выбираются в настройках (database.driver), миграции у них общие.
+type TeamRepository interface {
+	Migrate() error
+	LoadTeams() ([]StoredTeam, error)
+	LoadAliases() ([]TeamAlias, error)
+	InsertTeam(source, teamName, league, sport string) (int, error)
+	LinkTeam(sansabetTeam string, pinnacleId int) (int, error)
+	FoldName(name string) string
+	LoadLeagueLinkStats() ([]LeagueLinkStat, error)
+	LoadLeagueMatches() ([]LeagueMatch, error)
+	CreateLeagueMatch(pinnacleLeagueId, sansabetLeagueId int, autoCreated bool) error
+	Close() error
+}
 
-	key := generateMatchKey(parsedMsg.Home, parsedMsg.Away)
+// Отличия SQL-диалектов, которые нужны хранилищу и миграциям
+type SQLDialect struct {
+	Name             string // суффикс файлов миграций, написанных только для этого диалекта
+	SchemaVersionDDL string
+	LegacyTableQuery string // количество таблиц sansabet_teams в базе
+	// Приведение названия к виду, в котором его сравнивает collation столбцов
+	// name: названия, равные для базы, дают одинаковый результат
+	FoldName func(name string) string
+	// Ошибка DDL означает, что выражение уже применено прошлым запуском
+	// (только для диалектов без транзакционного DDL)
+	AlreadyApplied func(err error) bool
+}
 
-	matchDataMutex.Lock()
-	matchData[name][key] = &MatchData{
-		Data:       string(msg),
-		LastUpdate: time.Now(),
+var (
+	mysqlDialect = SQLDialect{
+		Name: "mysql",
+		SchemaVersionDDL: `
+            CREATE TABLE IF NOT EXISTS schema_version (
+                version    INT NOT NULL,
+                name       VARCHAR(200) NOT NULL,
+                applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                PRIMARY KEY (version)
+            ) ENGINE=InnoDB`,
+		LegacyTableQuery: `
+            SELECT COUNT(*) FROM information_schema.tables
+            WHERE table_schema = DATABASE() AND table_name = 'sansabet_teams'`,
+		AlreadyApplied: mysqlAlreadyApplied,
+		FoldName:       foldGeneralCI,
 	}
-	matchDataMutex.Unlock()
-
-	log.Printf("[DEBUG] Данные матча сохранены в matchData[%s][%s]", name, key)
+	sqliteDialect = SQLDialect{
+		Name: "sqlite",
+		SchemaVersionDDL: `
+            CREATE TABLE IF NOT EXISTS schema_version (
+                version    INTEGER NOT NULL PRIMARY KEY,
+                name       TEXT NOT NULL,
+                applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+            )`,
+		LegacyTableQuery: `
+            SELECT COUNT(*) FROM sqlite_master
+            WHERE type = 'table' AND name = 'sansabet_teams'`,
+		FoldName: foldNoCase,
+	}
+)
 
-	// Запускаем обработку пар
-	processPairs()
-	sendCurrentMatchesToFrontend()
+// Хранилище поверх database/sql
+type SQLTeamRepository struct {
+	db      *sql.DB
+	dialect SQLDialect
 }
 
-// Отправка текущих матчей на фронтенд
-func sendCurrentMatchesToFrontend() {
-	results := groupResultsByMatch(matchPairs)
-	forwardToFrontendBatch(results)
+// Кэш команд и связей между ними. Загружается из базы при старте,
+// обновляется при записи анализатором и перезагружается по команде
+// администратора, поэтому обработка сообщений не ходит в базу.
+// Все названия в ключах приведены через fold хранилища (TeamRepository.FoldName),
+// поэтому кэш считает одинаковыми те же названия, что и база.
+type TeamCache struct {
+	mutex             sync.RWMutex
+	fold              func(name string) string
+	teams             map[string]StoredTeam // source|sport|league|name -> команда в базе
+	aliases           map[string]int        // source|sport|name -> ID канонической команды
+	canonicalPinnacle map[int]string        // ID канонической команды -> её написание у Pinnacle
+	loadedAt          time.Time
 }
 
-// Парсинг сообщения
-func parseMessage(name string, msg []byte) (*ParsedMessage, error) {
-	//log.Printf("[DEBUG] Получено сообщение из %s: %s", name, string(msg))
-
-	var parsedMsg ParsedMessage
-	if err := json.Unmarshal(msg, &parsedMsg); err != nil {
-		return nil, fmt.Errorf("Ошибка парсинга JSON из %s: %v | Сообщение: %s", name, err, string(msg))
-	}
-
-	teams := splitMatchName(parsedMsg.MatchName, name)
-	if len(teams) != 2 {
-		return nil, fmt.Errorf("Не удалось разделить MatchName на команды: %s", parsedMsg.MatchName)
-	}
+// Типы рынков
+const (
+	MarketType1x2              = "1x2"
+	MarketTypeTotal            = "Total"
+	MarketTypeHandicap         = "Handicap"
+	MarketTypeDoubleChance     = "DoubleChance"
+	MarketTypeDrawNoBet        = "DrawNoBet"
+	MarketTypeBothTeamsToScore = "BothTeamsToScore"
+)
 
-	parsedMsg.Home = teams[0]
-	parsedMsg.Away = teams[1]
+// Рынки, которые сравниваются между букмекерами. Новый рынок - новая строка
+// таблицы. Field совпадает с JSON-тегом поля OneGame в обоих парсерах.
+var marketSpecs = []MarketSpec{
+	{Field: "Win1x2", Type: MarketType1x2},
+	{Field: "Totals", Type: MarketTypeTotal},
+	{Field: "FirstTeamTotals", Type: MarketTypeTotal, Participant: "First Team"},
+	{Field: "SecondTeamTotals", Type: MarketTypeTotal, Participant: "Second Team"},
+	{Field: "Handicap", Type: MarketTypeHandicap},
+
+	{Field: "Time1Win1x2", Period: "Time1", Type: MarketType1x2},
+	{Field: "Time1Totals", Period: "Time1", Type: MarketTypeTotal},
+	{Field: "Time1FirstTeam", Period: "Time1", Type: MarketTypeTotal, Participant: "First Team"},
+	{Field: "Time1SecondTeam", Period: "Time1", Type: MarketTypeTotal, Participant: "Second Team"},
+	{Field: "Time1Handicap", Period: "Time1", Type: MarketTypeHandicap},
+
+	{Field: "Time2Win1x2", Period: "Time2", Type: MarketType1x2},
+	{Field: "Time2Totals", Period: "Time2", Type: MarketTypeTotal},
+	{Field: "Time2FirstTeam", Period: "Time2", Type: MarketTypeTotal, Participant: "First Team"},
+	{Field: "Time2SecondTeam", Period: "Time2", Type: MarketTypeTotal, Participant: "Second Team"},
+	{Field: "Time2Handicap", Period: "Time2", Type: MarketTypeHandicap},
+
+	{Field: "DoubleChance", Type: MarketTypeDoubleChance},
+	{Field: "DrawNoBet", Type: MarketTypeDrawNoBet},
+	{Field: "BothTeamsToScore", Type: MarketTypeBothTeamsToScore},
+}
 
-	if parsedMsg.Home == "" || parsedMsg.Away == "" || parsedMsg.LeagueName == "" {
-		return nil, fmt.Errorf("Недостаточно данных: Home=%s, Away=%s, LeagueName=%s", parsedMsg.Home, parsedMsg.Away, parsedMsg.LeagueName)
-	}
+// Названия рынков без линий в названии исхода (перед стороной)
+var marketTypeNames = map[string]string{
+	MarketTypeDoubleChance:     "Double Chance",
+	MarketTypeDrawNoBet:        "Draw No Bet",
+	MarketTypeBothTeamsToScore: "Both Teams To Score",
+}
 
-	log.Printf("[DEBUG] Распарсенные данные: Home=%s, Away=%s, LeagueName=%s", parsedMsg.Home, parsedMsg.Away, parsedMsg.LeagueName)
-	return &parsedMsg, nil
+// Названия сторон в JSON парсеров -> сторона в названии исхода
+var marketSides = map[string]string{
+	"Win1":    "Win1",
+	"WinNone": "WinNone",
+	"Win2":    "Win2",
+	"WinMore": "More",
+	"WinLess": "Less",
+	"Win1X":   "1X",
+	"Win12":   "12",
+	"WinX2":   "X2",
+	"Yes":     "Yes",
+	"No":      "No",
 }
 
-// Разделение названия матча на домашнюю и гостевую команды
-func splitMatchName(matchName, source string) []string {
-	log.Printf("[DEBUG] Разделяем MatchName: '%s' для источника '%s'", matchName, source)
+// Маржа недоступна: у Pinnacle нет всех исходов полного рынка,
+// поэтому ни маржу, ни справедливую цену посчитать нельзя
+var errMarginUnavailable = errors.New("у Pinnacle нет полного рынка, маржа недоступна")
 
-	var separator string
-	if source == "Sansabet" {
-		separator = " : "
-	} else if source == "Pinnacle" {
-		separator = " vs "
-	} else {
-		separator = " vs "
-	}
+// Способы снятия маржи
+const (
+	DevigMultiplicative = "multiplicative"
+	DevigAdditive       = "additive"
+	DevigPower          = "power"
+	DevigShin           = "shin"
+	DevigOddsRatio      = "odds_ratio"
+)
 
-	teams := strings.Split(matchName, separator)
-	log.Printf("[DEBUG] Разделённые команды: %v", teams)
-	return teams
+// Снятие маржи: цены всех исходов полного рынка -> справедливые вероятности
+var devigMethods = map[string]func(odds []float64) []float64{
+	DevigMultiplicative: devigMultiplicative,
+	DevigAdditive:       devigAdditive,
+	DevigPower:          devigPower,
+	DevigShin:           devigShin,
+	DevigOddsRatio:      devigOddsRatio,
 }
 
-// Проверка наличия команд в базе данных
-func ensureTeamsExist(source, home, away, league, sport string) {
-	log.Printf("[DEBUG] Проверяем наличие команды %s в %s, лига: %s", home, source, league)
-	if !teamExists(source, home, league, sport) {
-		log.Printf("[DEBUG] Команда %s отсутствует в %s, добавляем её (лига: %s)", home, source, league)
-		insertTeam(source, home, league, sport)
-	}
+// Глобальные переменные
+var (
+	config    = defaultConfig()
+	teamRepo  TeamRepository
+	teamCache = &TeamCache{}
+	upgrader  = websocket.Upgrader{CheckOrigin: originAllowed}
+	state     = newStateActor()
+)
 
-	log.Printf("[DEBUG] Проверяем наличие команды %s в %s, лига: %s", away, source, league)
-	if !teamExists(source, away, league, sport) {
-		log.Printf("[DEBUG] Команда %s отсутствует в %s, добавляем её (лига: %s)", away, source, league)
-		insertTeam(source, away, league, sport)
+const roiFormula = "(Sansabet / (FairOdds * ExtraPercent) - 1 - FixedCosts) * 100 * Scale * (1 - ExpectedRefund)"
+
+// Настройки по умолчанию
+func defaultConfig() AnalyzerConfig {
+	return AnalyzerConfig{
+		Database: DatabaseConfig{
+			Driver: "mysql",
+			DSN:    "matchingTeams:local_password@tcp(localhost:3306)/matchingTeams",
+		},
+		LeagueMatching: LeagueMatchingConfig{
+			MinLinkedTeams: 3,
+			AutoCreate:     false,
+		},
+		Devig: DevigConfig{
+			Default: DevigMultiplicative,
+		},
+		ROI: ROIConfig{
+			ExtraPercents: []ExtraPercentBand{
+				{Min: 2.29, Max: 2.75, ExtraPercent: 1.03},
+				{Min: 2.75, Max: 3.2, ExtraPercent: 1.04},
+				{Min: 3.2, Max: 3.7, ExtraPercent: 1.05},
+			},
+			FixedCosts: 0.03,
+			Scale:      0.67,
+			MinROI:     -30,
+		},
+		Quotes: QuotesConfig{
+			MaxUnchangedSeconds: 120,
+		},
+		Limits: LimitsConfig{
+			FullConfidenceStake: 500,
+			MinStake:            0,
+		},
+		Frontend: FrontendConfig{
+			TickMillis:          500,
+			SendQueueSize:       64,
+			SlowClientPolicy:    SlowClientDropOldest,
+			PingSeconds:         20,
+			WriteTimeoutSeconds: 10,
+		},
+		Pairs: PairsConfig{
+			ExpireSeconds: 60,
+		},
+		Ingest: IngestConfig{
+			QueueSize:     500,
+			StatusSeconds: 1,
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "text",
+		},
 	}
 }
 
-// Проверка наличия команды в базе данных
-func teamExists(source, teamName, league, sport string) bool {
-	var exists bool
-	var query string
+// Загрузка настроек поверх значений по умолчанию
+func loadConfig() (AnalyzerConfig, error) {
+	cfg := defaultConfig()
 
-	if source == "Pinnacle" {
-		query = `
-            SELECT EXISTS(
-                SELECT 1 FROM pinnacle_teams pt 
-                JOIN pinnacle_leagues pl ON pt.league_id = pl.id 
-                JOIN sports s ON pt.sport_id = s.id
-                WHERE pt.name = ? AND pl.name = ? AND s.name = ?
-            )`
-	} else {
-		query = `
-            SELECT EXISTS(
-                SELECT 1 FROM sansabet_teams st 
-                JOIN sansabet_leagues sl ON st.league_id = sl.id 
-                JOIN sports s ON st.sport_id = s.id
-                WHERE st.name = ? AND sl.name = ? AND s.name = ?
-            )`
+	configFile := os.Getenv("ANALYZER_CONFIG")
+	if configFile == "" {
+		configFile = defaultConfigFile
 	}
 
-	err := db.QueryRow(query, teamName, league, sport).Scan(&exists)
+	data, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Printf("[ERROR] Ошибка проверки существования команды %s: %v", teamName, err)
-		return false
-	}
-	return exists
-}
-
-// Вставка команды в базу данных
-func insertTeam(source, teamName, league, sport string) {
-	// Сначала убедимся, что существует вид спорта
-	var sportId int64
-	err := db.QueryRow("SELECT id FROM sports WHERE name = ?", sport).Scan(&sportId)
-	if err == sql.ErrNoRows {
-		result, err := db.Exec("INSERT INTO sports (name) VALUES (?)", sport)
-		if err != nil {
-			log.Printf("[ERROR] Ошибка создания вида спорта %s: %v", sport, err)
-			return
+		if os.IsNotExist(err) {
+			return cfg, nil // Файла нет - работаем на значениях по умолчанию
 		}
-		sportId, _ = result.LastInsertId()
-	} else if err != nil {
-		log.Printf("[ERROR] Ошибка поиска вида спорта %s: %v", sport, err)
-		return
+		return cfg, fmt.Errorf("ошибка чтения файла настроек %s: %v", configFile, err)
 	}
 
-	// Теперь проверим/создадим лигу
-	var leagueId int64
-	var leagueQuery string
-	if source == "Pinnacle" {
-		leagueQuery = "SELECT id FROM pinnacle_leagues WHERE name = ? AND sport_id = ?"
-	} else {
-		leagueQuery = "SELECT id FROM sansabet_leagues WHERE name = ? AND sport_id = ?"
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("ошибка разбора файла настроек %s: %v", configFile, err)
 	}
 
-	err = db.QueryRow(leagueQuery, league, sportId).Scan(&leagueId)
-	if err == sql.ErrNoRows {
-		var leagueInsertQuery string
-		if source == "Pinnacle" {
-			leagueInsertQuery = "INSERT INTO pinnacle_leagues (name, sport_id) VALUES (?, ?)"
-		} else {
-			leagueInsertQuery = "INSERT INTO sansabet_leagues (name, sport_id) VALUES (?, ?)"
+	if _, known := devigMethods[cfg.Devig.Default]; !known {
+		return cfg, fmt.Errorf("неизвестный способ снятия маржи devig.default: %q", cfg.Devig.Default)
+	}
+	for marketType, method := range cfg.Devig.Markets {
+		if _, known := devigMethods[method]; !known {
+			return cfg, fmt.Errorf("неизвестный способ снятия маржи devig.markets.%s: %q", marketType, method)
 		}
-
-		result, err := db.Exec(leagueInsertQuery, league, sportId)
-		if err != nil {
-			log.Printf("[ERROR] Ошибка создания лиги %s: %v", league, err)
-			return
+	}
+	for i, band := range cfg.ROI.ExtraPercents {
+		if band.Min >= band.Max || band.ExtraPercent <= 0 {
+			return cfg, fmt.Errorf("некорректный диапазон roi.extraPercents[%d]: %+v", i, band)
 		}
-		leagueId, _ = result.LastInsertId()
-	} else if err != nil {
-		log.Printf("[ERROR] Ошибка поиска лиги %s: %v", league, err)
-		return
 	}
-
-	// Теперь вставляем команду
-	var teamInsertQuery string
-	if source == "Pinnacle" {
-		teamInsertQuery = "INSERT INTO pinnacle_teams (name, sport_id, league_id) VALUES (?, ?, ?)"
-	} else {
-		teamInsertQuery = "INSERT INTO sansabet_teams (name, sport_id, league_id) VALUES (?, ?, ?)"
+	if cfg.Quotes.MaxUnchangedSeconds < 0 {
+		return cfg, fmt.Errorf("некорректное значение quotes.maxUnchangedSeconds: %d", cfg.Quotes.MaxUnchangedSeconds)
 	}
-
-	_, err = db.Exec(teamInsertQuery, teamName, sportId, leagueId)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка создания команды %s: %v", teamName, err)
-		return
+	if cfg.Limits.FullConfidenceStake < 0 || cfg.Limits.MinStake < 0 {
+		return cfg, fmt.Errorf("некорректные лимиты limits: %+v", cfg.Limits)
 	}
+	if cfg.Frontend.TickMillis <= 0 {
+		return cfg, fmt.Errorf("некорректный период отправки frontend.tickMillis: %d", cfg.Frontend.TickMillis)
+	}
+	if cfg.Frontend.SendQueueSize <= 0 {
+		return cfg, fmt.Errorf("некорректный размер очереди frontend.sendQueueSize: %d", cfg.Frontend.SendQueueSize)
+	}
+	if cfg.Frontend.SlowClientPolicy != SlowClientDropOldest && cfg.Frontend.SlowClientPolicy != SlowClientDisconnect {
+		return cfg, fmt.Errorf("неизвестная политика frontend.slowClientPolicy: %s", cfg.Frontend.SlowClientPolicy)
+	}
+	if cfg.Frontend.PingSeconds <= 0 || cfg.Frontend.WriteTimeoutSeconds <= 0 {
+		return cfg, fmt.Errorf("некорректные таймауты frontend.pingSeconds/writeTimeoutSeconds: %d/%d", cfg.Frontend.PingSeconds, cfg.Frontend.WriteTimeoutSeconds)
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return cfg, fmt.Errorf("для TLS нужны оба файла tls.certFile и tls.keyFile")
+	}
+	if cfg.Ingest.QueueSize <= 0 || cfg.Ingest.StatusSeconds <= 0 {
+		return cfg, fmt.Errorf("некорректные настройки очереди ingest.queueSize/statusSeconds: %d/%d", cfg.Ingest.QueueSize, cfg.Ingest.StatusSeconds)
+	}
+	if cfg.Pairs.ExpireSeconds <= 0 {
+		return cfg, fmt.Errorf("некорректное время жизни пары pairs.expireSeconds: %d", cfg.Pairs.ExpireSeconds)
+	}
+	if cfg.ROI.Scale <= 0 {
+		return cfg, fmt.Errorf("некорректный множитель roi.scale: %v", cfg.ROI.Scale)
+	}
+	if cfg.Logging.Format != "text" && cfg.Logging.Format != "json" {
+		return cfg, fmt.Errorf("неизвестный формат журнала logging.format: %q", cfg.Logging.Format)
+	}
+	if _, err := resolveLogLevels(nil, cfg.Logging.Level, cfg.Logging.Modules); err != nil {
+		return cfg, fmt.Errorf("некорректные уровни журнала logging: %v", err)
+	}
+	return cfg, nil
 }
 
-// Получение Pinnacle ID для команды
-func getTeamPinnacleId(teamName string) (int, error) {
-	var pinnacleId int
-	query := `
-        SELECT pt.id 
-        FROM sansabet_teams st
-        JOIN pinnacle_teams pt ON st.pinnacle_team_id = pt.id
-        WHERE st.name = ?`
+// Модули журнала, у каждого свой уровень
+const (
+	logModuleMain     = "main"     // запуск и настройки
+	logModuleDB       = "db"       // база данных и кэш команд
+	logModuleTeams    = "teams"    // поиск и связывание команд
+	logModuleLeagues  = "leagues"  // пары лиг
+	logModuleIngest   = "ingest"   // сообщения парсеров и их очереди
+	logModulePairs    = "pairs"    // пары матчей
+	logModuleOutcomes = "outcomes" // сравнение исходов и ROI
+	logModuleFrontend = "frontend" // клиенты фронтенда
+	logModuleAuth     = "auth"     // доступ и TLS
+)
 
-	err := db.QueryRow(query, teamName).Scan(&pinnacleId)
-	if err != nil {
-		return 0, err
-	}
-	return pinnacleId, nil
+var logModules = []string{
+	logModuleMain, logModuleDB, logModuleTeams, logModuleLeagues, logModuleIngest,
+	logModulePairs, logModuleOutcomes, logModuleFrontend, logModuleAuth,
 }
 
-// Получение названия команды по Pinnacle ID
-func getTeamNameByPinnacleId(pinnacleId int) (string, error) {
-	var teamName string
-	err := db.QueryRow("SELECT name FROM pinnacle_teams WHERE id = ?", pinnacleId).Scan(&teamName)
-	if err != nil {
-		return "", err
+// Текущие уровни модулей. Набор ключей не меняется после запуска,
+// сами уровни (slog.LevelVar) меняются атомарно из /admin/logging.
+var logLevels = func() map[string]*slog.LevelVar {
+	levels := make(map[string]*slog.LevelVar, len(logModules))
+	for _, module := range logModules {
+		levels[module] = new(slog.LevelVar)
 	}
-	return teamName, nil
-}
+	return levels
+}()
 
-// Получение Pinnacle ID напрямую по названию команды
-func getPinnacleIdDirectly(teamName string) (int, error) {
-	var pinnacleId int
-	query := `
-        SELECT pt.id
-        FROM pinnacle_teams pt
-        WHERE pt.name = ?`
+// Журналы модулей, создаются в setupLogging до запуска горутин.
+// Общие поля записей: module, source (источник), match_id (MatchId
+// парсера), pair_id (MatchPair.Key), client (адрес клиента), error.
+var (
+	logMain     *slog.Logger
+	logDB       *slog.Logger
+	logTeams    *slog.Logger
+	logLeagues  *slog.Logger
+	logIngest   *slog.Logger
+	logPairs    *slog.Logger
+	logOutcomes *slog.Logger
+	logFrontend *slog.Logger
+	logAuth     *slog.Logger
+)
 
-	err := db.QueryRow(query, teamName).Scan(&pinnacleId)
-	if err != nil {
-		return 0, err
-	}
-	return pinnacleId, nil
+// Обработчик журнала модуля: пропускает записи не ниже уровня модуля
+type moduleHandler struct {
+	slog.Handler
+	level *slog.LevelVar
 }
 
-// Проверка и связывание команд для матча
-func linkTeamsForMatch(home, away string) (bool, string, string) {
-	log.Printf("[DEBUG] Пытаемся найти связи для матча: Home=%s, Away=%s", home, away)
+func (h moduleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
 
-	homeLinked := linkTeam(home)
-	awayLinked := linkTeam(away)
+func (h moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
 
-	linkedHome := ""
-	linkedAway := ""
+func (h moduleHandler) WithGroup(name string) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
 
-	if homeLinked {
-		linkedHome = home
-	}
-	if awayLinked {
-		linkedAway = away
+// Уровень журнала по имени: debug, info, warn, error
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("неизвестный уровень %q", name)
 	}
+	return level, nil
+}
 
-	if homeLinked || awayLinked {
-		log.Printf("[DEBUG] Найдена связь: HomeLinked=%t, AwayLinked=%t", homeLinked, awayLinked)
-		return true, linkedHome, linkedAway
+// Уровни модулей после изменения: level (если задан) ставится всем
+// модулям, затем применяются уровни из modules
+func resolveLogLevels(current map[string]slog.Level, level string, modules map[string]string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level, len(logModules))
+	for module, moduleLevel := range current {
+		levels[module] = moduleLevel
 	}
-
-	log.Printf("[DEBUG] Связи не найдены для обеих команд: Home=%s, Away=%s", home, away)
-	return false, linkedHome, linkedAway
+	if level != "" {
+		parsed, err := parseLogLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		for _, module := range logModules {
+			levels[module] = parsed
+		}
+	}
+	for module, name := range modules {
+		if _, known := logLevels[module]; !known {
+			return nil, fmt.Errorf("неизвестный модуль %q", module)
+		}
+		parsed, err := parseLogLevel(name)
+		if err != nil {
+			return nil, fmt.Errorf("модуль %s: %v", module, err)
+		}
+		levels[module] = parsed
+	}
+	return levels, nil
 }
 
-// Проверяем связь для одной команды
-func linkTeam(teamName string) bool {
-	log.Printf("[DEBUG] Проверяем связь для команды %s в sansabetTeams", teamName)
-
-	query := `
-        SELECT EXISTS(
-            SELECT 1 FROM sansabet_teams st
-            JOIN pinnacle_teams pt ON st.pinnacle_team_id = pt.id
-            WHERE st.name = ?
-        )`
-
-	var linked bool
-	err := db.QueryRow(query, teamName).Scan(&linked)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка запроса для команды %s: %v", teamName, err)
-		return false
+// Текущие уровни модулей
+func currentLogLevels() map[string]slog.Level {
+	levels := make(map[string]slog.Level, len(logLevels))
+	for module, level := range logLevels {
+		levels[module] = level.Level()
 	}
-	return linked
+	return levels
 }
 
-// Обновление Pinnacle ID для команды Sansabet
-func updateTeamPinnacleId(sansabetTeam string, pinnacleId int) error {
-	query := `
-        UPDATE sansabet_teams 
-        SET pinnacle_team_id = ?
-        WHERE name = ?`
-
-	result, err := db.Exec(query, pinnacleId, sansabetTeam)
+// Журналы модулей по настройкам logging. Стандартный log тоже пишет
+// через slog (модуль main), чтобы все записи были в одном формате.
+func setupLogging(cfg LoggingConfig) error {
+	levels, err := resolveLogLevels(nil, cfg.Level, cfg.Modules)
 	if err != nil {
-		return fmt.Errorf("ошибка обновления pinnacle_team_id: %v", err)
+		return err
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("ошибка получения количества обновленных строк: %v", err)
+	for module, level := range levels {
+		logLevels[module].Set(level)
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("команда %s не найдена в базе данных", sansabetTeam)
+	options := &slog.HandlerOptions{Level: slog.LevelDebug} // Уровень проверяет moduleHandler
+	var base slog.Handler
+	if cfg.Format == "json" {
+		base = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		base = slog.NewTextHandler(os.Stderr, options)
+	}
+	moduleLogger := func(module string) *slog.Logger {
+		return slog.New(moduleHandler{Handler: base, level: logLevels[module]}).With("module", module)
 	}
 
+	logMain = moduleLogger(logModuleMain)
+	logDB = moduleLogger(logModuleDB)
+	logTeams = moduleLogger(logModuleTeams)
+	logLeagues = moduleLogger(logModuleLeagues)
+	logIngest = moduleLogger(logModuleIngest)
+	logPairs = moduleLogger(logModulePairs)
+	logOutcomes = moduleLogger(logModuleOutcomes)
+	logFrontend = moduleLogger(logModuleFrontend)
+	logAuth = moduleLogger(logModuleAuth)
+	slog.SetDefault(logMain)
 	return nil
 }
 
-// Обновление пар матчей
-func updateMatchPairs(parsedMsg *ParsedMessage) {
-	keySansabet := generateMatchKey(parsedMsg.Home, parsedMsg.Away)
-	pairsMutex.Lock()
-	defer pairsMutex.Unlock()
-
-	if _, exists := matchKeys[keySansabet]; exists {
-		log.Printf("[DEBUG] Матч уже существует: %s vs %s", parsedMsg.Home, parsedMsg.Away)
+// Уровни журнала: GET - текущие, POST {"level": "...", "modules": {...}} -
+// изменить без перезапуска
+func loggingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request LoggingConfig
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		levels, err := resolveLogLevels(currentLogLevels(), request.Level, request.Modules)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for module, level := range levels {
+			logLevels[module].Set(level)
+		}
+		logMain.Info("Уровни журнала изменены", "level", request.Level, "modules", request.Modules)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	pinnacleHomeId, err := getTeamPinnacleId(parsedMsg.Home)
-	if err != nil && err != sql.ErrNoRows {
-		log.Printf("[ERROR] Ошибка получения Pinnacle ID для команды Home: %v", err)
-		return
+	modules := make(map[string]string, len(logLevels))
+	for module, level := range currentLogLevels() {
+		modules[module] = strings.ToLower(level.String())
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"modules": modules})
+}
 
-	pinnacleAwayId, err := getTeamPinnacleId(parsedMsg.Away)
-	if err != nil && err != sql.ErrNoRows {
-		log.Printf("[ERROR] Ошибка получения Pinnacle ID для команды Away: %v", err)
-		return
+// Инициализация подключения к базе данных
+func initDB() {
+	var err error
+	repo, err := openTeamRepository(config.Database)
+	if err != nil {
+		logDB.Error("Ошибка подключения к базе данных", "error", err)
+		os.Exit(1)
 	}
+	teamRepo = &measuredTeamRepository{repo: repo}
+	logDB.Info("Подключение к базе данных установлено", "driver", config.Database.Driver)
 
-	if pinnacleHomeId == 0 && pinnacleAwayId == 0 {
-		log.Printf("[DEBUG] Нет связи с Pinnacle ни для одной из команд: %s vs %s", parsedMsg.Home, parsedMsg.Away)
-		return
+	if err := teamRepo.Migrate(); err != nil {
+		logDB.Error("Ошибка миграции схемы базы данных", "error", err)
+		os.Exit(1)
 	}
 
-	if pinnacleHomeId == 0 || pinnacleAwayId == 0 {
-		log.Printf("[DEBUG] Необходим PinnacleId для одной или обеих команд, пытаемся получить отсутствующие данные")
+	if err := teamCache.load(); err != nil {
+		logDB.Error("Ошибка загрузки кэша команд", "error", err)
+		os.Exit(1)
+	}
+}
 
-		if pinnacleHomeId != 0 && pinnacleAwayId == 0 {
-			knownTeamName, err := getTeamNameByPinnacleId(pinnacleHomeId)
-			if err != nil {
-				log.Printf("[ERROR] Ошибка получения названия команды по Pinnacle ID Home: %d. Ошибка: %v", pinnacleHomeId, err)
-				return
-			}
+// Открытие хранилища команд по настройкам
+func openTeamRepository(cfg DatabaseConfig) (TeamRepository, error) {
+	switch cfg.Driver {
+	case "mysql":
+		return NewMySQLTeamRepository(cfg.DSN)
+	case "sqlite":
+		return NewSQLiteTeamRepository(cfg.DSN)
+	default:
+		return nil, fmt.Errorf("неизвестный драйвер базы данных: %s", cfg.Driver)
+	}
+}
 
-			missingTeamName, err := findMissingTeamInMatchData(knownTeamName)
-			if err != nil {
-				log.Printf("[ERROR] Не удалось найти недостающую команду в matchData: %v", err)
-				return
-			}
+// Хранилище в MySQL
+func NewMySQLTeamRepository(dsn string) (*SQLTeamRepository, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("не удалось подключиться к базе: %v", err)
+	}
+	return &SQLTeamRepository{db: db, dialect: mysqlDialect}, nil
+}
 
-			pinnacleAwayId, err = getPinnacleIdDirectly(missingTeamName)
-			if err != nil {
-				log.Printf("[ERROR] Ошибка получения Pinnacle ID для недостающей команды Away: %s. Ошибка: %v", missingTeamName, err)
-				return
-			}
+// Встроенное хранилище SQLite: сервер базы данных не нужен, достаточно пути к файлу
+func NewSQLiteTeamRepository(dbPath string) (*SQLTeamRepository, error) {
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite допускает одного писателя, поэтому держим одно соединение
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("не удалось открыть базу %s: %v", dbPath, err)
+	}
+	return &SQLTeamRepository{db: db, dialect: sqliteDialect}, nil
+}
 
-			if err := updateTeamPinnacleId(parsedMsg.Away, pinnacleAwayId); err != nil {
-				log.Printf("[ERROR] Ошибка обновления связи для команды %s: %v", parsedMsg.Away, err)
-				return
-			}
-			log.Printf("[DEBUG] Успешно создана связь для команды %s с Pinnacle ID %d", parsedMsg.Away, pinnacleAwayId)
+func (r *SQLTeamRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLTeamRepository) FoldName(name string) string {
+	return r.dialect.FoldName(name)
+}
+
+// Сравнение utf8mb4_general_ci: без учёта регистра и диакритики
+// ("Málaga" = "MALAGA"), ß равна s, пробелы в конце не учитываются
+func foldGeneralCI(name string) string {
+	var folded strings.Builder
+	for _, r := range norm.NFD.String(strings.TrimRight(name, " ")) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// Диакритический знак после разложения NFD
+		case r == 'ß':
+			folded.WriteRune('S')
+		default:
+			folded.WriteRune(unicode.ToUpper(r))
 		}
+	}
+	return folded.String()
+}
 
-		if pinnacleAwayId != 0 && pinnacleHomeId == 0 {
-			knownTeamName, err := getTeamNameByPinnacleId(pinnacleAwayId)
-			if err != nil {
-				log.Printf("[ERROR] Ошибка получения названия команды по Pinnacle ID Away: %d. Ошибка: %v", pinnacleAwayId, err)
-				return
-			}
+// Сравнение NOCASE в SQLite: без учёта регистра только для латиницы ASCII
+func foldNoCase(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, name)
+}
 
-			missingTeamName, err := findMissingTeamInMatchData(knownTeamName)
-			if err != nil {
-				log.Printf("[ERROR] Не удалось найти недостающую команду в matchData: %v", err)
-				return
-			}
+// Загрузка встроенных миграций для диалекта, отсортированных по версии.
+// Файл миграции называется NNNN_описание.sql, где NNNN - номер версии.
+// Если для версии есть файл NNNN_описание.<диалект>.sql, он заменяет общий.
+func loadMigrations(dialect string) ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения каталога миграций: %v", err)
+	}
 
-			pinnacleHomeId, err = getPinnacleIdDirectly(missingTeamName)
-			if err != nil {
-				log.Printf("[ERROR] Ошибка получения Pinnacle ID для недостающей команды Home: %s. Ошибка: %v", missingTeamName, err)
-				return
-			}
+	byVersion := make(map[int]Migration)
+	dialectSpecific := make(map[int]bool)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		baseName := strings.TrimSuffix(fileName, ".sql")
+		forDialect := ""
+		if dot := strings.LastIndex(baseName, "."); dot != -1 {
+			forDialect = baseName[dot+1:]
+			baseName = baseName[:dot]
+		}
+		if forDialect != "" && forDialect != dialect {
+			continue
+		}
 
-			if err := updateTeamPinnacleId(parsedMsg.Home, pinnacleHomeId); err != nil {
-				log.Printf("[ERROR] Ошибка обновления связи для команды %s: %v", parsedMsg.Home, err)
-				return
-			}
-			log.Printf("[DEBUG] Успешно создана связь для команды %s с Pinnacle ID %d", parsedMsg.Home, pinnacleHomeId)
+		parts := strings.SplitN(baseName, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("некорректное имя файла миграции: %s", fileName)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("некорректный номер версии в файле миграции: %s", fileName)
+		}
+		if other, exists := byVersion[version]; exists && other.Name != parts[1] {
+			return nil, fmt.Errorf("версия %d встречается в миграциях %s и %s", version, other.Name, parts[1])
+		}
+		if forDialect == "" && dialectSpecific[version] {
+			continue
 		}
 
-		if pinnacleHomeId == 0 || pinnacleAwayId == 0 {
-			log.Printf("[ERROR] Не удалось получить обе команды для матча после попыток: HomeId=%d, AwayId=%d", pinnacleHomeId, pinnacleAwayId)
-			return
+		data, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения миграции %s: %v", fileName, err)
+		}
+		byVersion[version] = Migration{Version: version, Name: parts[1], SQL: string(data)}
+		if forDialect != "" {
+			dialectSpecific[version] = true
 		}
 	}
 
-	linkedHome, err := getTeamNameByPinnacleId(pinnacleHomeId)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка получения названия команды Home по Pinnacle ID: %d. Ошибка: %v", pinnacleHomeId, err)
-		return
+	migrations := []Migration{}
+	for _, migration := range byVersion {
+		migrations = append(migrations, migration)
 	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
 
-	linkedAway, err := getTeamNameByPinnacleId(pinnacleAwayId)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка получения названия команды Away по Pinnacle ID: %d. Ошибка: %v", pinnacleAwayId, err)
-		return
+// Разделение файла миграции на отдельные выражения.
+// Комментарии "--" отбрасываются, выражения разделяются точкой с запятой.
+func splitMigrationStatements(script string) []string {
+	var cleaned strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		cleaned.WriteString(line)
+		cleaned.WriteString("\n")
 	}
 
-	keyPinnacle := generateMatchKey(linkedHome, linkedAway)
-
-	pinnacleData, pinnacleExists := matchData["Pinnacle"][keyPinnacle]
-	if !pinnacleExists {
-		log.Printf("[DEBUG] Отсутствуют данные от Pinnacle для матча: %s", parsedMsg.MatchName)
-		return
+	statements := []string{}
+	for _, statement := range strings.Split(cleaned.String(), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
 	}
+	return statements
+}
 
-	var pinnacleMsg struct {
-		MatchId   string `json:"MatchId"`
-		MatchName string `json:"MatchName"`
-		HomeScore int64  `json:"HomeScore"`
-		AwayScore int64  `json:"AwayScore"`
+// Текущая версия схемы. Базы, созданные старым скриптом manualMatch.sql
+// (таблицы есть, schema_version нет), считаются находящимися на версии 1.
+func (r *SQLTeamRepository) currentSchemaVersion() (int, error) {
+	if _, err := r.db.Exec(r.dialect.SchemaVersionDDL); err != nil {
+		return 0, fmt.Errorf("ошибка создания таблицы schema_version: %v", err)
 	}
 
-	if err := json.Unmarshal([]byte(pinnacleData.Data), &pinnacleMsg); err != nil {
-		log.Printf("[ERROR] Ошибка парсинга данных Pinnacle: %v", err)
-		return
+	var version int
+	if err := r.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("ошибка чтения версии схемы: %v", err)
+	}
+	if version > 0 {
+		return version, nil
 	}
 
-	matchParts := strings.SplitN(pinnacleMsg.MatchName, " vs ", 2)
-	if len(matchParts) != 2 {
-		log.Printf("[ERROR] Некорректный формат MatchName: %s", pinnacleMsg.MatchName)
-		return
+	var legacyTables int
+	if err := r.db.QueryRow(r.dialect.LegacyTableQuery).Scan(&legacyTables); err != nil {
+		return 0, fmt.Errorf("ошибка проверки существующих таблиц: %v", err)
 	}
-	pinnacleHome := matchParts[0]
-	pinnacleAway := matchParts[1]
+	if legacyTables > 0 {
+		logDB.Info("Найдена схема, созданная manualMatch.sql, отмечаем её как версию 1")
+		if _, err := r.db.Exec("INSERT INTO schema_version (version, name) VALUES (1, 'initial_schema')"); err != nil {
+			return 0, fmt.Errorf("ошибка записи базовой версии схемы: %v", err)
+		}
+		return 1, nil
+	}
+	return 0, nil
+}
 
-	newPair := MatchPair{
-		SansabetId:   parsedMsg.MatchId,
-		SansabetName: parsedMsg.MatchName,
-		SansabetHome: parsedMsg.Home,
-		SansabetAway: parsedMsg.Away,
-		PinnacleId:   pinnacleMsg.MatchId,
-		PinnacleName: pinnacleMsg.MatchName,
-		PinnacleHome: pinnacleHome,
-		PinnacleAway: pinnacleAway,
-		Score:        fmt.Sprintf("%d - %d", pinnacleMsg.HomeScore, pinnacleMsg.AwayScore),
+// Применение недостающих миграций. Миграции только вперёд:
+// каждая применяется один раз и записывается в schema_version.
+func (r *SQLTeamRepository) Migrate() error {
+	migrations, err := loadMigrations(r.dialect.Name)
+	if err != nil {
+		return err
 	}
 
-	matchPairs = append(matchPairs, newPair)
-	matchKeys[keySansabet] = true
+	version, err := r.currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	logDB.Debug("Текущая версия схемы", "version", version)
 
-	log.Printf("[DEBUG] Новая пара добавлена в matchPairs: %v", newPair)
-}
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
 
-// Поиск недостающей команды в matchData
-func findMissingTeamInMatchData(knownTeam string) (string, error) {
-	log.Printf("[DEBUG] Начинаем поиск недостающей команды с известной командой: %s", knownTeam)
+		logDB.Info("Применяем миграцию", "version", migration.Version, "name", migration.Name)
+		if err := r.applyMigration(migration); err != nil {
+			return err
+		}
+		version = migration.Version
+	}
 
-	if pinnacleMatches, exists := matchData["Pinnacle"]; exists {
-		log.Printf("[DEBUG] Найдены данные для источника Pinnacle, количество матчей: %d", len(pinnacleMatches))
+	logDB.Info("Схема базы данных актуальна", "version", version)
+	return nil
+}
 
-		for key, matchJSON := range pinnacleMatches {
-			log.Printf("[DEBUG] Обрабатываем матч с ключом: %s", key)
+// Применение одной миграции: выражения и запись версии идут в одной транзакции.
+// В SQLite DDL транзакционный, и миграция применяется целиком или не применяется.
+// В MySQL DDL неявно фиксирует транзакцию, поэтому скрипты MySQL повторяемы:
+// данные меняются идемпотентно, а ошибки «уже существует» от DDL при повторном
+// запуске после сбоя пропускаются (SQLDialect.AlreadyApplied).
+func (r *SQLTeamRepository) applyMigration(migration Migration) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("миграция %04d_%s: ошибка начала транзакции: %v", migration.Version, migration.Name, err)
+	}
+	defer tx.Rollback()
 
-			var match struct {
-				MatchName string `json:"MatchName"`
-			}
-			if err := json.Unmarshal([]byte(matchJSON.Data), &match); err != nil {
-				log.Printf("[DEBUG] Ошибка парсинга JSON для ключа %s: %v", key, err)
+	for _, statement := range splitMigrationStatements(migration.SQL) {
+		if _, err := tx.Exec(statement); err != nil {
+			if r.dialect.AlreadyApplied != nil && r.dialect.AlreadyApplied(err) {
+				logDB.Warn("Выражение миграции уже применено, пропускаем", "version", migration.Version, "error", err)
 				continue
 			}
+			return fmt.Errorf("миграция %04d_%s: %v | Запрос: %s", migration.Version, migration.Name, err, statement)
+		}
+	}
 
-			log.Printf("[DEBUG] Успешно распарсен матч: %s", match.MatchName)
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name) VALUES (?, ?)", migration.Version, migration.Name); err != nil {
+		return fmt.Errorf("ошибка записи версии %d: %v", migration.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("миграция %04d_%s: ошибка фиксации: %v", migration.Version, migration.Name, err)
+	}
+	return nil
+}
 
-			teams := strings.Split(match.MatchName, " vs ")
-			log.Printf("[DEBUG] Разделенные команды: %v", teams)
+// Ошибки MySQL, которые DDL возвращает для уже созданного объекта:
+// таблица (1050), столбец (1060), индекс (1061) есть или индекса для DROP уже нет (1091)
+func mysqlAlreadyApplied(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1050, 1060, 1061, 1091:
+		return true
+	}
+	return false
+}
 
-			if len(teams) == 2 {
-				if teams[0] == knownTeam {
-					log.Printf("[DEBUG] Известная команда найдена как первая, возвращаем вторую: %s", teams[1])
-					return teams[1], nil
-				} else if teams[1] == knownTeam {
-					log.Printf("[DEBUG] Известная команда найдена как вторая, возвращаем первую: %s", teams[0])
-					return teams[0], nil
-				}
-			} else {
-				log.Printf("[DEBUG] Ошибка: Название матча имеет некорректный формат: %s", match.MatchName)
+// Все команды обоих источников с лигами и видами спорта
+func (r *SQLTeamRepository) LoadTeams() ([]StoredTeam, error) {
+	teams := []StoredTeam{}
+	for _, source := range []string{"Pinnacle", "Sansabet"} {
+		prefix := "sansabet"
+		if source == "Pinnacle" {
+			prefix = "pinnacle"
+		}
+		rows, err := r.db.Query(`
+            SELECT t.id, t.name, l.name, s.name
+            FROM ` + prefix + `_teams t
+            JOIN ` + prefix + `_leagues l ON t.league_id = l.id
+            JOIN sports s ON t.sport_id = s.id
+            ORDER BY t.id`)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка загрузки команд %s: %v", source, err)
+		}
+		for rows.Next() {
+			team := StoredTeam{Source: source}
+			if err := rows.Scan(&team.Id, &team.Name, &team.League, &team.Sport); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("ошибка чтения команды %s: %v", source, err)
 			}
+			teams = append(teams, team)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("ошибка чтения команд %s: %v", source, err)
+		}
+	}
+	return teams, nil
+}
+
+// Все алиасы команд обоих источников
+func (r *SQLTeamRepository) LoadAliases() ([]TeamAlias, error) {
+	rows, err := r.db.Query(`
+        SELECT a.canonical_team_id, a.source, s.name, a.name
+        FROM team_aliases a
+        JOIN sports s ON a.sport_id = s.id
+        ORDER BY a.id`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки алиасов команд: %v", err)
+	}
+	defer rows.Close()
+
+	aliases := []TeamAlias{}
+	for rows.Next() {
+		var alias TeamAlias
+		if err := rows.Scan(&alias.CanonicalId, &alias.Source, &alias.Sport, &alias.Name); err != nil {
+			return nil, fmt.Errorf("ошибка чтения алиаса команды: %v", err)
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, rows.Err()
+}
+
+// Вставка команды; вид спорта и лига создаются при необходимости
+func (r *SQLTeamRepository) InsertTeam(source, teamName, league, sport string) (int, error) {
+	// Сначала убедимся, что существует вид спорта
+	var sportId int64
+	err := r.db.QueryRow("SELECT id FROM sports WHERE name = ?", sport).Scan(&sportId)
+	if err == sql.ErrNoRows {
+		result, err := r.db.Exec("INSERT INTO sports (name) VALUES (?)", sport)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания вида спорта %s: %v", sport, err)
+		}
+		sportId, _ = result.LastInsertId()
+	} else if err != nil {
+		return 0, fmt.Errorf("ошибка поиска вида спорта %s: %v", sport, err)
+	}
+
+	// Теперь проверим/создадим лигу
+	var leagueId int64
+	var leagueQuery string
+	if source == "Pinnacle" {
+		leagueQuery = "SELECT id FROM pinnacle_leagues WHERE name = ? AND sport_id = ?"
+	} else {
+		leagueQuery = "SELECT id FROM sansabet_leagues WHERE name = ? AND sport_id = ?"
+	}
+
+	err = r.db.QueryRow(leagueQuery, league, sportId).Scan(&leagueId)
+	if err == sql.ErrNoRows {
+		var leagueInsertQuery string
+		if source == "Pinnacle" {
+			leagueInsertQuery = "INSERT INTO pinnacle_leagues (name, sport_id) VALUES (?, ?)"
+		} else {
+			leagueInsertQuery = "INSERT INTO sansabet_leagues (name, sport_id) VALUES (?, ?)"
 		}
-		log.Printf("[DEBUG] Матч с известной командой %s не найден в Pinnacle", knownTeam)
+
+		result, err := r.db.Exec(leagueInsertQuery, league, sportId)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания лиги %s: %v", league, err)
+		}
+		leagueId, _ = result.LastInsertId()
+	} else if err != nil {
+		return 0, fmt.Errorf("ошибка поиска лиги %s: %v", league, err)
+	}
+
+	// Теперь вставляем команду
+	var teamInsertQuery string
+	if source == "Pinnacle" {
+		teamInsertQuery = "INSERT INTO pinnacle_teams (name, sport_id, league_id) VALUES (?, ?, ?)"
 	} else {
-		log.Printf("[DEBUG] Источник Pinnacle отсутствует в matchData")
+		teamInsertQuery = "INSERT INTO sansabet_teams (name, sport_id, league_id) VALUES (?, ?, ?)"
 	}
 
-	return "", fmt.Errorf("команда %s не найдена в matchData", knownTeam)
+	result, err := r.db.Exec(teamInsertQuery, teamName, sportId, leagueId)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка создания команды %s: %v", teamName, err)
+	}
+
+	teamId, _ := result.LastInsertId()
+	return int(teamId), nil
 }
 
-// Генерация ключа матча
-func generateMatchKey(home, away string) string {
-	const emptyHash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+// Запросы, которые выполняются и на базе, и внутри транзакции
+type sqlExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
 
-	h1 := sha1.Sum([]byte(home))
-	h2 := sha1.Sum([]byte(away))
+// Связывание команды Sansabet с командой Pinnacle. Написание Sansabet
+// становится алиасом канонической команды, поэтому связь действует во всех
+// лигах, где встречается это название. Все записи идут в одной транзакции:
+// при ошибке не остаётся канонической команды без алиаса или строки
+// sansabet_teams со связью, но без алиаса. Возвращает ID канонической команды.
+func (r *SQLTeamRepository) LinkTeam(sansabetTeam string, pinnacleId int) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %v", err)
+	}
+	defer tx.Rollback()
 
-	hexH1 := hex.EncodeToString(h1[:])
-	hexH2 := hex.EncodeToString(h2[:])
+	var pinnacleName string
+	var sportId int64
+	err = tx.QueryRow("SELECT name, sport_id FROM pinnacle_teams WHERE id = ?", pinnacleId).Scan(&pinnacleName, &sportId)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("команда Pinnacle с ID %d не найдена в базе данных", pinnacleId)
+	} else if err != nil {
+		return 0, fmt.Errorf("ошибка поиска команды Pinnacle %d: %v", pinnacleId, err)
+	}
 
-	if hexH1 == emptyHash || hexH2 == emptyHash {
-		log.Printf("[WARNING] One of the teams has an empty hash: home hash = %s, away hash = %s", hexH1, hexH2)
+	// MySQL считает в RowsAffected только изменённые строки, поэтому
+	// наличие команды проверяем отдельно, а не по результату UPDATE
+	var teamRows int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sansabet_teams WHERE name = ? AND sport_id = ?", sansabetTeam, sportId).Scan(&teamRows); err != nil {
+		return 0, fmt.Errorf("ошибка поиска команды %s: %v", sansabetTeam, err)
+	}
+	if teamRows == 0 {
+		return 0, fmt.Errorf("команда %s не найдена в базе данных", sansabetTeam)
 	}
 
-	return hexH1 + hexH2
+	query := `
+        UPDATE sansabet_teams 
+        SET pinnacle_team_id = ?
+        WHERE name = ? AND sport_id = ?`
+
+	if _, err := tx.Exec(query, pinnacleId, sansabetTeam, sportId); err != nil {
+		return 0, fmt.Errorf("ошибка обновления pinnacle_team_id: %v", err)
+	}
+
+	canonicalId, err := ensureCanonicalTeam(tx, pinnacleName, sportId)
+	if err != nil {
+		return 0, err
+	}
+	if err := setAlias(tx, canonicalId, sportId, "Sansabet", sansabetTeam); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ошибка фиксации связи команды %s: %v", sansabetTeam, err)
+	}
+	return int(canonicalId), nil
 }
 
-// Обработка пар матчей
-func processPairs() {
-	localMatchData := make(map[string]map[string]*MatchData)
-	matchDataMutex.RLock()
-	for source, matches := range matchData {
-		localMatchData[source] = make(map[string]*MatchData)
-		for key, match := range matches {
-			localMatchData[source][key] = match
+// Каноническая команда, к которой относится написание Pinnacle; создаётся при необходимости
+func ensureCanonicalTeam(db sqlExecutor, pinnacleName string, sportId int64) (int64, error) {
+	var canonicalId int64
+	err := db.QueryRow(
+		"SELECT canonical_team_id FROM team_aliases WHERE source = 'Pinnacle' AND sport_id = ? AND name = ?",
+		sportId, pinnacleName).Scan(&canonicalId)
+	if err == nil {
+		return canonicalId, nil
+	} else if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("ошибка поиска алиаса %s: %v", pinnacleName, err)
+	}
+
+	err = db.QueryRow("SELECT id FROM canonical_teams WHERE sport_id = ? AND name = ?", sportId, pinnacleName).Scan(&canonicalId)
+	if err == sql.ErrNoRows {
+		result, err := db.Exec("INSERT INTO canonical_teams (sport_id, name) VALUES (?, ?)", sportId, pinnacleName)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания канонической команды %s: %v", pinnacleName, err)
 		}
+		canonicalId, _ = result.LastInsertId()
+	} else if err != nil {
+		return 0, fmt.Errorf("ошибка поиска канонической команды %s: %v", pinnacleName, err)
 	}
-	matchDataMutex.RUnlock()
 
-	// Удаление устаревших матчей
-	for source, matches := range localMatchData {
-		for key, match := range matches {
-			if time.Since(match.LastUpdate) > maxStaleDuration {
-				log.Printf("[DEBUG] Удаляем устаревший матч: Source=%s, Key=%s", source, key)
-				matchDataMutex.Lock()
-				delete(matchData[source], key)
-				matchDataMutex.Unlock()
-			}
+	if err := setAlias(db, canonicalId, sportId, "Pinnacle", pinnacleName); err != nil {
+		return 0, err
+	}
+	return canonicalId, nil
+}
+
+// Привязка написания к канонической команде (существующий алиас переназначается)
+func setAlias(db sqlExecutor, canonicalId, sportId int64, source, teamName string) error {
+	var currentId int64
+	err := db.QueryRow(
+		"SELECT canonical_team_id FROM team_aliases WHERE source = ? AND sport_id = ? AND name = ?",
+		source, sportId, teamName).Scan(&currentId)
+	if err == nil {
+		if currentId == canonicalId {
+			return nil
+		}
+		_, err = db.Exec(
+			"UPDATE team_aliases SET canonical_team_id = ? WHERE source = ? AND sport_id = ? AND name = ?",
+			canonicalId, source, sportId, teamName)
+		if err != nil {
+			return fmt.Errorf("ошибка обновления алиаса %s: %v", teamName, err)
+		}
+		return nil
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("ошибка поиска алиаса %s: %v", teamName, err)
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO team_aliases (canonical_team_id, sport_id, source, name) VALUES (?, ?, ?, ?)",
+		canonicalId, sportId, source, teamName)
+	if err != nil {
+		return fmt.Errorf("ошибка создания алиаса %s: %v", teamName, err)
+	}
+	return nil
+}
+
+// Количество связанных команд по парам лиг Sansabet/Pinnacle
+func (r *SQLTeamRepository) LoadLeagueLinkStats() ([]LeagueLinkStat, error) {
+	rows, err := r.db.Query(`
+        SELECT sl.id, sl.name, pl.id, pl.name, COUNT(*)
+        FROM sansabet_teams st
+        JOIN sansabet_leagues sl ON st.league_id = sl.id
+        JOIN pinnacle_teams pt ON st.pinnacle_team_id = pt.id
+        JOIN pinnacle_leagues pl ON pt.league_id = pl.id
+        GROUP BY sl.id, sl.name, pl.id, pl.name`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подсчёта связей лиг: %v", err)
+	}
+	defer rows.Close()
+
+	stats := []LeagueLinkStat{}
+	for rows.Next() {
+		var stat LeagueLinkStat
+		if err := rows.Scan(&stat.SansabetLeagueId, &stat.SansabetLeague, &stat.PinnacleLeagueId, &stat.PinnacleLeague, &stat.LinkedTeams); err != nil {
+			return nil, fmt.Errorf("ошибка чтения связей лиг: %v", err)
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Уже созданные пары лиг
+func (r *SQLTeamRepository) LoadLeagueMatches() ([]LeagueMatch, error) {
+	rows, err := r.db.Query("SELECT pinnacle_league_id, sansabet_league_id FROM league_matches")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки пар лиг: %v", err)
+	}
+	defer rows.Close()
+
+	matches := []LeagueMatch{}
+	for rows.Next() {
+		var match LeagueMatch
+		if err := rows.Scan(&match.PinnacleLeagueId, &match.SansabetLeagueId); err != nil {
+			return nil, fmt.Errorf("ошибка чтения пары лиг: %v", err)
+		}
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
+
+// Создание пары лиг
+func (r *SQLTeamRepository) CreateLeagueMatch(pinnacleLeagueId, sansabetLeagueId int, autoCreated bool) error {
+	_, err := r.db.Exec(
+		"INSERT INTO league_matches (pinnacle_league_id, sansabet_league_id, auto_created) VALUES (?, ?, ?)",
+		pinnacleLeagueId, sansabetLeagueId, autoCreated)
+	if err != nil {
+		return fmt.Errorf("ошибка создания пары лиг %d/%d: %v", pinnacleLeagueId, sansabetLeagueId, err)
+	}
+	return nil
+}
+
+// Запуск анализатора
+func startAnalyzer() {
+	logMain.Info("Анализатор запущен")
+	warnOpenAccess()
+	go state.run()
+	ingest := newParserIngest("Sansabet", "Pinnacle")
+	ingest.start()
+	go startParserServer(7100, "Sansabet", ingest.queues["Sansabet"])
+	go startParserServer(7200, "Pinnacle", ingest.queues["Pinnacle"])
+	go startFrontendServer(ingest)
+	go frontendTickLoop(ingest)
+	go reloadTeamCachePeriodically()
+	go matchLeaguesPeriodically()
+}
+
+// Метрики Prometheus, /metrics на порту 7300
+var (
+	metricParserMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analyzer_parser_messages_total",
+		Help: "Сообщения, полученные от парсеров",
+	}, []string{"source"})
+	metricParserLastMessage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analyzer_parser_last_message_timestamp_seconds",
+		Help: "Время последнего сообщения от парсера (unix)",
+	}, []string{"source"})
+	metricIngestDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analyzer_ingest_queue_depth",
+		Help: "Матчей в очереди сообщений парсера",
+	}, []string{"source"})
+	metricIngestCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analyzer_ingest_coalesced_total",
+		Help: "Сообщения, замененные более новым сообщением того же матча",
+	}, []string{"source"})
+	metricIngestDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analyzer_ingest_dropped_total",
+		Help: "Сообщения, выброшенные из переполненной очереди",
+	}, []string{"source"})
+	metricIngestLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "analyzer_ingest_lag_seconds",
+		Help:    "Задержка от постановки сообщения в очередь до конца обработки",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+	}, []string{"source"})
+	metricActiveMatches = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analyzer_active_matches",
+		Help: "Матчи с данными по источникам",
+	}, []string{"source"})
+	metricActivePairs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analyzer_active_pairs",
+		Help: "Пары матчей Sansabet и Pinnacle",
+	})
+	metricPairsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analyzer_pairs_created_total",
+		Help: "Созданные пары матчей",
+	})
+	metricPairsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analyzer_pairs_closed_total",
+		Help: "Удаленные пары: expired - нет данных, removed - матч снят парсером",
+	}, []string{"reason"})
+	metricUnlinkedMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analyzer_unlinked_teams_total",
+		Help: "Сообщения, в которых ни одна команда не связана с Pinnacle",
+	}, []string{"source"})
+	metricOutcomesAboveROI = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analyzer_outcomes_above_roi",
+		Help: "Исходы в текущих результатах с ROI не ниже порога, %",
+	}, []string{"threshold"})
+	metricFrontendClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analyzer_frontend_clients",
+		Help: "Подключенные клиенты фронтенда",
+	})
+	metricFrontendQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analyzer_frontend_queue_depth",
+		Help: "Сообщения в очередях отправки всех клиентов фронтенда",
+	})
+	metricFrontendQueueDepthMax = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analyzer_frontend_queue_depth_max",
+		Help: "Наибольшая очередь отправки среди клиентов фронтенда",
+	})
+	metricFrontendDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analyzer_frontend_dropped_messages_total",
+		Help: "Сообщения, выброшенные из переполненных очередей клиентов",
+	})
+	metricFrontendDisconnected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analyzer_frontend_slow_disconnects_total",
+		Help: "Клиенты, отключенные из-за переполненной очереди",
+	})
+	metricDBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "analyzer_db_query_duration_seconds",
+		Help:    "Длительность операций хранилища команд",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+	metricDBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analyzer_db_errors_total",
+		Help: "Ошибки операций хранилища команд",
+	}, []string{"op"})
+)
+
+// Пороги ROI для analyzer_outcomes_above_roi
+var roiMetricThresholds = []float64{0, 2, 5, 10}
+
+// Размеры состояния для метрик, вызывается в горутине-владельце
+func (st *analyzerState) updateStateMetrics() {
+	for source, matches := range st.matchData {
+		metricActiveMatches.WithLabelValues(source).Set(float64(len(matches)))
+	}
+	metricActivePairs.Set(float64(len(st.matchPairs)))
+	metricFrontendClients.Set(float64(len(st.frontendClients)))
+
+	total, deepest := 0, 0
+	for _, client := range st.frontendClients {
+		depth := len(client.sender.queue)
+		total += depth
+		if depth > deepest {
+			deepest = depth
+		}
+	}
+	metricFrontendQueueDepth.Set(float64(total))
+	metricFrontendQueueDepthMax.Set(float64(deepest))
+}
+
+// Число исходов с ROI не ниже порогов по текущим результатам
+func (f *frontendFeed) updateROIMetrics() {
+	counts := make([]int, len(roiMetricThresholds))
+	for _, result := range f.results {
+		outcomes, _ := result["Outcomes"].([]map[string]interface{})
+		for _, outcome := range outcomes {
+			roi, _ := outcome["ROI"].(float64)
+			for i, threshold := range roiMetricThresholds {
+				if roi >= threshold {
+					counts[i]++
+				}
+			}
+		}
+	}
+	for i, threshold := range roiMetricThresholds {
+		metricOutcomesAboveROI.WithLabelValues(strconv.FormatFloat(threshold, 'f', -1, 64)).Set(float64(counts[i]))
+	}
+}
+
+// Хранилище команд с замером длительности и ошибок операций
+type measuredTeamRepository struct {
+	repo TeamRepository
+}
+
+// Учет длительности и ошибки операции op
+func observeDB(op string, start time.Time, err error) {
+	metricDBQueryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricDBErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (m *measuredTeamRepository) Migrate() error {
+	start := time.Now()
+	err := m.repo.Migrate()
+	observeDB("Migrate", start, err)
+	return err
+}
+
+func (m *measuredTeamRepository) LoadTeams() ([]StoredTeam, error) {
+	start := time.Now()
+	teams, err := m.repo.LoadTeams()
+	observeDB("LoadTeams", start, err)
+	return teams, err
+}
+
+func (m *measuredTeamRepository) LoadAliases() ([]TeamAlias, error) {
+	start := time.Now()
+	aliases, err := m.repo.LoadAliases()
+	observeDB("LoadAliases", start, err)
+	return aliases, err
+}
+
+func (m *measuredTeamRepository) InsertTeam(source, teamName, league, sport string) (int, error) {
+	start := time.Now()
+	id, err := m.repo.InsertTeam(source, teamName, league, sport)
+	observeDB("InsertTeam", start, err)
+	return id, err
+}
+
+func (m *measuredTeamRepository) LinkTeam(sansabetTeam string, pinnacleId int) (int, error) {
+	start := time.Now()
+	id, err := m.repo.LinkTeam(sansabetTeam, pinnacleId)
+	observeDB("LinkTeam", start, err)
+	return id, err
+}
+
+func (m *measuredTeamRepository) LoadLeagueLinkStats() ([]LeagueLinkStat, error) {
+	start := time.Now()
+	stats, err := m.repo.LoadLeagueLinkStats()
+	observeDB("LoadLeagueLinkStats", start, err)
+	return stats, err
+}
+
+func (m *measuredTeamRepository) LoadLeagueMatches() ([]LeagueMatch, error) {
+	start := time.Now()
+	matches, err := m.repo.LoadLeagueMatches()
+	observeDB("LoadLeagueMatches", start, err)
+	return matches, err
+}
+
+func (m *measuredTeamRepository) CreateLeagueMatch(pinnacleLeagueId, sansabetLeagueId int, autoCreated bool) error {
+	start := time.Now()
+	err := m.repo.CreateLeagueMatch(pinnacleLeagueId, sansabetLeagueId, autoCreated)
+	observeDB("CreateLeagueMatch", start, err)
+	return err
+}
+
+func (m *measuredTeamRepository) FoldName(name string) string {
+	return m.repo.FoldName(name)
+}
+
+func (m *measuredTeamRepository) Close() error {
+	return m.repo.Close()
+}
+
+// Ограниченная очередь сообщений одного парсера. По каждому матчу хранится
+// только последнее сообщение: пока анализатор занят, новые цены заменяют
+// старые, а чтение из WebSocket парсера не ждёт обработки. Сообщения
+// обрабатывает одна горутина run в порядке первого поступления матча.
+type ingestQueue struct {
+	source  string
+	mu      sync.Mutex
+	pending map[string]ingestItem // ключ очереди (ingestKey) -> последнее сообщение
+	order   []string              // ключи в порядке поступления
+	wake    chan struct{}
+	stats   IngestStats
+}
+
+type ingestItem struct {
+	msg      []byte
+	received time.Time // Когда матч встал в очередь
+}
+
+// Счетчики очереди парсера для фронтенда и /admin/ingest
+type IngestStats struct {
+	Received     int64 `json:"received"`
+	Processed    int64 `json:"processed"`
+	Coalesced    int64 `json:"coalesced"`    // Заменены более новым сообщением того же матча
+	Dropped      int64 `json:"dropped"`      // Выброшены из переполненной очереди
+	Depth        int   `json:"depth"`        // Матчей в очереди сейчас
+	LagMillis    int64 `json:"lagMillis"`    // Задержка последнего обработанного сообщения
+	MaxLagMillis int64 `json:"maxLagMillis"` // Наибольшая задержка с прошлого отчёта фронтенду
+}
+
+// Ключ пустого сообщения, которое снимает все матчи источника
+const ingestResetKey = "*"
+
+func newIngestQueue(source string) *ingestQueue {
+	return &ingestQueue{
+		source:  source,
+		pending: make(map[string]ingestItem),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Ключ очереди: MatchId матча, для пустого сообщения - ingestResetKey.
+// Сообщение без MatchId получает собственный ключ и ни с чем не склеивается.
+func (q *ingestQueue) ingestKey(msg []byte) string {
+	if len(msg) == 0 || string(msg) == "[]" {
+		return ingestResetKey
+	}
+	var header struct {
+		MatchId string `json:"MatchId"`
+	}
+	if err := json.Unmarshal(msg, &header); err != nil || header.MatchId == "" {
+		return fmt.Sprintf("#%d", q.stats.Received)
+	}
+	return header.MatchId
+}
+
+// Постановка сообщения в очередь без ожидания
+func (q *ingestQueue) push(msg []byte) {
+	metricParserMessages.WithLabelValues(q.source).Inc()
+	metricParserLastMessage.WithLabelValues(q.source).SetToCurrentTime()
+
+	q.mu.Lock()
+	q.stats.Received++
+	key := q.ingestKey(msg)
+	now := time.Now()
+
+	if key == ingestResetKey {
+		// Пустое сообщение снимает все матчи, ожидающие сообщения не нужны
+		q.stats.Coalesced += int64(len(q.order))
+		metricIngestCoalesced.WithLabelValues(q.source).Add(float64(len(q.order)))
+		q.pending = make(map[string]ingestItem)
+		q.order = nil
+	}
+
+	if item, exists := q.pending[key]; exists {
+		q.pending[key] = ingestItem{msg: msg, received: item.received}
+		q.stats.Coalesced++
+		metricIngestCoalesced.WithLabelValues(q.source).Inc()
+	} else {
+		if len(q.order) >= config.Ingest.QueueSize {
+			oldest := q.order[0]
+			q.order = q.order[1:]
+			delete(q.pending, oldest)
+			q.stats.Dropped++
+			metricIngestDropped.WithLabelValues(q.source).Inc()
+			logIngest.Warn("Очередь переполнена, выброшено сообщение матча", "source", q.source, "match_id", oldest, "queue_size", config.Ingest.QueueSize)
+		}
+		q.pending[key] = ingestItem{msg: msg, received: now}
+		q.order = append(q.order, key)
+	}
+	metricIngestDepth.WithLabelValues(q.source).Set(float64(len(q.order)))
+	q.mu.Unlock()
+	if logIngest.Enabled(context.Background(), slog.LevelDebug) {
+		logIngest.Debug("Получено сообщение парсера", "source", q.source, "match_id", key, "body", string(msg))
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Следующее сообщение очереди, с ожиданием
+func (q *ingestQueue) pop() ingestItem {
+	for {
+		q.mu.Lock()
+		if len(q.order) > 0 {
+			key := q.order[0]
+			q.order = q.order[1:]
+			item := q.pending[key]
+			delete(q.pending, key)
+			metricIngestDepth.WithLabelValues(q.source).Set(float64(len(q.order)))
+			q.mu.Unlock()
+			return item
+		}
+		q.mu.Unlock()
+		<-q.wake
+	}
+}
+
+// Горутина обработки сообщений парсера
+func (q *ingestQueue) run() {
+	for {
+		item := q.pop()
+		saveMatchData(q.source, item.msg)
+
+		metricIngestLag.WithLabelValues(q.source).Observe(time.Since(item.received).Seconds())
+		lag := time.Since(item.received).Milliseconds()
+		q.mu.Lock()
+		q.stats.Processed++
+		q.stats.LagMillis = lag
+		if lag > q.stats.MaxLagMillis {
+			q.stats.MaxLagMillis = lag
+		}
+		q.mu.Unlock()
+	}
+}
+
+// Текущие счетчики очереди. resetMax начинает новый период MaxLagMillis.
+func (q *ingestQueue) snapshot(resetMax bool) IngestStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Depth = len(q.order)
+	if resetMax {
+		q.stats.MaxLagMillis = 0
+	}
+	return stats
+}
+
+// Очереди сообщений всех парсеров. Создаются в startAnalyzer и передаются
+// серверам парсеров и фронтенда; набор очередей после создания не меняется,
+// поэтому читать queues можно без блокировки.
+type parserIngest struct {
+	queues map[string]*ingestQueue // источник -> очередь сообщений парсера
+}
+
+func newParserIngest(sources ...string) *parserIngest {
+	ingest := &parserIngest{queues: make(map[string]*ingestQueue, len(sources))}
+	for _, source := range sources {
+		ingest.queues[source] = newIngestQueue(source)
+	}
+	return ingest
+}
+
+// Запуск обработки всех очередей
+func (p *parserIngest) start() {
+	for _, queue := range p.queues {
+		go queue.run()
+	}
+}
+
+// Счетчики очередей всех парсеров
+func (p *parserIngest) status(resetMax bool) map[string]IngestStats {
+	status := map[string]IngestStats{}
+	for source, queue := range p.queues {
+		status[source] = queue.snapshot(resetMax)
+	}
+	return status
+}
+
+// Токен запроса: заголовок "Authorization: Bearer <токен>". Параметр token
+// принимается только при подключении WebSocket (браузерный WebSocket не
+// умеет задавать заголовки): в адресах обычных запросов токен попадал бы в
+// журналы и историю браузера.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// Совпадает ли токен с одним из разрешённых. Сравнение за постоянное время.
+func tokenAllowed(token string, allowed []string) bool {
+	if token == "" {
+		return false
+	}
+	for _, candidate := range allowed {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Проверка ключа фронтенда (auth.apiKeys) и Origin браузера
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !originAllowed(r) {
+			logAuth.Warn("Запрос с неразрешённого Origin", "path", r.URL.Path, "origin", r.Header.Get("Origin"), "client", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if len(config.Auth.APIKeys) == 0 {
+			if !config.Auth.Insecure {
+				logAuth.Warn("Запрос отклонён: auth.apiKeys не заданы", "path", r.URL.Path, "client", r.RemoteAddr)
+				http.Error(w, "Forbidden: auth.apiKeys not configured", http.StatusForbidden)
+				return
+			}
+		} else if !tokenAllowed(requestToken(r), config.Auth.APIKeys) {
+			logAuth.Warn("Запрос без верного ключа", "path", r.URL.Path, "client", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Origin браузера из auth.allowedOrigins. Запросы без Origin идут не из
+// браузера и проверяются только токеном.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(config.Auth.AllowedOrigins) == 0 {
+		return true
+	}
+	return containsString(config.Auth.AllowedOrigins, origin)
+}
+
+// HTTP или HTTPS по настройкам tls
+func listenAndServe(addr string, handler http.Handler) error {
+	if config.TLS.CertFile != "" {
+		return http.ListenAndServeTLS(addr, config.TLS.CertFile, config.TLS.KeyFile, handler)
+	}
+	return http.ListenAndServe(addr, handler)
+}
+
+// Предупреждения об отключённых проверках доступа
+func warnOpenAccess() {
+	if config.Auth.Insecure {
+		logAuth.Warn("auth.insecure: серверы без токенов и ключей принимают любые подключения и изменяющие запросы")
+	}
+	if len(config.Auth.APIKeys) == 0 && !config.Auth.Insecure {
+		logAuth.Error("auth.apiKeys не заданы: /output, /admin и /metrics отклоняют все запросы (для разработки - auth.insecure)")
+	}
+	if len(config.Auth.AllowedOrigins) == 0 {
+		logAuth.Warn("auth.allowedOrigins не заданы: подключения браузера разрешены с любой страницы")
+	}
+	if config.TLS.CertFile == "" {
+		logAuth.Warn("tls не настроен: токены и данные передаются без шифрования")
+	}
+}
+
+// Обработчик подключения парсера: сообщения идут в очередь источника
+func parserHandler(sourceName string, queue *ingestQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := config.Auth.ParserTokens[sourceName]; (token != "" || !config.Auth.Insecure) && !tokenAllowed(requestToken(r), []string{token}) {
+			logAuth.Warn("Подключение парсера без верного токена", "source", sourceName, "client", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logIngest.Error("Ошибка подключения парсера", "source", sourceName, "error", err)
+			return
+		}
+		defer conn.Close()
+
+		logIngest.Info("Новое подключение парсера", "source", sourceName, "client", r.RemoteAddr)
+
+		state.do(func(st *analyzerState) { st.parserConns[sourceName][conn] = true })
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				logIngest.Error("Ошибка чтения сообщения парсера", "source", sourceName, "error", err)
+				break
+			}
+			queue.push(msg)
+		}
+
+		state.do(func(st *analyzerState) { delete(st.parserConns[sourceName], conn) })
+	}
+}
+
+// Сервер для приема данных от парсеров
+func startParserServer(port int, sourceName string, queue *ingestQueue) {
+	if config.Auth.ParserTokens[sourceName] == "" && !config.Auth.Insecure {
+		logAuth.Error("auth.parserTokens не задан: сервер парсера не запущен (для разработки - auth.insecure)", "source", sourceName, "port", port)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", parserHandler(sourceName, queue))
+
+	logIngest.Info("Сервер для парсера запущен", "source", sourceName, "port", port)
+	err := listenAndServe(fmt.Sprintf(":%d", port), mux)
+	if err != nil {
+		logIngest.Error("Ошибка запуска сервера для парсера", "source", sourceName, "error", err)
+	}
+}
+
+// Подключение клиента фронтенда: снимки и изменения отправляет его горутина
+// записи, здесь читаются только запросы клиента
+func frontendHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logFrontend.Error("Ошибка подключения клиента", "client", r.RemoteAddr, "error", err)
+		return
+	}
+	clientLog := logFrontend.With("client", conn.RemoteAddr().String())
+	clientLog.Info("Клиент подключен")
+
+	sender := newClientSender(conn)
+	go sender.writeLoop()
+
+	// Первый снимок новому клиенту отправит frontendTickLoop
+	state.do(func(st *analyzerState) {
+		st.frontendClients[conn] = &frontendClient{needSnapshot: true, sender: sender}
+	})
+
+	defer func() {
+		state.do(func(st *analyzerState) { delete(st.frontendClients, conn) })
+		sender.close()
+	}()
+
+	// Клиент, не ответивший на ping за два периода, отключается
+	pongWait := 2 * time.Duration(config.Frontend.PingSeconds) * time.Second
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var request struct {
+			Type string `json:"type"`
+			FrontendSubscription
+		}
+		if err := json.Unmarshal(msg, &request); err != nil {
+			clientLog.Warn("Некорректное сообщение от клиента", "body", string(msg))
+			continue
+		}
+		switch request.Type {
+		case "resync":
+			clientLog.Debug("Клиент запросил снимок")
+			state.post(func(st *analyzerState) {
+				if client, ok := st.frontendClients[conn]; ok {
+					client.needSnapshot = true
+				}
+			})
+		case "subscribe":
+			subscription := request.FrontendSubscription
+			if err := subscription.normalize(); err != nil {
+				clientLog.Warn("Подписка клиента отклонена", "error", err)
+				continue
+			}
+			clientLog.Info("Клиент подписался", "subscription", subscription.key())
+			state.post(func(st *analyzerState) {
+				if client, ok := st.frontendClients[conn]; ok {
+					client.subscription = subscription
+					client.needSnapshot = true
+				}
+			})
+		default:
+			clientLog.Warn("Неизвестное сообщение от клиента", "body", string(msg))
+		}
+	}
+}
+
+// Сервер для фронтенда
+func startFrontendServer(ingest *parserIngest) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/output", requireAPIKey(frontendHandler))
+	mux.HandleFunc("/admin/reload_teams", requireAPIKey(reloadTeamsHandler))
+	mux.HandleFunc("/admin/league_suggestions", requireAPIKey(leagueSuggestionsHandler))
+	mux.HandleFunc("/admin/pairs", requireAPIKey(pairsHandler))
+	mux.HandleFunc("/admin/clients", requireAPIKey(clientsHandler))
+	mux.HandleFunc("/admin/ingest", requireAPIKey(ingestHandler(ingest)))
+	mux.HandleFunc("/admin/logging", requireAPIKey(loggingHandler))
+	mux.Handle("/metrics", requireAPIKey(promhttp.Handler().ServeHTTP))
+
+	logFrontend.Info("Сервер для фронтенда запущен", "port", 7300)
+	err := listenAndServe(":7300", mux)
+	if err != nil {
+		logFrontend.Error("Ошибка запуска сервера для фронтенда", "error", err)
+	}
+}
+
+// Обработка полученных данных от парсеров
+func saveMatchData(name string, msg []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			logIngest.Error("Паника в saveMatchData", "source", name, "panic", r)
+		}
+	}()
+
+	// Проверяем на пустое сообщение
+	if len(msg) == 0 || string(msg) == "[]" {
+		state.do(func(st *analyzerState) {
+			for key := range st.matchData[name] {
+				st.removeMatch(name, key)
+				logIngest.Debug("Матч удален из-за пустого массива", "source", name, "key", key)
+			}
+		})
+		return
+	}
+
+	var removal RemovalMessage
+	if err := json.Unmarshal(msg, &removal); err == nil && removal.Removed {
+		teams := splitMatchName(removal.MatchName, name)
+		if len(teams) != 2 {
+			logIngest.Error("Не удалось разделить MatchName снятого матча", "source", name, "match_id", removal.MatchId, "match_name", removal.MatchName)
+			return
+		}
+		key := generateMatchKey(teams[0], teams[1])
+		state.do(func(st *analyzerState) { st.removeEvent(name, removal.MatchId, key) })
+		return
+	}
+
+	parsedMsg, err := parseMessage(name, msg)
+	if err != nil {
+		logIngest.Error("Ошибка парсинга сообщения", "source", name, "error", err)
+		return
+	}
+
+	ensureTeamsExist(name, parsedMsg.Home, parsedMsg.Away, parsedMsg.LeagueName, parsedMsg.Sport)
+	var pinnacleHome, pinnacleAway string
+	if name == "Sansabet" {
+		pinnacleHome, pinnacleAway = resolvePinnacleTeams(parsedMsg)
+	}
+
+	key := generateMatchKey(parsedMsg.Home, parsedMsg.Away)
+	now := time.Now()
+	prices := historyPrices(name, string(msg))
+
+	state.do(func(st *analyzerState) {
+		if pinnacleHome != "" && pinnacleAway != "" {
+			st.updateMatchPairs(parsedMsg, pinnacleHome, pinnacleAway)
+		}
+		st.matchData[name][key] = &MatchData{
+			Data:       string(msg),
+			LastUpdate: now,
+		}
+		st.recordPrices(name, key, prices, now)
+		st.touchPairs(name, key, now)
+		logIngest.Debug("Данные матча сохранены", "source", name, "match_id", parsedMsg.MatchId, "key", key)
+
+		// Пересчитываем только пары с этим матчем, отправка - по таймеру
+		st.recomputeAffectedPairs(name, key)
+	})
+}
+
+// Запуск владельца состояния
+func newStateActor() *stateActor {
+	return &stateActor{
+		inbox: make(chan func(*analyzerState), 256),
+		state: &analyzerState{
+			matchData:       map[string]map[string]*MatchData{"Sansabet": {}, "Pinnacle": {}},
+			matchKeys:       make(map[string]bool),
+			pairResults:     make(map[string]map[string]interface{}),
+			priceHistory:    map[string]map[string]map[MarketOutcome]*PriceRing{"Sansabet": {}, "Pinnacle": {}},
+			dirtyPairs:      make(map[string]bool),
+			frontendClients: make(map[*websocket.Conn]*frontendClient),
+			parserConns:     map[string]map[*websocket.Conn]bool{"Sansabet": {}, "Pinnacle": {}},
+		},
+	}
+}
+
+// Горутина-владелец: выполняет присланные функции по очереди
+func (a *stateActor) run() {
+	for f := range a.inbox {
+		a.safeCall(f)
+	}
+}
+
+// Паника в присланной функции не должна останавливать владельца состояния
+func (a *stateActor) safeCall(f func(*analyzerState)) {
+	defer func() {
+		if r := recover(); r != nil {
+			logMain.Error("Паника при работе с состоянием анализатора", "panic", r)
+		}
+	}()
+	f(a.state)
+}
+
+// Выполнение f в горутине-владельце с ожиданием завершения. f не должна
+// вызывать do/post сама: владелец ждёт только одну функцию за раз.
+func (a *stateActor) do(f func(*analyzerState)) {
+	done := make(chan struct{})
+	a.inbox <- func(st *analyzerState) {
+		defer close(done)
+		f(st)
+	}
+	<-done
+}
+
+// Выполнение f в горутине-владельце без ожидания
+func (a *stateActor) post(f func(*analyzerState)) {
+	a.inbox <- f
+}
+
+// Удаление матча источника вместе с историей цен и пересчет его пар
+func (st *analyzerState) removeMatch(source, key string) {
+	delete(st.matchData[source], key)
+	delete(st.priceHistory[source], key)
+	st.recomputeAffectedPairs(source, key)
+}
+
+// Периодическая отправка накопленных результатов на фронтенд. Заодно
+// удаляются устаревшие матчи, чтобы их пары пропадали и без новых сообщений.
+func frontendTickLoop(ingest *parserIngest) {
+	ticker := time.NewTicker(time.Duration(config.Frontend.TickMillis) * time.Millisecond)
+	defer ticker.Stop()
+	feed := newFrontendFeed()
+	statusEvery := time.Duration(config.Ingest.StatusSeconds) * time.Second
+	lastStatus := time.Now()
+	for range ticker.C {
+		state.do(func(st *analyzerState) {
+			st.removeStaleMatches()
+			st.expirePairs(time.Now())
+			st.updateStateMetrics()
+		})
+		sendCurrentMatchesToFrontend(feed)
+		if time.Since(lastStatus) >= statusEvery {
+			lastStatus = time.Now()
+			sendIngestStatusToFrontend(ingest)
+		}
+	}
+}
+
+// Отправка изменений результатов на фронтенд. Клиенты с одинаковой
+// подпиской получают общую дельту, новые и запросившие снимок - снимок
+// своей подписки. Сообщения только ставятся в очереди клиентов, запись
+// идёт в их горутинах.
+func sendCurrentMatchesToFrontend(feed *frontendFeed) {
+	var order []string
+	changed := map[string]map[string]interface{}{}
+	type clientInfo struct {
+		conn         *websocket.Conn
+		sender       *clientSender
+		needSnapshot bool
+		subscription FrontendSubscription
+	}
+	var clients []clientInfo
+	state.do(func(st *analyzerState) {
+		for _, pair := range st.matchPairs {
+			if _, ok := st.pairResults[pair.Key]; ok {
+				order = append(order, pair.Key)
+			}
+		}
+		// nil - результат пары пропал
+		for key := range st.dirtyPairs {
+			changed[key] = st.pairResults[key]
+		}
+		st.dirtyPairs = make(map[string]bool)
+
+		for conn, client := range st.frontendClients {
+			clients = append(clients, clientInfo{conn, client.sender, client.needSnapshot, client.subscription})
+			client.needSnapshot = false
+		}
+	})
+	feed.update(order, changed)
+	if len(changed) > 0 {
+		feed.updateROIMetrics()
+	}
+
+	// Клиенты по подпискам
+	groups := map[string][]clientInfo{}
+	for _, client := range clients {
+		key := client.subscription.key()
+		groups[key] = append(groups[key], client)
+	}
+
+	var lagging []*clientSender
+	for key, members := range groups {
+		var deltaClients, snapshotClients []*clientSender
+		publisher, exists := feed.publishers[key]
+		if !exists {
+			// Новая подписка: состояние публикации - все текущие матчи
+			publisher = newFrontendPublisher(members[0].subscription)
+			publisher.apply(feed.order, feed.results)
+			feed.publishers[key] = publisher
+			for _, client := range members {
+				snapshotClients = append(snapshotClients, client.sender)
+			}
+		} else {
+			for _, client := range members {
+				if client.needSnapshot {
+					snapshotClients = append(snapshotClients, client.sender)
+				} else {
+					deltaClients = append(deltaClients, client.sender)
+				}
+			}
+			if len(changed) > 0 {
+				if delta := publisher.apply(feed.order, changed); delta != nil {
+					lagging = append(lagging, forwardToFrontendBatch(delta, deltaClients)...)
+				}
+			}
+		}
+		if len(snapshotClients) > 0 {
+			lagging = append(lagging, forwardToFrontendBatch(publisher.snapshot(), snapshotClients)...)
+		}
+	}
+
+	// Подписки без клиентов больше не считаем
+	for key := range feed.publishers {
+		if _, ok := groups[key]; !ok {
+			delete(feed.publishers, key)
+		}
+	}
+
+	requestSnapshots(lagging)
+}
+
+// Клиенты, потерявшие сообщения, получат новый снимок
+func requestSnapshots(lagging []*clientSender) {
+	if len(lagging) == 0 {
+		return
+	}
+	state.post(func(st *analyzerState) {
+		for _, sender := range lagging {
+			if client, ok := st.frontendClients[sender.conn]; ok {
+				client.needSnapshot = true
+			}
+		}
+	})
+}
+
+// Отправка всем клиентам состояния очередей парсеров
+func sendIngestStatusToFrontend(ingest *parserIngest) {
+	var clients []*clientSender
+	state.do(func(st *analyzerState) {
+		for _, client := range st.frontendClients {
+			clients = append(clients, client.sender)
+		}
+	})
+	requestSnapshots(forwardToFrontendBatch(&FrontendMessage{Type: "status", Ingest: ingest.status(true)}, clients))
+}
+
+// Парсинг сообщения
+func parseMessage(name string, msg []byte) (*ParsedMessage, error) {
+	var parsedMsg ParsedMessage
+	if err := json.Unmarshal(msg, &parsedMsg); err != nil {
+		return nil, fmt.Errorf("Ошибка парсинга JSON из %s: %v | Сообщение: %s", name, err, string(msg))
+	}
+
+	teams := splitMatchName(parsedMsg.MatchName, name)
+	if len(teams) != 2 {
+		return nil, fmt.Errorf("Не удалось разделить MatchName на команды: %s", parsedMsg.MatchName)
+	}
+
+	parsedMsg.Home = teams[0]
+	parsedMsg.Away = teams[1]
+	if parsedMsg.Sport == "" {
+		parsedMsg.Sport = "Soccer"
+	}
+
+	if parsedMsg.Home == "" || parsedMsg.Away == "" || parsedMsg.LeagueName == "" {
+		return nil, fmt.Errorf("Недостаточно данных: Home=%s, Away=%s, LeagueName=%s", parsedMsg.Home, parsedMsg.Away, parsedMsg.LeagueName)
+	}
+
+	return &parsedMsg, nil
+}
+
+// Разделение названия матча на домашнюю и гостевую команды
+func splitMatchName(matchName, source string) []string {
+	var separator string
+	if source == "Sansabet" {
+		separator = " : "
+	} else if source == "Pinnacle" {
+		separator = " vs "
+	} else {
+		separator = " vs "
+	}
+
+	return strings.Split(matchName, separator)
+}
+
+// Проверка наличия команд в базе данных
+func ensureTeamsExist(source, home, away, league, sport string) {
+	if !teamExists(source, home, league, sport) {
+		logTeams.Info("Новая команда, добавляем её", "source", source, "team", home, "league", league)
+		insertTeam(source, home, league, sport)
+	}
+
+	if !teamExists(source, away, league, sport) {
+		logTeams.Info("Новая команда, добавляем её", "source", source, "team", away, "league", league)
+		insertTeam(source, away, league, sport)
+	}
+}
+
+// Проверка наличия команды (по кэшу)
+func teamExists(source, teamName, league, sport string) bool {
+	return teamCache.hasTeam(source, teamName, league, sport)
+}
+
+// Вставка команды в базу данных
+func insertTeam(source, teamName, league, sport string) {
+	teamId, err := teamRepo.InsertTeam(source, teamName, league, sport)
+	if err != nil {
+		logTeams.Error("Ошибка добавления команды", "source", source, "team", teamName, "error", err)
+		return
+	}
+	teamCache.addTeam(source, teamName, league, sport, teamId)
+}
+
+// Название связанной команды Pinnacle для написания Sansabet (через алиас)
+func getLinkedPinnacleTeam(teamName, sport string) (string, error) {
+	return teamCache.linkedPinnacleTeam(sport, teamName)
+}
+
+// Команда Pinnacle из лиги матча Pinnacle
+func getPinnacleTeam(teamName, league, sport string) (StoredTeam, error) {
+	return teamCache.team("Pinnacle", teamName, league, sport)
+}
+
+// Связанные команды Pinnacle для матча Sansabet. Если связана одна команда,
+// вторую ищем в матче Pinnacle с первой и связываем. Запись связи в базу идёт
+// здесь, вне владельца состояния: владельцу достаётся только поиск матча,
+// поэтому медленный запрос не задерживает парсеры и фронтенд. Пустая строка -
+// связи нет.
+func resolvePinnacleTeams(parsedMsg *ParsedMessage) (string, string) {
+	matchLog := logTeams.With("source", "Sansabet", "match_id", parsedMsg.MatchId)
+	linkedHome, _ := getLinkedPinnacleTeam(parsedMsg.Home, parsedMsg.Sport)
+	linkedAway, _ := getLinkedPinnacleTeam(parsedMsg.Away, parsedMsg.Sport)
+
+	if linkedHome == "" && linkedAway == "" {
+		matchLog.Debug("Связь команд с Pinnacle не найдена", "home", parsedMsg.Home, "away", parsedMsg.Away)
+		metricUnlinkedMatches.WithLabelValues("Sansabet").Inc()
+		return "", ""
+	}
+	if linkedHome != "" && linkedAway != "" {
+		matchLog.Debug("Найдена связь команд с Pinnacle", "home", linkedHome, "away", linkedAway)
+		return linkedHome, linkedAway
+	}
+
+	knownTeamName, unlinkedTeam := linkedHome, parsedMsg.Away
+	if linkedHome == "" {
+		knownTeamName, unlinkedTeam = linkedAway, parsedMsg.Home
+	}
+	matchLog.Debug("Связана одна команда, ищем вторую в матчах Pinnacle", "known_team", knownTeamName)
+
+	var missingTeamName, league string
+	var err error
+	state.do(func(st *analyzerState) {
+		missingTeamName, league, err = st.findMissingTeamInMatchData(knownTeamName)
+	})
+	if err != nil {
+		matchLog.Debug("Недостающая команда не найдена в матчах Pinnacle", "known_team", knownTeamName, "error", err)
+		return linkedHome, linkedAway
+	}
+
+	pinnacleTeam, err := getPinnacleTeam(missingTeamName, league, parsedMsg.Sport)
+	if err != nil {
+		matchLog.Error("Команда Pinnacle не найдена в лиге матча", "team", missingTeamName, "league", league, "error", err)
+		return linkedHome, linkedAway
+	}
+
+	if err := updateTeamPinnacleId(unlinkedTeam, pinnacleTeam); err != nil {
+		matchLog.Error("Ошибка обновления связи команды", "team", unlinkedTeam, "error", err)
+		return linkedHome, linkedAway
+	}
+	matchLog.Info("Создана связь команды с Pinnacle", "team", unlinkedTeam, "pinnacle_team_id", pinnacleTeam.Id)
+
+	if linkedHome == "" {
+		linkedHome = pinnacleTeam.Name
+	} else {
+		linkedAway = pinnacleTeam.Name
+	}
+	return linkedHome, linkedAway
+}
+
+// Связывание команды Sansabet с командой Pinnacle
+func updateTeamPinnacleId(sansabetTeam string, pinnacleTeam StoredTeam) error {
+	canonicalId, err := teamRepo.LinkTeam(sansabetTeam, pinnacleTeam.Id)
+	if err != nil {
+		return err
+	}
+
+	teamCache.setLink(pinnacleTeam.Sport, sansabetTeam, pinnacleTeam.Name, canonicalId)
+	return nil
+}
+
+// Ключ команды в кэше
+func (c *TeamCache) teamKey(source, teamName, league, sport string) string {
+	return source + "|" + c.fold(sport) + "|" + c.fold(league) + "|" + c.fold(teamName)
+}
+
+// Ключ алиаса в кэше: как и в team_aliases, написание уникально в пределах
+// источника и вида спорта
+func (c *TeamCache) aliasKey(source, sport, teamName string) string {
+	return source + "|" + c.fold(sport) + "|" + c.fold(teamName)
+}
+
+// Полная загрузка кэша из хранилища
+func (c *TeamCache) load() error {
+	storedTeams, err := teamRepo.LoadTeams()
+	if err != nil {
+		return err
+	}
+	storedAliases, err := teamRepo.LoadAliases()
+	if err != nil {
+		return err
+	}
+
+	// Новый кэш собирается отдельно и подменяет карты целиком
+	next := &TeamCache{
+		fold:              teamRepo.FoldName,
+		teams:             make(map[string]StoredTeam),
+		aliases:           make(map[string]int),
+		canonicalPinnacle: make(map[int]string),
+	}
+
+	for _, team := range storedTeams {
+		next.teams[next.teamKey(team.Source, team.Name, team.League, team.Sport)] = team
+	}
+	for _, alias := range storedAliases {
+		key := next.aliasKey(alias.Source, alias.Sport, alias.Name)
+		if _, exists := next.aliases[key]; !exists {
+			next.aliases[key] = alias.CanonicalId
+		}
+		// Команда Pinnacle определяется алиасом Pinnacle канонической команды,
+		// а не первой попавшейся командой с таким названием
+		if alias.Source == "Pinnacle" {
+			if _, linked := next.canonicalPinnacle[alias.CanonicalId]; !linked {
+				next.canonicalPinnacle[alias.CanonicalId] = alias.Name
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	c.fold = next.fold
+	c.teams = next.teams
+	c.aliases = next.aliases
+	c.canonicalPinnacle = next.canonicalPinnacle
+	c.loadedAt = time.Now()
+	c.mutex.Unlock()
+
+	logDB.Debug("Кэш команд загружен", "teams", len(next.teams), "aliases", len(next.aliases))
+	return nil
+}
+
+func (c *TeamCache) hasTeam(source, teamName, league, sport string) bool {
+	_, err := c.team(source, teamName, league, sport)
+	return err == nil
+}
+
+// Команда источника в лиге; sql.ErrNoRows, если её нет
+func (c *TeamCache) team(source, teamName, league, sport string) (StoredTeam, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if team, exists := c.teams[c.teamKey(source, teamName, league, sport)]; exists {
+		return team, nil
+	}
+	return StoredTeam{}, sql.ErrNoRows
+}
+
+func (c *TeamCache) addTeam(source, teamName, league, sport string, id int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.teams[c.teamKey(source, teamName, league, sport)] = StoredTeam{
+		Source: source,
+		Id:     id,
+		Name:   teamName,
+		League: league,
+		Sport:  sport,
+	}
+}
+
+func (c *TeamCache) setLink(sport, sansabetTeam, pinnacleTeam string, canonicalId int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.aliases[c.aliasKey("Sansabet", sport, sansabetTeam)] = canonicalId
+	c.aliases[c.aliasKey("Pinnacle", sport, pinnacleTeam)] = canonicalId
+	if _, linked := c.canonicalPinnacle[canonicalId]; !linked {
+		c.canonicalPinnacle[canonicalId] = pinnacleTeam
+	}
+}
+
+// Связанная команда Pinnacle: написание Sansabet -> каноническая команда ->
+// её написание у Pinnacle; sql.ErrNoRows, если связи нет
+func (c *TeamCache) linkedPinnacleTeam(sport, sansabetTeam string) (string, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	canonicalId, exists := c.aliases[c.aliasKey("Sansabet", sport, sansabetTeam)]
+	if !exists {
+		return "", sql.ErrNoRows
+	}
+	if pinnacleTeam, exists := c.canonicalPinnacle[canonicalId]; exists {
+		return pinnacleTeam, nil
+	}
+	return "", sql.ErrNoRows
+}
+
+// Периодическая перезагрузка кэша на случай правок в базе в обход анализатора
+func reloadTeamCachePeriodically() {
+	for {
+		time.Sleep(teamCacheReloadEvery)
+		if err := teamCache.load(); err != nil {
+			logDB.Error("Ошибка перезагрузки кэша команд", "error", err)
+		}
+	}
+}
+
+// Эндпоинт для сброса кэша после ручных правок связей (manualMatch.php)
+func reloadTeamsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := teamCache.load(); err != nil {
+		logDB.Error("Ошибка перезагрузки кэша команд", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	teamCache.mutex.RLock()
+	loadedAt := teamCache.loadedAt
+	teamCache.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":   "success",
+		"loadedAt": loadedAt.Format(time.RFC3339),
+	})
+}
+
+// Поиск пар лиг по связанным командам. Пара предлагается, если не меньше
+// minLinkedTeams связанных команд лиги Sansabet играют в одной лиге Pinnacle
+// и такой пары ещё нет в league_matches. Если одна лига набирает
+// minLinkedTeams связанных команд с несколькими лигами другого источника,
+// это конфликт: такие лиги показываются отдельно и автоматически не
+// связываются. Единичные связи (кубковый матч, товарищеская игра) конфликтом
+// не считаются.
+func suggestLeagueMatches(stats []LeagueLinkStat, existing []LeagueMatch, minLinkedTeams int) LeagueSuggestions {
+	matched := make(map[LeagueMatch]bool)
+	for _, match := range existing {
+		matched[match] = true
+	}
+
+	bySansabet := make(map[int][]LeagueLinkStat)
+	byPinnacle := make(map[int][]LeagueLinkStat)
+	for _, stat := range stats {
+		if stat.LinkedTeams < minLinkedTeams {
+			continue
+		}
+		bySansabet[stat.SansabetLeagueId] = append(bySansabet[stat.SansabetLeagueId], stat)
+		byPinnacle[stat.PinnacleLeagueId] = append(byPinnacle[stat.PinnacleLeagueId], stat)
+	}
+
+	result := LeagueSuggestions{Suggestions: []LeagueSuggestion{}, Conflicts: []LeagueConflict{}}
+	conflictedSansabet := make(map[int]bool)
+	conflictedPinnacle := make(map[int]bool)
+
+	addConflicts := func(groups map[int][]LeagueLinkStat, reason string, conflicted map[int]bool) {
+		for leagueId, candidates := range groups {
+			if len(candidates) < 2 {
+				continue
+			}
+			sort.Slice(candidates, func(i, j int) bool {
+				return candidates[i].LinkedTeams > candidates[j].LinkedTeams
+			})
+			conflicted[leagueId] = true
+			result.Conflicts = append(result.Conflicts, LeagueConflict{Reason: reason, Candidates: candidates})
+		}
+	}
+	addConflicts(bySansabet, "sansabet_league_split", conflictedSansabet)
+	addConflicts(byPinnacle, "pinnacle_league_split", conflictedPinnacle)
+
+	for _, stat := range stats {
+		if stat.LinkedTeams < minLinkedTeams {
+			continue
+		}
+		if matched[LeagueMatch{PinnacleLeagueId: stat.PinnacleLeagueId, SansabetLeagueId: stat.SansabetLeagueId}] {
+			continue
+		}
+		result.Suggestions = append(result.Suggestions, LeagueSuggestion{
+			LeagueLinkStat: stat,
+			Conflicted:     conflictedSansabet[stat.SansabetLeagueId] || conflictedPinnacle[stat.PinnacleLeagueId],
+		})
+	}
+
+	sort.Slice(result.Suggestions, func(i, j int) bool {
+		return result.Suggestions[i].LinkedTeams > result.Suggestions[j].LinkedTeams
+	})
+	sort.Slice(result.Conflicts, func(i, j int) bool {
+		return result.Conflicts[i].Candidates[0].SansabetLeague < result.Conflicts[j].Candidates[0].SansabetLeague
+	})
+	return result
+}
+
+// Один проход поиска пар лиг; при autoCreate создаёт пары без конфликтов
+func matchLeagues(autoCreate bool) (LeagueSuggestions, error) {
+	stats, err := teamRepo.LoadLeagueLinkStats()
+	if err != nil {
+		return LeagueSuggestions{}, err
+	}
+	existing, err := teamRepo.LoadLeagueMatches()
+	if err != nil {
+		return LeagueSuggestions{}, err
+	}
+
+	result := suggestLeagueMatches(stats, existing, config.LeagueMatching.MinLinkedTeams)
+	for i, suggestion := range result.Suggestions {
+		if !autoCreate || suggestion.Conflicted {
+			continue
+		}
+		if err := teamRepo.CreateLeagueMatch(suggestion.PinnacleLeagueId, suggestion.SansabetLeagueId, true); err != nil {
+			logLeagues.Error("Ошибка создания пары лиг", "error", err)
+			continue
+		}
+		result.Suggestions[i].Created = true
+		logLeagues.Info("Создана пара лиг", "sansabet_league", suggestion.SansabetLeague, "pinnacle_league", suggestion.PinnacleLeague, "linked_teams", suggestion.LinkedTeams)
+	}
+
+	for _, conflict := range result.Conflicts {
+		names := []string{}
+		for _, candidate := range conflict.Candidates {
+			names = append(names, fmt.Sprintf("%s <-> %s (%d)", candidate.SansabetLeague, candidate.PinnacleLeague, candidate.LinkedTeams))
+		}
+		logLeagues.Warn("Конфликт связей лиг", "reason", conflict.Reason, "candidates", strings.Join(names, "; "))
+	}
+	return result, nil
+}
+
+// Периодический поиск пар лиг
+func matchLeaguesPeriodically() {
+	for {
+		time.Sleep(leagueMatchingEvery)
+		if _, err := matchLeagues(config.LeagueMatching.AutoCreate); err != nil {
+			logLeagues.Error("Ошибка поиска пар лиг", "error", err)
+		}
+	}
+}
+
+// Счетчики и список активных пар матчей
+func pairsHandler(w http.ResponseWriter, r *http.Request) {
+	type pairInfo struct {
+		Key          string  `json:"key"`
+		SansabetName string  `json:"sansabetName"`
+		PinnacleName string  `json:"pinnacleName"`
+		CreatedAt    string  `json:"createdAt"`
+		SansabetAge  float64 `json:"sansabetAge"` // Секунд с последних данных Sansabet
+		PinnacleAge  float64 `json:"pinnacleAge"` // Секунд с последних данных Pinnacle
+	}
+	var counters PairCounters
+	pairs := []pairInfo{}
+	state.do(func(st *analyzerState) {
+		counters = st.pairCounters
+		counters.Active = len(st.matchPairs)
+		for _, pair := range st.matchPairs {
+			pairs = append(pairs, pairInfo{
+				Key:          pair.Key,
+				SansabetName: pair.SansabetName,
+				PinnacleName: pair.PinnacleName,
+				CreatedAt:    pair.CreatedAt.Format(time.RFC3339),
+				SansabetAge:  time.Since(pair.SansabetSeen).Seconds(),
+				PinnacleAge:  time.Since(pair.PinnacleSeen).Seconds(),
+			})
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"counters": counters,
+		"pairs":    pairs,
+	})
+}
+
+// Счетчики очередей сообщений парсеров
+func ingestHandler(ingest *parserIngest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ingest.status(false))
+	}
+}
+
+// Клиенты фронтенда и их очереди отправки
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+	type clientInfo struct {
+		Addr         string               `json:"addr"`
+		Connected    string               `json:"connected"`
+		QueueDepth   int                  `json:"queueDepth"`
+		QueueSize    int                  `json:"queueSize"`
+		Sent         int64                `json:"sent"`
+		Dropped      int64                `json:"dropped"`
+		Subscription FrontendSubscription `json:"subscription"`
+	}
+	clients := []clientInfo{}
+	state.do(func(st *analyzerState) {
+		for conn, client := range st.frontendClients {
+			clients = append(clients, clientInfo{
+				Addr:         conn.RemoteAddr().String(),
+				Connected:    client.sender.connected.Format(time.RFC3339),
+				QueueDepth:   len(client.sender.queue),
+				QueueSize:    cap(client.sender.queue),
+				Sent:         atomic.LoadInt64(&client.sender.sent),
+				Dropped:      atomic.LoadInt64(&client.sender.dropped),
+				Subscription: client.subscription,
+			})
+		}
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policy":  config.Frontend.SlowClientPolicy,
+		"clients": clients,
+	})
+}
+
+// Эндпоинт с предложениями пар лиг и конфликтами (для manualMatch.php)
+func leagueSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := matchLeagues(false)
+	if err != nil {
+		logLeagues.Error("Ошибка поиска пар лиг", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Обновление пар матчей
+func (st *analyzerState) updateMatchPairs(parsedMsg *ParsedMessage, linkedHome, linkedAway string) {
+	matchLog := logTeams.With("source", "Sansabet", "match_id", parsedMsg.MatchId)
+	for _, pair := range st.matchPairs {
+		if pair.SansabetId == parsedMsg.MatchId {
+			return
+		}
+	}
+
+	keyPinnacle := generateMatchKey(linkedHome, linkedAway)
+
+	pinnacleData, pinnacleExists := st.matchData["Pinnacle"][keyPinnacle]
+	if !pinnacleExists {
+		matchLog.Debug("Нет данных Pinnacle для матча", "match_name", parsedMsg.MatchName, "key", keyPinnacle)
+		return
+	}
+
+	var pinnacleMsg struct {
+		MatchId   string `json:"MatchId"`
+		MatchName string `json:"MatchName"`
+		HomeScore int64  `json:"HomeScore"`
+		AwayScore int64  `json:"AwayScore"`
+	}
+
+	if err := json.Unmarshal([]byte(pinnacleData.Data), &pinnacleMsg); err != nil {
+		matchLog.Error("Ошибка парсинга данных Pinnacle", "key", keyPinnacle, "error", err)
+		return
+	}
+
+	matchParts := strings.SplitN(pinnacleMsg.MatchName, " vs ", 2)
+	if len(matchParts) != 2 {
+		matchLog.Error("Некорректный формат MatchName Pinnacle", "match_name", pinnacleMsg.MatchName)
+		return
+	}
+	pinnacleHome := matchParts[0]
+	pinnacleAway := matchParts[1]
+
+	now := time.Now()
+	newPair := MatchPair{
+		Key:          pairEventKey(parsedMsg.MatchId, pinnacleMsg.MatchId, now),
+		CreatedAt:    now,
+		SansabetSeen: now,
+		PinnacleSeen: pinnacleData.LastUpdate,
+		SansabetId:   parsedMsg.MatchId,
+		SansabetName: parsedMsg.MatchName,
+		SansabetHome: parsedMsg.Home,
+		SansabetAway: parsedMsg.Away,
+		PinnacleId:   pinnacleMsg.MatchId,
+		PinnacleName: pinnacleMsg.MatchName,
+		PinnacleHome: pinnacleHome,
+		PinnacleAway: pinnacleAway,
+		Score:        fmt.Sprintf("%d - %d", pinnacleMsg.HomeScore, pinnacleMsg.AwayScore),
+	}
+
+	if st.matchKeys[newPair.Key] {
+		return
+	}
+	st.matchPairs = append(st.matchPairs, newPair)
+	st.matchKeys[newPair.Key] = true
+	st.pairCounters.Total++
+	metricPairsCreated.Inc()
+
+	logPairs.Info("Создана пара матчей", "pair_id", newPair.Key, "match_id", newPair.SansabetId,
+		"pinnacle_match_id", newPair.PinnacleId, "sansabet_name", newPair.SansabetName, "pinnacle_name", newPair.PinnacleName)
+}
+
+// Поиск недостающей команды в matchData: соперник известной команды и лига матча Pinnacle
+func (st *analyzerState) findMissingTeamInMatchData(knownTeam string) (string, string, error) {
+	for key, matchJSON := range st.matchData["Pinnacle"] {
+		var match struct {
+			MatchName  string `json:"MatchName"`
+			LeagueName string `json:"LeagueName"`
+		}
+		if err := json.Unmarshal([]byte(matchJSON.Data), &match); err != nil {
+			logTeams.Debug("Ошибка парсинга данных Pinnacle", "source", "Pinnacle", "key", key, "error", err)
+			continue
+		}
+
+		teams := strings.Split(match.MatchName, " vs ")
+		if len(teams) != 2 {
+			logTeams.Debug("Некорректный формат MatchName Pinnacle", "source", "Pinnacle", "match_name", match.MatchName)
+			continue
+		}
+		if teams[0] == knownTeam {
+			return teams[1], match.LeagueName, nil
+		} else if teams[1] == knownTeam {
+			return teams[0], match.LeagueName, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("команда %s не найдена в matchData", knownTeam)
+}
+
+// Генерация ключа матча
+func generateMatchKey(home, away string) string {
+	const emptyHash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	h1 := sha1.Sum([]byte(home))
+	h2 := sha1.Sum([]byte(away))
+
+	hexH1 := hex.EncodeToString(h1[:])
+	hexH2 := hex.EncodeToString(h2[:])
+
+	if hexH1 == emptyHash || hexH2 == emptyHash {
+		logIngest.Warn("Пустое название команды в ключе матча", "home", home, "away", away)
+	}
+
+	return hexH1 + hexH2
+}
+
+// Удаление устаревших матчей и результатов их пар
+func (st *analyzerState) removeStaleMatches() {
+	for source, matches := range st.matchData {
+		for key, match := range matches {
+			if time.Since(match.LastUpdate) > maxStaleDuration {
+				logIngest.Debug("Удаляем устаревший матч", "source", source, "key", key)
+				st.removeMatch(source, key)
+			}
+		}
+	}
+}
+
+// Ключ пары: ID событий обоих букмекеров и дата создания. Ответный матч
+// тех же команд - другие события, поэтому и другая пара.
+func pairEventKey(sansabetId, pinnacleId string, createdAt time.Time) string {
+	return fmt.Sprintf("%s|%s|%s", sansabetId, pinnacleId, createdAt.Format("2006-01-02"))
+}
+
+// Входит ли матч key источника source в пару
+func pairHasMatch(pair MatchPair, source, key string) bool {
+	switch source {
+	case "Sansabet":
+		return generateMatchKey(pair.SansabetHome, pair.SansabetAway) == key
+	case "Pinnacle":
+		return generateMatchKey(pair.PinnacleHome, pair.PinnacleAway) == key
+	}
+	return false
+}
+
+// Отметка о свежих данных стороны source у пар с матчем key
+func (st *analyzerState) touchPairs(source, key string, at time.Time) {
+	for i := range st.matchPairs {
+		if !pairHasMatch(st.matchPairs[i], source, key) {
+			continue
+		}
+		if source == "Sansabet" {
+			st.matchPairs[i].SansabetSeen = at
+		} else {
+			st.matchPairs[i].PinnacleSeen = at
+		}
+	}
+}
+
+// Удаление пар, от одной из сторон которых нет данных дольше pairs.expireSeconds
+func (st *analyzerState) expirePairs(now time.Time) {
+	expire := time.Duration(config.Pairs.ExpireSeconds) * time.Second
+	dropped := st.dropPairs(func(pair MatchPair) bool {
+		return now.Sub(pair.SansabetSeen) > expire || now.Sub(pair.PinnacleSeen) > expire
+	}, "нет данных дольше pairs.expireSeconds")
+	st.pairCounters.Expired += dropped
+	metricPairsClosed.WithLabelValues("expired").Add(float64(dropped))
+}
+
+// Снятие матча по сообщению парсера: данные матча и пары с этим событием
+func (st *analyzerState) removeEvent(source, matchId, key string) {
+	logPairs.Info("Парсер снял матч", "source", source, "match_id", matchId, "key", key)
+	st.removeMatch(source, key)
+	dropped := st.dropPairs(func(pair MatchPair) bool {
+		if source == "Sansabet" {
+			return pair.SansabetId == matchId
+		}
+		return pair.PinnacleId == matchId
+	}, "матч снят парсером "+source)
+	st.pairCounters.Removed += dropped
+	metricPairsClosed.WithLabelValues("removed").Add(float64(dropped))
+}
+
+// Удаление пар по условию вместе с ключами и результатами. Возвращает
+// число удалённых пар.
+func (st *analyzerState) dropPairs(drop func(MatchPair) bool, reason string) int {
+	dropped := 0
+	kept := st.matchPairs[:0]
+	for _, pair := range st.matchPairs {
+		if !drop(pair) {
+			kept = append(kept, pair)
+			continue
+		}
+		logPairs.Info("Пара удалена", "pair_id", pair.Key, "match_id", pair.SansabetId, "pinnacle_name", pair.PinnacleName, "reason", reason)
+		delete(st.matchKeys, pair.Key)
+		if _, cached := st.pairResults[pair.Key]; cached {
+			delete(st.pairResults, pair.Key)
+			st.dirtyPairs[pair.Key] = true
+		}
+		dropped++
+	}
+	st.matchPairs = kept
+	return dropped
+}
+
+// Пересчет результатов только тех пар, в которые входит матч key
+// источника source. Если данных одной из сторон нет или они устарели,
+// результат пары удаляется из кэша.
+func (st *analyzerState) recomputeAffectedPairs(source, key string) {
+	for _, pair := range st.matchPairs {
+		if !pairHasMatch(pair, source, key) {
+			continue
+		}
+
+		if result := st.evaluatePair(pair); result != nil {
+			st.pairResults[pair.Key] = result
+			st.dirtyPairs[pair.Key] = true
+		} else if _, cached := st.pairResults[pair.Key]; cached {
+			delete(st.pairResults, pair.Key)
+			st.dirtyPairs[pair.Key] = true
+		}
+	}
+}
+
+// Результат пары, если данные обеих сторон свежие и есть цены
+func (st *analyzerState) evaluatePair(pair MatchPair) map[string]interface{} {
+	keySansabet := generateMatchKey(pair.SansabetHome, pair.SansabetAway)
+	keyPinnacle := generateMatchKey(pair.PinnacleHome, pair.PinnacleAway)
+
+	sansabetMatch, sansabetExists := st.matchData["Sansabet"][keySansabet]
+	pinnacleMatch, pinnacleExists := st.matchData["Pinnacle"][keyPinnacle]
+	if !sansabetExists || !pinnacleExists ||
+		time.Since(sansabetMatch.LastUpdate) > maxStaleDuration ||
+		time.Since(pinnacleMatch.LastUpdate) > maxStaleDuration {
+		return nil
+	}
+
+	result := st.processPairAndGetResult(pair)
+	if result == nil || !hasNonEmptyPrices(result) {
+		return nil
+	}
+	return result
+}
+
+// Обработка одной пары и получение результата
+func (st *analyzerState) processPairAndGetResult(pair MatchPair) map[string]interface{} {
+	keySansabet := generateMatchKey(pair.SansabetHome, pair.SansabetAway)
+	keyPinnacle := generateMatchKey(pair.PinnacleHome, pair.PinnacleAway)
+
+	sansabetData, sansabetExists := st.matchData["Sansabet"][keySansabet]
+	pinnacleData, pinnacleExists := st.matchData["Pinnacle"][keyPinnacle]
+
+	pairLog := logOutcomes.With("pair_id", pair.Key, "match_id", pair.SansabetId)
+	if !sansabetExists || !pinnacleExists {
+		pairLog.Debug("Нет данных одной из сторон пары", "sansabet", sansabetExists, "pinnacle", pinnacleExists)
+		return nil
+	}
+
+	pairLog.Debug("Анализируем пару", "pinnacle_match_id", pair.PinnacleId, "pinnacle_name", pair.PinnacleName)
+
+	sansabetOdds, err := parseMarketOutcomes(sansabetData.Data)
+	if err != nil {
+		pairLog.Error("Ошибка парсинга данных", "source", "Sansabet", "error", err)
+		return nil
+	}
+	pinnacleOdds, err := parseMarketOutcomes(pinnacleData.Data)
+	if err != nil {
+		pairLog.Error("Ошибка парсинга данных", "source", "Pinnacle", "error", err)
+		return nil
+	}
+
+	var sansabetParsed, pinnacleParsed map[string]interface{}
+	json.Unmarshal([]byte(sansabetData.Data), &sansabetParsed)
+	json.Unmarshal([]byte(pinnacleData.Data), &pinnacleParsed)
+
+	if !checkHandicapConvention(pairLog, "Sansabet", sansabetParsed) || !checkHandicapConvention(pairLog, "Pinnacle", pinnacleParsed) {
+		dropMarketType(sansabetOdds, MarketTypeHandicap)
+		dropMarketType(pinnacleOdds, MarketTypeHandicap)
+	}
+	now := time.Now()
+	maxUnchanged := time.Duration(config.Quotes.MaxUnchangedSeconds) * time.Second
+	dropUnreliableMarkets(pairLog, "Sansabet", sansabetOdds, marketStates(sansabetData.Data), now, 0)
+	dropUnreliableMarkets(pairLog, "Pinnacle", pinnacleOdds, marketStates(pinnacleData.Data), now, maxUnchanged)
+	homeScore, _ := pinnacleParsed["HomeScore"].(float64)
+	awayScore, _ := pinnacleParsed["AwayScore"].(float64)
+	deriveEquivalentOutcomes(pinnacleOdds, int(homeScore), int(awayScore))
+
+	commonOutcomes := findCommonOutcomes(sansabetOdds, pinnacleOdds)
+	if len(commonOutcomes) == 0 {
+		pairLog.Debug("Нет общих исходов")
+		return nil
+	}
+
+	movement := st.movementSignals(keySansabet, keyPinnacle, commonOutcomes, now)
+	filtered, unpriced := calculateAndFilterCommonOutcomes(pairLog, commonOutcomes, pinnacleOdds, movement, pinnacleLimits(pinnacleData.Data))
+	if len(filtered) == 0 {
+		pairLog.Debug("Нет подходящих исходов", "common", len(commonOutcomes))
+		return nil
+	}
+	pairLog.Debug("Исходы пары посчитаны", "common", len(commonOutcomes), "filtered", len(filtered), "unpriced", len(unpriced))
+
+	leagueName := ""
+	if leagueNamePinnacle, ok := pinnacleParsed["LeagueName"].(string); ok && leagueNamePinnacle != "" {
+		leagueName = leagueNamePinnacle
+	} else if leagueNameSansabet, ok := sansabetParsed["LeagueName"].(string); ok {
+		leagueName = leagueNameSansabet
+	}
+
+	country := ""
+	if countryPinnacle, ok := pinnacleParsed["Country"].(string); ok {
+		country = countryPinnacle
+	} else if countrySansabet, ok := sansabetParsed["Country"].(string); ok {
+		country = countrySansabet
+	}
+
+	// UnpricedOutcomes - общие исходы без полного рынка Pinnacle:
+	// маржа недоступна, ROI не считается
+	result := map[string]interface{}{
+		"PairKey":          pair.Key,
+		"MatchName":        pair.PinnacleName,
+		"Score":            pair.Score,
+		"SansabetName":     pair.SansabetName,
+		"SansabetId":       pair.SansabetId,
+		"PinnacleId":       pair.PinnacleId,
+		"LeagueName":       leagueName,
+		"Country":          country,
+		"Outcomes":         filtered,
+		"UnpricedOutcomes": unpriced,
+	}
+
+	return result
+}
+
+// Проверка наличия непустых цен в результатах
+func hasNonEmptyPrices(result map[string]interface{}) bool {
+	outcomes, ok := result["Outcomes"].([]map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, outcome := range outcomes {
+		sansabet, ok := outcome["Sansabet"].(float64)
+		if !ok || sansabet == 0 {
+			return false
+		}
+		pinnacle, ok := outcome["Pinnacle"].(float64)
+		if !ok || pinnacle == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Исходы, вместе составляющие полный рынок для исхода: все стороны того же
+// рынка и линии. Двойной шанс - двусторонний рынок с противоположным
+// исходом 1x2 того же периода (1X против Win2, 12 против WinNone, X2 против Win1).
+func marginGroup(outcome MarketOutcome) []MarketOutcome {
+	if outcome.Market.Type == MarketTypeDoubleChance {
+		complement := map[string]string{"1X": "Win2", "12": "WinNone", "X2": "Win1"}[outcome.Side]
+		winner := findMarketSpec(outcome.Market.Period, MarketType1x2, "")
+		return []MarketOutcome{outcome, {Market: winner, Side: complement}}
+	}
+
+	sides := []string{"Win1", "Win2"}
+	switch outcome.Market.Type {
+	case MarketType1x2:
+		sides = []string{"Win1", "WinNone", "Win2"}
+	case MarketTypeTotal:
+		sides = []string{"More", "Less"}
+	case MarketTypeBothTeamsToScore:
+		sides = []string{"Yes", "No"}
+	}
+
+	group := []MarketOutcome{}
+	for _, side := range sides {
+		group = append(group, MarketOutcome{Market: outcome.Market, Line: outcome.Line, Side: side})
+	}
+	return group
+}
+
+// Цены Pinnacle всех исходов полного рынка (marginGroup) и позиция исхода
+// среди них. Берутся из полного рынка Pinnacle независимо от того, какие
+// исходы есть у Sansabet; если хотя бы одного исхода нет - errMarginUnavailable.
+func fullMarketOdds(outcome MarketOutcome, pinnacleOdds map[MarketOutcome]float64) ([]float64, int, error) {
+	odds := []float64{}
+	target := -1
+	for _, member := range marginGroup(outcome) {
+		price, exists := pinnacleOdds[member]
+		if !exists || price <= 1 {
+			return nil, -1, errMarginUnavailable
+		}
+		if member == outcome {
+			target = len(odds)
+		}
+		odds = append(odds, price)
+	}
+	if target < 0 {
+		return nil, -1, errMarginUnavailable
+	}
+	return odds, target, nil
+}
+
+// Расчет MARGIN (сумма обратных цен) по полному рынку Pinnacle
+func calculateMARGIN(outcome MarketOutcome, pinnacleOdds map[MarketOutcome]float64) (float64, error) {
+	parallelOdds, _, err := fullMarketOdds(outcome, pinnacleOdds)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := 0.0
+	for _, odd := range parallelOdds {
+		sum += 100.0 / odd
+	}
+
+	return 1.0 + (sum-100.0)/100.0, nil
+}
+
+// Способ снятия маржи для рынка по настройкам
+func devigMethodFor(marketType string) string {
+	if method, exists := config.Devig.Markets[marketType]; exists {
+		return method
+	}
+	return config.Devig.Default
+}
+
+// Справедливая цена исхода: маржа снимается с цен Pinnacle всех исходов
+// полного рынка (marginGroup) способом из настроек. Возвращает цену и способ.
+func fairOdds(outcome MarketOutcome, pinnacleOdds map[MarketOutcome]float64) (float64, string, error) {
+	odds, target, err := fullMarketOdds(outcome, pinnacleOdds)
+	if err != nil {
+		return 0, "", err
+	}
+
+	method := devigMethodFor(outcome.Market.Type)
+	probabilities := devigMethods[method](odds)
+	if probabilities == nil {
+		// Способ неприменим к этим ценам (например, аддитивный дал
+		// отрицательную вероятность), снимаем маржу пропорционально
+		method = DevigMultiplicative
+		probabilities = devigMultiplicative(odds)
+	}
+	return 1 / probabilities[target], method, nil
+}
+
+// Вероятности без маржи из цен (implied = 1/цена)
+func impliedProbabilities(odds []float64) ([]float64, float64) {
+	implied := make([]float64, len(odds))
+	sum := 0.0
+	for i, odd := range odds {
+		implied[i] = 1 / odd
+		sum += implied[i]
+	}
+	return implied, sum
+}
+
+// Пропорциональное снятие: маржа распределяется пропорционально вероятностям
+func devigMultiplicative(odds []float64) []float64 {
+	implied, sum := impliedProbabilities(odds)
+	for i := range implied {
+		implied[i] /= sum
+	}
+	return implied
+}
+
+// Аддитивное снятие: маржа поровну вычитается из каждой вероятности
+func devigAdditive(odds []float64) []float64 {
+	implied, sum := impliedProbabilities(odds)
+	share := (sum - 1) / float64(len(implied))
+	for i := range implied {
+		implied[i] -= share
+		if implied[i] <= 0 {
+			return nil
+		}
+	}
+	return implied
+}
+
+// Степенное снятие: p = implied^k, k подбирается так, чтобы сумма была 1
+func devigPower(odds []float64) []float64 {
+	implied, _ := impliedProbabilities(odds)
+	k := solveDecreasing(func(k float64) float64 {
+		sum := 0.0
+		for _, p := range implied {
+			sum += math.Pow(p, k)
+		}
+		return sum - 1
+	}, 0.01, 100)
+
+	for i, p := range implied {
+		implied[i] = math.Pow(p, k)
+	}
+	return implied
+}
+
+// Снятие по Шину: маржа объясняется долей z информированных игроков
+func devigShin(odds []float64) []float64 {
+	implied, sum := impliedProbabilities(odds)
+	if sum <= 1 {
+		return devigMultiplicative(odds)
+	}
+
+	shin := func(z float64) []float64 {
+		probabilities := make([]float64, len(implied))
+		for i, p := range implied {
+			probabilities[i] = (math.Sqrt(z*z+4*(1-z)*p*p/sum) - z) / (2 * (1 - z))
+		}
+		return probabilities
+	}
+	z := solveDecreasing(func(z float64) float64 {
+		total := 0.0
+		for _, p := range shin(z) {
+			total += p
+		}
+		return total - 1
+	}, 0, 0.99)
+	return shin(z)
+}
+
+// Снятие через отношение шансов: implied/(1-implied) = c * p/(1-p)
+func devigOddsRatio(odds []float64) []float64 {
+	implied, _ := impliedProbabilities(odds)
+	ratio := func(c float64) []float64 {
+		probabilities := make([]float64, len(implied))
+		for i, p := range implied {
+			probabilities[i] = p / (c - c*p + p)
+		}
+		return probabilities
+	}
+	c := solveDecreasing(func(c float64) float64 {
+		total := 0.0
+		for _, p := range ratio(c) {
+			total += p
+		}
+		return total - 1
+	}, 0.001, 1000)
+	return ratio(c)
+}
+
+// Корень убывающей функции на отрезке [lo, hi] делением пополам
+func solveDecreasing(f func(float64) float64, lo, hi float64) float64 {
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if f(mid) > 0 {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// Расчет ROI относительно справедливой цены Pinnacle по формуле из
+// настроек (см. ROIConfig)
+func calculateROI(sansaOdd, pinnacleOdd, fairOdd float64, method string, refund float64) ROIBreakdown {
+	rc := config.ROI
+	b := ROIBreakdown{
+		Formula:        roiFormula,
+		Sansabet:       sansaOdd,
+		Pinnacle:       pinnacleOdd,
+		FairOdds:       fairOdd,
+		DevigMethod:    method,
+		ExtraPercent:   1.0,
+		FixedCosts:     rc.FixedCosts,
+		Scale:          rc.Scale,
+		ExpectedRefund: refund,
+	}
+	if band := getExtraPercentBand(pinnacleOdd); band != nil {
+		b.ExtraPercent = band.ExtraPercent
+		b.ExtraBand = band
+	}
+	b.Edge = sansaOdd/(fairOdd*b.ExtraPercent) - 1
+	b.ROI = (b.Edge - rc.FixedCosts) * 100 * rc.Scale * (1 - refund)
+	return b
+}
+
+// Вес уверенности по максимальной ставке Pinnacle (см. LimitsConfig).
+// Отрицательный ROI не уменьшается: неуверенность в цене не делает
+// невыгодную ставку лучше.
+func applyStakeConfidence(b *ROIBreakdown, maxStake float64) {
+	b.MaxStake = maxStake
+	b.Confidence = 1
+	if fullStake := config.Limits.FullConfidenceStake; maxStake > 0 && fullStake > 0 {
+		b.Confidence = math.Min(1, maxStake/fullStake)
+	}
+	b.WeightedROI = b.ROI
+	if b.ROI > 0 {
+		b.WeightedROI = b.ROI * b.Confidence
+	}
+}
+
+// Максимальные ставки Pinnacle по полям рынков (поле Limits в OneGame)
+func pinnacleLimits(data string) map[string]float64 {
+	var feed struct {
+		Limits map[string]float64 `json:"Limits"`
+	}
+	if err := json.Unmarshal([]byte(data), &feed); err != nil {
+		return nil
+	}
+	return feed.Limits
+}
+
+// Максимальная ставка Pinnacle для исхода. Выведенные рынки берут лимит
+// рынка, из которого выведены (deriveEquivalentOutcomes); 0 - неизвестна.
+func maxStakeFor(outcome MarketOutcome, limits map[string]float64) float64 {
+	if limit, ok := limits[outcome.Market.Field]; ok {
+		return limit
+	}
+	switch outcome.Market.Type {
+	case MarketTypeDrawNoBet, MarketTypeDoubleChance:
+		return limits[findMarketSpec("", MarketTypeHandicap, "").Field]
+	case MarketTypeBothTeamsToScore:
+		first := limits[findMarketSpec("", MarketTypeTotal, "First Team").Field]
+		second := limits[findMarketSpec("", MarketTypeTotal, "Second Team").Field]
+		if first == 0 || (second > 0 && second < first) {
+			return second
+		}
+		return first
+	}
+	return 0
+}
+
+// Диапазон надбавки, в который попадает коэффициент Pinnacle
+func getExtraPercentBand(pinnacleOdd float64) *ExtraPercentBand {
+	for i := range config.ROI.ExtraPercents {
+		ep := &config.ROI.ExtraPercents[i]
+		if pinnacleOdd >= ep.Min && pinnacleOdd < ep.Max {
+			return ep
+		}
+	}
+	return nil
+}
+
+// Расчет и фильтрация общих исходов. Для целых и четвертных линий
+// ROI уменьшается на ожидаемую долю возврата ставки (см. expectedRefund).
+// Исходы, для которых у Pinnacle нет полного рынка, не оцениваются и
+// возвращаются отдельным списком названий.
+func calculateAndFilterCommonOutcomes(pairLog *slog.Logger, commonOutcomes map[MarketOutcome][2]float64, pinnacleOdds map[MarketOutcome]float64, movement map[MarketOutcome]MovementSignals, limits map[string]float64) ([]map[string]interface{}, []string) {
+	filtered := []map[string]interface{}{}
+	unpriced := []string{}
+
+	for outcome, values := range commonOutcomes {
+		margin, err := calculateMARGIN(outcome, pinnacleOdds)
+		if err != nil {
+			pairLog.Debug("Исход не оценивается", "outcome", outcome.Name(), "error", err)
+			unpriced = append(unpriced, outcome.Name())
+			continue
+		}
+		fair, method, err := fairOdds(outcome, pinnacleOdds)
+		if err != nil {
+			pairLog.Debug("Исход не оценивается", "outcome", outcome.Name(), "error", err)
+			unpriced = append(unpriced, outcome.Name())
+			continue
+		}
+		refund := expectedRefund(outcome, pinnacleOdds)
+		breakdown := calculateROI(values[0], values[1], fair, method, refund)
+		applyStakeConfidence(&breakdown, maxStakeFor(outcome, limits))
+		if breakdown.MaxStake > 0 && breakdown.MaxStake < config.Limits.MinStake {
+			pairLog.Debug("Максимальная ставка Pinnacle ниже limits.minStake", "outcome", outcome.Name(), "max_stake", breakdown.MaxStake)
+			continue
+		}
+		if breakdown.WeightedROI > config.ROI.MinROI {
+			filtered = append(filtered, map[string]interface{}{
+				"Outcome":        outcome.Name(),
+				"MarketType":     outcome.Market.Type,
+				"Period":         outcomePeriod(outcome.Market),
+				"ROI":            breakdown.ROI,
+				"MARGIN":         margin,
+				"FairOdds":       fair,
+				"DevigMethod":    method,
+				"ExpectedRefund": refund,
+				"Sansabet":       values[0],
+				"Pinnacle":       values[1],
+				"ROIBreakdown":   breakdown,
+				"Movement":       movement[outcome],
+				"MaxStake":       breakdown.MaxStake,
+			})
 		}
 	}
-	sendCurrentMatchesToFrontend()
-}
-
-// Группировка результатов по матчам
-func groupResultsByMatch(pairs []MatchPair) []map[string]interface{} {
-	results := []map[string]interface{}{}
-
-	matchDataMutex.RLock()
-	defer matchDataMutex.RUnlock()
+	// Сортируем результаты по убыванию ROI
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i]["ROI"].(float64) > filtered[j]["ROI"].(float64)
+	})
+	sort.Strings(unpriced)
 
-	for _, pair := range pairs {
-		keySansabet := generateMatchKey(pair.SansabetHome, pair.SansabetAway)
-		keyPinnacle := generateMatchKey(pair.PinnacleHome, pair.PinnacleAway)
+	return filtered, unpriced
+}
 
-		sansabetMatch, sansabetExists := matchData["Sansabet"][keySansabet]
-		pinnacleMatch, pinnacleExists := matchData["Pinnacle"][keyPinnacle]
+var subscriptionMarketTypes = map[string]bool{
+	MarketType1x2: true, MarketTypeTotal: true, MarketTypeHandicap: true,
+	MarketTypeDoubleChance: true, MarketTypeDrawNoBet: true, MarketTypeBothTeamsToScore: true,
+}
 
-		if sansabetExists && pinnacleExists &&
-			time.Since(sansabetMatch.LastUpdate) <= maxStaleDuration &&
-			time.Since(pinnacleMatch.LastUpdate) <= maxStaleDuration {
+var subscriptionPeriods = map[string]bool{"Match": true, "Time1": true, "Time2": true}
 
-			result := processPairAndGetResult(pair)
-			if result != nil {
-				// Check if the result contains non-empty prices
-				if hasNonEmptyPrices(result) {
-					results = append(results, result)
-				}
+// Проверка подписки и приведение списков к одному виду, чтобы одинаковые
+// подписки давали один ключ
+func (s *FrontendSubscription) normalize() error {
+	for _, marketType := range s.MarketTypes {
+		if !subscriptionMarketTypes[marketType] {
+			return fmt.Errorf("неизвестный тип рынка: %s", marketType)
+		}
+	}
+	for _, period := range s.Periods {
+		if !subscriptionPeriods[period] {
+			return fmt.Errorf("неизвестный период: %s", period)
+		}
+	}
+	if s.MinPinnacle < 0 {
+		return fmt.Errorf("некорректная минимальная цена Pinnacle: %v", s.MinPinnacle)
+	}
+	lower := func(values []string) []string {
+		result := []string{}
+		for _, value := range values {
+			if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+				result = append(result, value)
 			}
 		}
+		sort.Strings(result)
+		return result
 	}
-	return results
+	s.Leagues = lower(s.Leagues)
+	s.Countries = lower(s.Countries)
+	sort.Strings(s.MarketTypes)
+	sort.Strings(s.Periods)
+	return nil
 }
 
-// Обработка одной пары и получение результата
-func processPairAndGetResult(pair MatchPair) map[string]interface{} {
-	keySansabet := generateMatchKey(pair.SansabetHome, pair.SansabetAway)
-	keyPinnacle := generateMatchKey(pair.PinnacleHome, pair.PinnacleAway)
-
-	sansabetData, sansabetExists := matchData["Sansabet"][keySansabet]
-	pinnacleData, pinnacleExists := matchData["Pinnacle"][keyPinnacle]
+// Ключ подписки: клиенты с одинаковым ключом получают одни сообщения
+func (s FrontendSubscription) key() string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
 
-	if !sansabetExists || !pinnacleExists {
-		if !sansabetExists {
-			log.Printf("[DEBUG] Нет данных для Sansabet: ключ %s", keySansabet)
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
-		if !pinnacleExists {
-			log.Printf("[DEBUG] Нет данных для Pinnacle: ключ %s", keyPinnacle)
-		}
-		return nil
 	}
+	return false
+}
 
-	log.Printf("[DEBUG] Анализируем пару: %s | SansabetId=%s | PinnacleId=%s", pair.PinnacleName, pair.SansabetId, pair.PinnacleId)
-
-	commonOutcomes := findCommonOutcomes(sansabetData.Data, pinnacleData.Data)
-	if len(commonOutcomes) == 0 {
-		log.Printf("[DEBUG] Нет общих исходов для пары: %s", pair.SansabetName)
+// Результат пары с исходами, прошедшими фильтры подписки. nil - в матче
+// не осталось исходов.
+func (s FrontendSubscription) filter(result map[string]interface{}) map[string]interface{} {
+	if result == nil {
 		return nil
 	}
-
-	filtered := calculateAndFilterCommonOutcomes(commonOutcomes)
-	if len(filtered) == 0 {
-		log.Printf("[DEBUG] Нет подходящих исходов для пары: %s", pair.SansabetName)
-		return nil
+	if len(s.Leagues) > 0 {
+		league, _ := result["LeagueName"].(string)
+		if !containsString(s.Leagues, strings.ToLower(league)) {
+			return nil
+		}
 	}
-
-	var sansabetParsed, pinnacleParsed map[string]interface{}
-	json.Unmarshal([]byte(sansabetData.Data), &sansabetParsed)
-	json.Unmarshal([]byte(pinnacleData.Data), &pinnacleParsed)
-
-	leagueName := ""
-	if leagueNamePinnacle, ok := pinnacleParsed["LeagueName"].(string); ok && leagueNamePinnacle != "" {
-		leagueName = leagueNamePinnacle
-	} else if leagueNameSansabet, ok := sansabetParsed["LeagueName"].(string); ok {
-		leagueName = leagueNameSansabet
+	if len(s.Countries) > 0 {
+		country, _ := result["Country"].(string)
+		if !containsString(s.Countries, strings.ToLower(country)) {
+			return nil
+		}
+	}
+	if s.MinROI == nil && s.MinPinnacle == 0 && len(s.MarketTypes) == 0 && len(s.Periods) == 0 {
+		return result
 	}
 
-	country := ""
-	if countryPinnacle, ok := pinnacleParsed["Country"].(string); ok {
-		country = countryPinnacle
-	} else if countrySansabet, ok := sansabetParsed["Country"].(string); ok {
-		country = countrySansabet
+	outcomes, _ := result["Outcomes"].([]map[string]interface{})
+	kept := []map[string]interface{}{}
+	for _, outcome := range outcomes {
+		if s.MinROI != nil && outcome["ROI"].(float64) < *s.MinROI {
+			continue
+		}
+		if s.MinPinnacle > 0 && outcome["Pinnacle"].(float64) < s.MinPinnacle {
+			continue
+		}
+		if len(s.MarketTypes) > 0 && !containsString(s.MarketTypes, outcome["MarketType"].(string)) {
+			continue
+		}
+		if len(s.Periods) > 0 && !containsString(s.Periods, outcome["Period"].(string)) {
+			continue
+		}
+		kept = append(kept, outcome)
+	}
+	if len(kept) == 0 {
+		return nil
 	}
 
-	result := map[string]interface{}{
-		"MatchName":    pair.PinnacleName,
-		"Score":        pair.Score,
-		"SansabetName": pair.SansabetName,
-		"SansabetId":   pair.SansabetId,
-		"PinnacleId":   pair.PinnacleId,
-		"LeagueName":   leagueName,
-		"Country":      country,
-		"Outcomes":     filtered,
+	filtered := make(map[string]interface{}, len(result))
+	for field, value := range result {
+		filtered[field] = value
 	}
+	filtered["Outcomes"] = kept
+	return filtered
+}
 
-	return result
+// Текущие результаты всех пар и публикации по подпискам. Принадлежит
+// горутине frontendTickLoop.
+type frontendFeed struct {
+	order      []string                          // PairKey в порядке matchPairs
+	results    map[string]map[string]interface{} // PairKey -> результат
+	publishers map[string]*frontendPublisher     // FrontendSubscription.key() -> публикация
 }
 
-// Проверка наличия непустых цен в результатах
-func hasNonEmptyPrices(result map[string]interface{}) bool {
-	outcomes, ok := result["Outcomes"].([]map[string]interface{})
-	if !ok {
-		return false
+func newFrontendFeed() *frontendFeed {
+	return &frontendFeed{
+		results:    make(map[string]map[string]interface{}),
+		publishers: make(map[string]*frontendPublisher),
 	}
+}
 
-	for _, outcome := range outcomes {
-		sansabet, ok := outcome["Sansabet"].(float64)
-		if !ok || sansabet == 0 {
-			return false
-		}
-		pinnacle, ok := outcome["Pinnacle"].(float64)
-		if !ok || pinnacle == 0 {
-			return false
+// Учет изменившихся результатов пар (nil - пара пропала)
+func (f *frontendFeed) update(order []string, changed map[string]map[string]interface{}) {
+	f.order = order
+	for key, result := range changed {
+		if result == nil {
+			delete(f.results, key)
+		} else {
+			f.results[key] = result
 		}
 	}
-
-	return true
 }
 
-// Переворот среза
-func reverseSlice(slice []string) []string {
-	result := make([]string, len(slice))
-	for i, v := range slice {
-		result[len(slice)-1-i] = v
-	}
-	return result
+// Последнее отправленное клиентам одной подписки состояние и номер дельты
+type frontendPublisher struct {
+	subscription FrontendSubscription
+	seq          int64
+	order        []string              // PairKey в порядке matchPairs
+	matches      map[string]*sentMatch // PairKey -> отправленный матч
 }
 
-// Расчет MARGIN
-func calculateMARGIN(outcomeName string, outcomes map[string][2]float64) float64 {
-	parallelOdds := []float64{}
-	paralelNames := []string{outcomeName}
+// Отправленный матч и JSON его полей и исходов для сравнения
+type sentMatch struct {
+	result   map[string]interface{}
+	fields   map[string]string // поле матча (кроме Outcomes) -> JSON
+	outcomes map[string]string // Outcome -> JSON исхода
+}
 
-	splitedName := reverseSlice(strings.Split(outcomeName, " "))
+func newFrontendPublisher(subscription FrontendSubscription) *frontendPublisher {
+	return &frontendPublisher{subscription: subscription, matches: make(map[string]*sentMatch)}
+}
 
-	if len(splitedName) == 1 {
-		names := []string{
-			"Win1", "WinNone", "Win2",
+func newSentMatch(result map[string]interface{}) *sentMatch {
+	sent := &sentMatch{
+		result:   result,
+		fields:   make(map[string]string),
+		outcomes: make(map[string]string),
+	}
+	for field, value := range result {
+		if field == "Outcomes" {
+			continue
 		}
-		for _, name := range names {
-			if name != paralelNames[0] {
-				paralelNames = append(paralelNames, name)
+		data, _ := json.Marshal(value)
+		sent.fields[field] = string(data)
+	}
+	outcomes, _ := result["Outcomes"].([]map[string]interface{})
+	for _, outcome := range outcomes {
+		data, _ := json.Marshal(outcome)
+		sent.outcomes[outcome["Outcome"].(string)] = string(data)
+	}
+	return sent
+}
+
+// Применение изменившихся результатов пар (nil - пара пропала). Возвращает
+// дельту или nil, если для фронтенда ничего не изменилось.
+func (p *frontendPublisher) apply(order []string, changed map[string]map[string]interface{}) *FrontendMessage {
+	p.order = order
+	var changes []FrontendChange
+	for key, result := range changed {
+		old, existed := p.matches[key]
+		result = p.subscription.filter(result)
+		if result == nil {
+			if existed {
+				delete(p.matches, key)
+				changes = append(changes, FrontendChange{Op: "remove", Pair: key})
 			}
+			continue
 		}
-	} else if splitedName[2] == "Total" {
-		if splitedName[1] == "More" {
-			splitedName[1] = "Less"
-		} else {
-			splitedName[1] = "More"
+
+		sent := newSentMatch(result)
+		p.matches[key] = sent
+		if !existed {
+			changes = append(changes, FrontendChange{Op: "add", Pair: key, Match: result})
+			continue
 		}
-		paralelNames = append(paralelNames, strings.Join(reverseSlice(splitedName), " "))
-	} else if splitedName[1] == "Handicap" {
-		if splitedName[0] == "Win1" {
-			splitedName[0] = "Win2"
-		} else {
-			splitedName[0] = "Win1"
+		if change, ok := diffMatch(key, old, sent); ok {
+			changes = append(changes, change)
 		}
-
-		line, _ := strconv.ParseFloat(splitedName[1], 64)
-		line *= -1
-
-		paralelNames = append(paralelNames, strings.Join(reverseSlice(splitedName), " "))
 	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// Порядок изменений не зависит от обхода карты
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Pair < changes[j].Pair })
+	p.seq++
+	return &FrontendMessage{Type: "delta", Seq: p.seq, Changes: changes}
+}
 
-	for name, odds := range outcomes {
-		for _, paralelName := range paralelNames {
-			if name == paralelName {
-				parallelOdds = append(parallelOdds, odds[1])
+// Изменения матча: поля и исходы, JSON которых отличается от отправленного
+func diffMatch(key string, old, sent *sentMatch) (FrontendChange, bool) {
+	change := FrontendChange{Op: "update", Pair: key}
+	for field, data := range sent.fields {
+		if old.fields[field] != data {
+			if change.Match == nil {
+				change.Match = map[string]interface{}{}
 			}
+			change.Match[field] = sent.result[field]
 		}
 	}
-
-	if len(parallelOdds) < 2 {
-		return 1.08
-	}
-
-	sum := 0.0
-	for _, odd := range parallelOdds {
-		if odd != 0 {
-			sum += 100.0 / odd
+	outcomes, _ := sent.result["Outcomes"].([]map[string]interface{})
+	for _, outcome := range outcomes {
+		name := outcome["Outcome"].(string)
+		if old.outcomes[name] != sent.outcomes[name] {
+			change.Outcomes = append(change.Outcomes, outcome)
 		}
 	}
-
-	return 1.0 + (sum-100.0)/100.0
-}
-
-// Расчет ROI
-func calculateROI(sansaOdd, pinnacleOdd float64, margin float64) float64 {
-	extraPercent := getExtraPercent(pinnacleOdd)
-	roi := (sansaOdd/(pinnacleOdd*margin*extraPercent) - 1 - 0.03) * 100 * 0.67
-	return roi
-}
-
-// Получение дополнительного процента
-func getExtraPercent(pinnacleOdd float64) float64 {
-	for _, ep := range extraPercents {
-		if pinnacleOdd >= ep.Min && pinnacleOdd < ep.Max {
-			return ep.ExtraPercent
+	for name := range old.outcomes {
+		if _, ok := sent.outcomes[name]; !ok {
+			change.RemovedOutcomes = append(change.RemovedOutcomes, name)
 		}
 	}
-	return 1.0
+	sort.Strings(change.RemovedOutcomes)
+	ok := change.Match != nil || len(change.Outcomes) > 0 || len(change.RemovedOutcomes) > 0
+	return change, ok
 }
 
-// Расчет и фильтрация общих исходов
-func calculateAndFilterCommonOutcomes(commonOutcomes map[string][2]float64) []map[string]interface{} {
-	filtered := []map[string]interface{}{}
-
-	for outcome, values := range commonOutcomes {
-		margin := calculateMARGIN(outcome, commonOutcomes)
-		roi := calculateROI(values[0], values[1], margin)
-		if roi > -30 {
-			filtered = append(filtered, map[string]interface{}{
-				"Outcome":  outcome,
-				"ROI":      roi,
-				"MARGIN":   margin,
-				"Sansabet": values[0],
-				"Pinnacle": values[1],
-			})
+// Снимок всех отправленных матчей с текущим seq
+func (p *frontendPublisher) snapshot() *FrontendMessage {
+	matches := []map[string]interface{}{}
+	for _, key := range p.order {
+		if sent, ok := p.matches[key]; ok {
+			matches = append(matches, sent.result)
 		}
 	}
-	// Сортируем результаты по убыванию ROI
-	sort.Slice(filtered, func(i, j int) bool {
-		return filtered[i]["ROI"].(float64) > filtered[j]["ROI"].(float64)
-	})
-
-	return filtered
+	return &FrontendMessage{Type: "snapshot", Seq: p.seq, Matches: matches}
 }
 
-// Отправка данных клиентам фронтенда
-func forwardToFrontendBatch(results []map[string]interface{}) {
-	log.Printf("[DEBUG] Подготовка данных для отправки клиентам")
-
-	data, err := json.Marshal(results)
-	if err != nil {
-		log.Printf("[ERROR] Ошибка кодирования JSON: %v", err)
-		return
+// Постановка сообщения в очереди клиентов фронтенда. Возвращает клиентов,
+// у которых из переполненной очереди выброшено сообщение.
+func forwardToFrontendBatch(message *FrontendMessage, clients []*clientSender) []*clientSender {
+	if len(clients) == 0 {
+		return nil
 	}
 
-	frontendMutex.Lock()
-	defer frontendMutex.Unlock()
-
-	if len(frontendClients) == 0 {
-		log.Printf("[DEBUG] Нет подключенных клиентов, данные не отправлены")
-		return
+	data, err := json.Marshal(message)
+	if err != nil {
+		logFrontend.Error("Ошибка кодирования сообщения", "type", message.Type, "error", err)
+		return nil
 	}
+	logFrontend.Debug("Отправка сообщения клиентам", "type", message.Type, "seq", message.Seq, "bytes", len(data), "clients", len(clients))
 
-	for client := range frontendClients {
-		log.Printf("[DEBUG] Отправка данных клиенту: %v", client.RemoteAddr())
-		log.Printf("[DEBUG] Данные для отправки клиенту: %s", string(data))
-		if err := client.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("[ERROR] Ошибка отправки данных клиенту (%v): %v", client.RemoteAddr(), err)
-			client.Close()
-			delete(frontendClients, client)
-			log.Printf("[DEBUG] Клиент удалён: %v", client.RemoteAddr())
-		} else {
-			log.Printf("[DEBUG] Данные успешно отправлены клиенту: %v", client.RemoteAddr())
+	lagging := []*clientSender{}
+	for _, client := range clients {
+		if client.enqueue(data) {
+			lagging = append(lagging, client)
 		}
 	}
+	return lagging
 }
 
-// Нормализация ключа тотала
-func normalizeTotal(total string) string {
-	// Пробуем преобразовать строку в число
-	value, err := strconv.ParseFloat(total, 64)
-	if err != nil {
-		return total // Если не удалось преобразовать, возвращаем как есть
-	}
-	// Возвращаем строку с одним знаком после запятой
-	return fmt.Sprintf("%.1f", value)
-}
-
-// Поиск общих исходов
-func findCommonOutcomes(sansabetData, pinnacleData string) map[string][2]float64 {
-	//log.Printf("[DEBUG] Входные данные для анализа: Sansabet=%s, Pinnacle=%s", sansabetData, pinnacleData)
-
-	var sansabetOdds, pinnacleOdds struct {
-		Win1x2 map[string]float64 `json:"Win1x2"`
-		Totals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"Totals"`
-		FirstTeamTotals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"FirstTeamTotals"`
-		SecondTeamTotals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"SecondTeamTotals"`
-		Handicap map[string]struct {
-			Win1 float64 `json:"Win1"`
-			Win2 float64 `json:"Win2"`
-		} `json:"Handicap"`
-
-		Time1Win1x2 map[string]float64 `json:"Time1Win1x2"`
-		Time1Totals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"Time1Totals"`
-		Time1FirstTeamTotals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"Time1FirstTeamTotals"`
-		Time1SecondTeamTotals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"Time1SecondTeamTotals"`
-		Time1Handicap map[string]struct {
-			Win1 float64 `json:"Win1"`
-			Win2 float64 `json:"Win2"`
-		} `json:"Time1Handicap"`
-
-		Time2Win1x2 map[string]float64 `json:"Time2Win1x2"`
-		Time2Totals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"Time2Totals"`
-		Time2FirstTeamTotals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"Time2FirstTeamTotals"`
-		Time2SecondTeamTotals map[string]struct {
-			WinMore float64 `json:"WinMore"`
-			WinLess float64 `json:"WinLess"`
-		} `json:"Time2SecondTeamTotals"`
-		Time2Handicap map[string]struct {
-			Win1 float64 `json:"Win1"`
-			Win2 float64 `json:"Win2"`
-		} `json:"Time2Handicap"`
-	}
-	common := make(map[string][2]float64)
-
-	if err := json.Unmarshal([]byte(sansabetData), &sansabetOdds); err != nil {
-		log.Printf("[ERROR] Ошибка парсинга данных Sansabet: %v", err)
-		return common
-	}
-	if err := json.Unmarshal([]byte(pinnacleData), &pinnacleOdds); err != nil {
-		log.Printf("[ERROR] Ошибка парсинга данных Pinnacle: %v", err)
-		return common
-	}
-
-	for key, sansabetValue := range sansabetOdds.Win1x2 {
-		if pinnacleValue, exists := pinnacleOdds.Win1x2[key]; exists && pinnacleValue >= 1.02 && pinnacleValue <= 35 {
-			common[key] = [2]float64{sansabetValue, pinnacleValue}
-			log.Printf("[DEBUG] Найден общий исход Win1x2: %s", key)
-		}
-	}
-
-	// Создаем нормализованные мапы для тоталов
-	normalizedSansaTotals := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnTotals := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-
-	// Нормализуем ключи для основных тоталов
-	for key, value := range sansabetOdds.Totals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTotals[normalizedKey] = value
-	}
-	for key, value := range pinnacleOdds.Totals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnTotals[normalizedKey] = value
+func newClientSender(conn *websocket.Conn) *clientSender {
+	return &clientSender{
+		conn:      conn,
+		queue:     make(chan []byte, config.Frontend.SendQueueSize),
+		done:      make(chan struct{}),
+		connected: time.Now(),
 	}
+}
 
-	// Проверяем тоталы с нормализованными ключами
-	for key, sansabetTotal := range normalizedSansaTotals {
-		if pinnacleTotal, exists := normalizedPinnTotals[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Totals More: %s", key)
-			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Totals Less: %s", key)
-			}
-		}
+// Постановка сообщения в очередь без ожидания. При переполнении по
+// frontend.slowClientPolicy выбрасывается самое старое сообщение (тогда
+// возвращается true) или клиент отключается.
+func (c *clientSender) enqueue(data []byte) bool {
+	select {
+	case c.queue <- data:
+		return false
+	default:
 	}
 
-	// Нормализуем ключи для индивидуальных тоталов первой команды
-	normalizedSansaFirstTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnFirstTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
+	if config.Frontend.SlowClientPolicy == SlowClientDisconnect {
+		logFrontend.Warn("Очередь клиента переполнена, отключаем", "client", c.conn.RemoteAddr().String(), "queue_size", cap(c.queue))
+		metricFrontendDisconnected.Inc()
+		c.close()
+		return false
+	}
 
-	for key, value := range sansabetOdds.FirstTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaFirstTeam[normalizedKey] = value
+	// Очередь может освободиться между попытками, поэтому без ожидания
+	select {
+	case <-c.queue:
+		atomic.AddInt64(&c.dropped, 1)
+		metricFrontendDropped.Inc()
+	default:
 	}
-	for key, value := range pinnacleOdds.FirstTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnFirstTeam[normalizedKey] = value
+	select {
+	case c.queue <- data:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+		metricFrontendDropped.Inc()
 	}
+	logFrontend.Warn("Очередь клиента переполнена, старое сообщение выброшено", "client", c.conn.RemoteAddr().String(), "dropped", atomic.LoadInt64(&c.dropped))
+	return true
+}
 
-	// Проверяем индивидуальные тоталы первой команды с нормализованными ключами
-	for key, sansabetTotal := range normalizedSansaFirstTeam {
-		if pinnacleTotal, exists := normalizedPinnFirstTeam[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["First Team Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход First Team Totals More: %s", key)
+// Горутина записи: сообщения из очереди и ping. Ошибка записи закрывает
+// соединение, и обработчик /output удаляет клиента.
+func (c *clientSender) writeLoop() {
+	ping := time.NewTicker(time.Duration(config.Frontend.PingSeconds) * time.Second)
+	defer ping.Stop()
+	writeTimeout := time.Duration(config.Frontend.WriteTimeoutSeconds) * time.Second
+
+	for {
+		select {
+		case data := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				logFrontend.Error("Ошибка отправки данных клиенту", "client", c.conn.RemoteAddr().String(), "error", err)
+				c.close()
+				return
 			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["First Team Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход First Team Totals Less: %s", key)
+			atomic.AddInt64(&c.sent, 1)
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				logFrontend.Error("Ошибка отправки ping клиенту", "client", c.conn.RemoteAddr().String(), "error", err)
+				c.close()
+				return
 			}
+		case <-c.done:
+			return
 		}
 	}
+}
 
-	// Нормализуем ключи для индивидуальных тоталов второй команды
-	normalizedSansaSecondTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnSecondTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
+// Закрытие соединения и остановка горутины записи. Можно вызывать
+// несколько раз.
+func (c *clientSender) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+		logFrontend.Info("Клиент отключен", "client", c.conn.RemoteAddr().String(), "sent", atomic.LoadInt64(&c.sent), "dropped", atomic.LoadInt64(&c.dropped))
 	})
+}
 
-	for key, value := range sansabetOdds.SecondTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaSecondTeam[normalizedKey] = value
+// Нормализация ключа линии тотала или гандикапа. Линия сохраняется точно:
+// "2.50" -> "2.5", "2.25" -> "2.25", "-0" -> "0", поэтому четвертные линии
+// не склеиваются с соседними и сравниваются только одинаковые линии.
+func normalizeLine(line string) string {
+	value, err := strconv.ParseFloat(line, 64)
+	if err != nil {
+		return line
 	}
-	for key, value := range pinnacleOdds.SecondTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnSecondTeam[normalizedKey] = value
+	if value == 0 {
+		return "0"
 	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
 
-	// Проверяем индивидуальные тоталы второй команды с нормализованными ключами
-	for key, sansabetTotal := range normalizedSansaSecondTeam {
-		if pinnacleTotal, exists := normalizedPinnSecondTeam[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Second Team Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Second Team Totals More: %s", key)
-			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Second Team Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Second Team Totals Less: %s", key)
-			}
-		}
+// Доля ставки, которая в среднем возвращается. Целая линия (2.0) - возврат
+// всей ставки, если итог ровно на линии; четвертная (2.25, 2.75) - ставка
+// делится пополам на соседние линии (2.0 и 2.5, 2.5 и 3.0), и возвращается
+// половина, если итог на целой половине. Вероятность итога ровно на целой
+// линии L берётся из справедливых цен Pinnacle на той же стороне линий
+// L-0.5 и L+0.5. Если соседних линий нет, возврат не учитывается.
+func expectedRefund(outcome MarketOutcome, pinnacleOdds map[MarketOutcome]float64) float64 {
+	// Ставка без ничьей - тот же гандикап 0: при ничьей ставка возвращается
+	if outcome.Market.Type == MarketTypeDrawNoBet {
+		handicap := findMarketSpec(outcome.Market.Period, MarketTypeHandicap, "")
+		outcome = MarketOutcome{Market: handicap, Line: "0", Side: outcome.Side}
+	}
+	if !outcome.Market.HasLines() {
+		return 0
+	}
+	line, err := strconv.ParseFloat(outcome.Line, 64)
+	if err != nil {
+		return 0
 	}
 
-	// Нормализуем ключи для гандикапов
-	normalizedSansaHandicap := make(map[string]struct {
-		Win1 float64 `json:"Win1"`
-		Win2 float64 `json:"Win2"`
-	})
-	normalizedPinnHandicap := make(map[string]struct {
-		Win1 float64 `json:"Win1"`
-		Win2 float64 `json:"Win2"`
-	})
+	var pushLine, stakeShare float64
+	switch fraction := math.Abs(line - math.Trunc(line)); fraction {
+	case 0:
+		pushLine, stakeShare = line, 1
+	case 0.25, 0.75:
+		pushLine, stakeShare = math.Round(line), 0.5
+	default:
+		return 0
+	}
 
-	for key, value := range sansabetOdds.Handicap {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaHandicap[normalizedKey] = value
+	lower, lowerOk := fairSideProbability(outcome, pushLine-0.5, pinnacleOdds)
+	upper, upperOk := fairSideProbability(outcome, pushLine+0.5, pinnacleOdds)
+	if !lowerOk || !upperOk {
+		logOutcomes.Debug("Нет соседних половинных линий Pinnacle, возврат не учитывается", "outcome", outcome.Name())
+		return 0
 	}
-	for key, value := range pinnacleOdds.Handicap {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnHandicap[normalizedKey] = value
+	return stakeShare * math.Abs(lower-upper)
+}
+
+// Справедливая вероятность стороны исхода на указанной линии рынка Pinnacle
+// (без маржи, пропорционально по двум сторонам линии)
+func fairSideProbability(outcome MarketOutcome, line float64, pinnacleOdds map[MarketOutcome]float64) (float64, bool) {
+	lineKey := normalizeLine(strconv.FormatFloat(line, 'f', -1, 64))
+	side, sideOk := pinnacleOdds[MarketOutcome{Market: outcome.Market, Line: lineKey, Side: outcome.Side}]
+	if !sideOk || side <= 1 {
+		return 0, false
 	}
 
-	// Проверяем гандикапы с нормализованными ключами
-	for key, sansabetHandicap := range normalizedSansaHandicap {
-		if pinnacleHandicap, exists := normalizedPinnHandicap[key]; exists {
-			// Проверяем Win1
-			if pinnacleHandicap.Win1 >= 1.02 && pinnacleHandicap.Win1 <= 35 {
-				common["Handicap "+key+" Win1"] = [2]float64{sansabetHandicap.Win1, pinnacleHandicap.Win1}
-				log.Printf("[DEBUG] Найден общий исход Handicap Win1: %s", key)
-			}
-			// Проверяем Win2
-			if pinnacleHandicap.Win2 >= 1.02 && pinnacleHandicap.Win2 <= 35 {
-				common["Handicap "+key+" Win2"] = [2]float64{sansabetHandicap.Win2, pinnacleHandicap.Win2}
-				log.Printf("[DEBUG] Найден общий исход Handicap Win2: %s", key)
-			}
+	total := 1 / side
+	others := 0
+	for other, price := range pinnacleOdds {
+		if other.Market == outcome.Market && other.Line == lineKey && other.Side != outcome.Side && price > 1 {
+			total += 1 / price
+			others++
 		}
 	}
+	if others == 0 {
+		return 0, false
+	}
+	return (1 / side) / total, true
+}
 
-	// Нормализуем тоталы первого тайма
-	normalizedSansaTime1Totals := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnTime1Totals := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
+// Название исхода для фронтенда и калькулятора:
+// [период] [участник] тип [линия] сторона, например "Time1 Total More 2.5",
+// "First Team Total Less 1.5", "Handicap -0.5 Win1", "Time2 Win1",
+// "Double Chance 1X", "Draw No Bet Win2", "Both Teams To Score Yes"
+// Период рынка для фронтенда и подписок: Match, Time1 или Time2
+func outcomePeriod(spec MarketSpec) string {
+	if spec.Period == "" {
+		return "Match"
+	}
+	return spec.Period
+}
 
-	for key, value := range sansabetOdds.Time1Totals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime1Totals[normalizedKey] = value
+func (o MarketOutcome) Name() string {
+	parts := []string{}
+	if o.Market.Period != "" {
+		parts = append(parts, o.Market.Period)
 	}
-	for key, value := range pinnacleOdds.Time1Totals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnTime1Totals[normalizedKey] = value
+	if o.Market.Participant != "" {
+		parts = append(parts, o.Market.Participant)
 	}
-
-	for key, sansabetTotal := range normalizedSansaTime1Totals {
-		if pinnacleTotal, exists := normalizedPinnTime1Totals[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Time1 Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Time1 Totals More: %s", key)
-			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Time1 Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Time1 Totals Less: %s", key)
-			}
+	switch o.Market.Type {
+	case MarketTypeTotal:
+		parts = append(parts, "Total", o.Side, o.Line)
+	case MarketTypeHandicap:
+		parts = append(parts, "Handicap", o.Line, o.Side)
+	default:
+		if typeName, exists := marketTypeNames[o.Market.Type]; exists {
+			parts = append(parts, typeName)
 		}
+		parts = append(parts, o.Side)
 	}
+	return strings.Join(parts, " ")
+}
 
-	// Нормализуем индивидуальные тоталы первого тайма первой команды
-	normalizedSansaTime1FirstTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnTime1FirstTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
+// Рынок с линиями (тоталы, гандикапы)
+func (m MarketSpec) HasLines() bool {
+	return m.Type == MarketTypeTotal || m.Type == MarketTypeHandicap
+}
 
-	for key, value := range sansabetOdds.Time1FirstTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime1FirstTeam[normalizedKey] = value
-	}
-	for key, value := range pinnacleOdds.Time1FirstTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnTime1FirstTeam[normalizedKey] = value
+// Поиск рынка в marketSpecs по периоду, типу и участнику
+func findMarketSpec(period, marketType, participant string) MarketSpec {
+	for _, spec := range marketSpecs {
+		if spec.Period == period && spec.Type == marketType && spec.Participant == participant {
+			return spec
+		}
 	}
+	return MarketSpec{Period: period, Type: marketType, Participant: participant}
+}
 
-	for key, sansabetTotal := range normalizedSansaTime1FirstTeam {
-		if pinnacleTotal, exists := normalizedPinnTime1FirstTeam[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Time1 First Team Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Time1 First Team Totals More: %s", key)
-			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Time1 First Team Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Time1 First Team Totals Less: %s", key)
-			}
+// Рынки, которых нет у букмекера напрямую, но которые равны другим рынкам:
+// ставка без ничьей - гандикап 0, двойной шанс 1X и X2 - гандикап хозяев
+// +0.5 и гостей +0.5 (линия хозяев -0.5), "обе забьют", если одна команда
+// уже забила, - больше/меньше 0.5 в индивидуальном тотале второй.
+// Уже имеющиеся у букмекера исходы не перезаписываются.
+func deriveEquivalentOutcomes(odds map[MarketOutcome]float64, homeScore, awayScore int) {
+	handicap := findMarketSpec("", MarketTypeHandicap, "")
+	derive := func(target, source MarketOutcome) {
+		if _, exists := odds[target]; exists {
+			return
+		}
+		if price, exists := odds[source]; exists {
+			odds[target] = price
 		}
 	}
 
-	// Нормализуем индивидуальные тоталы первого тайма второй команды
-	normalizedSansaTime1SecondTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnacleTime1SecondTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	for key, value := range sansabetOdds.Time1SecondTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime1SecondTeam[normalizedKey] = value
+	drawNoBet := findMarketSpec("", MarketTypeDrawNoBet, "")
+	derive(MarketOutcome{Market: drawNoBet, Side: "Win1"}, MarketOutcome{Market: handicap, Line: "0", Side: "Win1"})
+	derive(MarketOutcome{Market: drawNoBet, Side: "Win2"}, MarketOutcome{Market: handicap, Line: "0", Side: "Win2"})
+
+	doubleChance := findMarketSpec("", MarketTypeDoubleChance, "")
+	derive(MarketOutcome{Market: doubleChance, Side: "1X"}, MarketOutcome{Market: handicap, Line: "0.5", Side: "Win1"})
+	derive(MarketOutcome{Market: doubleChance, Side: "X2"}, MarketOutcome{Market: handicap, Line: "-0.5", Side: "Win2"})
+
+	var scorelessTeam string
+	switch {
+	case homeScore > 0 && awayScore == 0:
+		scorelessTeam = "Second Team"
+	case awayScore > 0 && homeScore == 0:
+		scorelessTeam = "First Team"
+	default:
+		return
 	}
-	for key, value := range pinnacleOdds.Time1SecondTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnacleTime1SecondTeam[normalizedKey] = value
+	bothTeamsToScore := findMarketSpec("", MarketTypeBothTeamsToScore, "")
+	teamTotal := findMarketSpec("", MarketTypeTotal, scorelessTeam)
+	derive(MarketOutcome{Market: bothTeamsToScore, Side: "Yes"}, MarketOutcome{Market: teamTotal, Line: "0.5", Side: "More"})
+	derive(MarketOutcome{Market: bothTeamsToScore, Side: "No"}, MarketOutcome{Market: teamTotal, Line: "0.5", Side: "Less"})
+}
+
+// Разбор всех рынков из marketSpecs в плоскую карту исход -> цена
+func parseMarketOutcomes(data string) (map[MarketOutcome]float64, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return nil, err
 	}
 
-	for key, sansabetTotal := range normalizedSansaTime1SecondTeam {
-		if pinnacleTotal, exists := normalizedPinnacleTime1SecondTeam[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Time1 Second Team Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Time1 Second Team Totals More: %s", key)
+	outcomes := make(map[MarketOutcome]float64)
+	for _, spec := range marketSpecs {
+		raw, exists := fields[spec.Field]
+		if !exists || string(raw) == "null" {
+			continue
+		}
+
+		if !spec.HasLines() {
+			var prices map[string]float64
+			if err := json.Unmarshal(raw, &prices); err != nil {
+				return nil, fmt.Errorf("поле %s: %v", spec.Field, err)
+			}
+			for side, price := range prices {
+				if name, known := marketSides[side]; known && price > 0 {
+					outcomes[MarketOutcome{Market: spec, Side: name}] = price
+				}
 			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Time1 Second Team Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Time1 Second Team Totals Less: %s", key)
+			continue
+		}
+
+		var lines map[string]map[string]float64
+		if err := json.Unmarshal(raw, &lines); err != nil {
+			return nil, fmt.Errorf("поле %s: %v", spec.Field, err)
+		}
+		for line, prices := range lines {
+			for side, price := range prices {
+				if name, known := marketSides[side]; known && price > 0 {
+					outcomes[MarketOutcome{Market: spec, Line: normalizeLine(line), Side: name}] = price
+				}
 			}
 		}
 	}
+	return outcomes, nil
+}
 
-	// Нормализуем гандикапы первого тайма
-	normalizedSansaTime1Handicap := make(map[string]struct {
-		Win1 float64 `json:"Win1"`
-		Win2 float64 `json:"Win2"`
-	})
-	normalizedPinnacleTime1Handicap := make(map[string]struct {
-		Win1 float64 `json:"Win1"`
-		Win2 float64 `json:"Win2"`
-	})
-	for key, value := range sansabetOdds.Time1Handicap {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime1Handicap[normalizedKey] = value
+// Одинаковые ключи гандикапа значат одну и ту же линию, только если парсер
+// передаёт их в ожидаемом соглашении (линия хозяев от начала матча)
+func checkHandicapConvention(pairLog *slog.Logger, source string, parsed map[string]interface{}) bool {
+	convention, _ := parsed["HandicapConvention"].(string)
+	if convention != handicapConvention {
+		pairLog.Warn("Гандикапы в другом соглашении не сравниваются", "source", source, "convention", convention, "expected", handicapConvention)
+		return false
+	}
+	return true
+}
+
+// Состояния рынков из сообщения парсера; nil, если парсер их не передаёт
+func marketStates(data string) map[string]MarketState {
+	var feed struct {
+		Markets map[string]MarketState `json:"Markets"`
 	}
-	for key, value := range pinnacleOdds.Time1Handicap {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnacleTime1Handicap[normalizedKey] = value
+	if err := json.Unmarshal([]byte(data), &feed); err != nil {
+		return nil
 	}
+	return feed.Markets
+}
 
-	for key, sansabetHandicap := range normalizedSansaTime1Handicap {
-		if pinnacleHandicap, exists := normalizedPinnacleTime1Handicap[key]; exists {
-			// Проверяем Win1
-			if pinnacleHandicap.Win1 >= 1.02 && pinnacleHandicap.Win1 <= 35 {
-				common["Time1 Handicap Win1 "+key] = [2]float64{sansabetHandicap.Win1, pinnacleHandicap.Win1}
-				log.Printf("[DEBUG] Найден общий исход Time1 Handicap Win1: %s", key)
-			}
-			// Проверяем Win2
-			if pinnacleHandicap.Win2 >= 1.02 && pinnacleHandicap.Win2 <= 35 {
-				common["Time1 Handicap Win2 "+key] = [2]float64{sansabetHandicap.Win2, pinnacleHandicap.Win2}
-				log.Printf("[DEBUG] Найден общий исход Time1 Handicap Win2: %s", key)
-			}
+// Удаление исходов приостановленных рынков и рынков, цены которых не
+// менялись дольше maxUnchanged (0 - давность не проверяется). Рынки без
+// состояния не трогаются. Удаление идёт до вывода рынков Pinnacle из
+// гандикапов и тоталов, поэтому выведенные исходы наследуют проверку.
+func dropUnreliableMarkets(pairLog *slog.Logger, source string, odds map[MarketOutcome]float64, states map[string]MarketState, now time.Time, maxUnchanged time.Duration) {
+	for outcome := range odds {
+		state, known := states[outcome.Market.Field]
+		if !known {
+			continue
+		}
+		if state.Suspended {
+			pairLog.Debug("Рынок приостановлен, исход не сравнивается", "source", source, "market", outcome.Market.Field, "outcome", outcome.Name())
+			delete(odds, outcome)
+			continue
+		}
+		if age := now.Sub(time.UnixMilli(state.LastChanged)); maxUnchanged > 0 && age > maxUnchanged {
+			pairLog.Debug("Цены рынка давно не менялись, исход не сравнивается", "source", source, "market", outcome.Market.Field, "outcome", outcome.Name(), "age", age.Round(time.Second))
+			delete(odds, outcome)
 		}
 	}
+}
 
-	// Нормализуем тоталы второго тайма
-	normalizedSansaTime2Totals := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnacleTime2Totals := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	for key, value := range sansabetOdds.Time2Totals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime2Totals[normalizedKey] = value
-	}
-	for key, value := range pinnacleOdds.Time2Totals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnacleTime2Totals[normalizedKey] = value
+// Удаление всех исходов рынков указанного типа
+func dropMarketType(odds map[MarketOutcome]float64, marketType string) {
+	for outcome := range odds {
+		if outcome.Market.Type == marketType {
+			delete(odds, outcome)
+		}
 	}
+}
 
-	for key, sansabetTotal := range normalizedSansaTime2Totals {
-		if pinnacleTotal, exists := normalizedPinnacleTime2Totals[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Time2 Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Time2 Totals More: %s", key)
-			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Time2 Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Time2 Totals Less: %s", key)
-			}
-		}
+// Цены исходов из сообщения парсера для истории. Для Pinnacle
+// добавляются и выведенные рынки (deriveEquivalentOutcomes), чтобы
+// сигналы движения были у всех исходов, которые сравниваются с Sansabet.
+// Разбор идёт до передачи владельцу состояния.
+func historyPrices(source, data string) map[MarketOutcome]float64 {
+	odds, err := parseMarketOutcomes(data)
+	if err != nil {
+		logIngest.Error("Ошибка разбора цен для истории", "source", source, "error", err)
+		return nil
+	}
+	if source == "Pinnacle" {
+		var parsed map[string]interface{}
+		json.Unmarshal([]byte(data), &parsed)
+		homeScore, _ := parsed["HomeScore"].(float64)
+		awayScore, _ := parsed["AwayScore"].(float64)
+		deriveEquivalentOutcomes(odds, int(homeScore), int(awayScore))
 	}
+	return odds
+}
 
-	// Нормализуем индивидуальные тоталы второго тайма первой команды
-	normalizedSansaTime2FirstTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnacleTime2FirstTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	for key, value := range sansabetOdds.Time2FirstTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime2FirstTeam[normalizedKey] = value
+// Запись цен исходов матча в историю
+func (st *analyzerState) recordPrices(source, key string, odds map[MarketOutcome]float64, at time.Time) {
+	rings, exists := st.priceHistory[source][key]
+	if !exists {
+		rings = make(map[MarketOutcome]*PriceRing)
+		st.priceHistory[source][key] = rings
 	}
-	for key, value := range pinnacleOdds.Time2FirstTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnacleTime2FirstTeam[normalizedKey] = value
+	for outcome, price := range odds {
+		ring, exists := rings[outcome]
+		if !exists {
+			ring = &PriceRing{}
+			rings[outcome] = ring
+		}
+		ring.push(price, at)
 	}
+}
 
-	for key, sansabetTotal := range normalizedSansaTime2FirstTeam {
-		if pinnacleTotal, exists := normalizedPinnacleTime2FirstTeam[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Time2 First Team Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Time2 First Team Totals More: %s", key)
-			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Time2 First Team Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Time2 First Team Totals Less: %s", key)
-			}
+// Сигналы движения линии для общих исходов пары
+func (st *analyzerState) movementSignals(keySansabet, keyPinnacle string, commonOutcomes map[MarketOutcome][2]float64, now time.Time) map[MarketOutcome]MovementSignals {
+	signals := make(map[MarketOutcome]MovementSignals, len(commonOutcomes))
+	for outcome := range commonOutcomes {
+		pinnacle := st.priceHistory["Pinnacle"][keyPinnacle][outcome]
+		sansabet := st.priceHistory["Sansabet"][keySansabet][outcome]
+
+		s := MovementSignals{
+			Pinnacle: pinnacle.movement(now),
+			Sansabet: sansabet.movement(now),
 		}
+		pinnacleAt, pinnacleMoved := pinnacle.lastMoveAt()
+		sansabetAt, sansabetMoved := sansabet.lastMoveAt()
+		pinnacleMoved = pinnacleMoved && now.Sub(pinnacleAt) <= movementWindow
+		sansabetMoved = sansabetMoved && now.Sub(sansabetAt) <= movementWindow
+
+		switch {
+		case pinnacleMoved && (!sansabetMoved || pinnacleAt.Before(sansabetAt)):
+			s.FirstMover = "Pinnacle"
+		case sansabetMoved:
+			s.FirstMover = "Sansabet"
+		}
+		s.SansabetLagging = pinnacleMoved && (!sansabetMoved || sansabetAt.Before(pinnacleAt))
+		signals[outcome] = s
 	}
+	return signals
+}
 
-	// Нормализуем индивидуальные тоталы второго тайма второй команды
-	normalizedSansaTime2SecondTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	normalizedPinnacleTime2SecondTeam := make(map[string]struct {
-		WinMore float64 `json:"WinMore"`
-		WinLess float64 `json:"WinLess"`
-	})
-	for key, value := range sansabetOdds.Time2SecondTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime2SecondTeam[normalizedKey] = value
+// Добавление цены; одинаковая с последней цена не записывается
+func (r *PriceRing) push(price float64, at time.Time) {
+	if last, ok := r.at(0); ok && last.Price == price {
+		return
 	}
-	for key, value := range pinnacleOdds.Time2SecondTeamTotals {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnacleTime2SecondTeam[normalizedKey] = value
+	r.points[r.next] = PricePoint{Price: price, At: at}
+	r.next = (r.next + 1) % priceHistorySize
+	if r.count < priceHistorySize {
+		r.count++
 	}
+}
 
-	for key, sansabetTotal := range normalizedSansaTime2SecondTeam {
-		if pinnacleTotal, exists := normalizedPinnacleTime2SecondTeam[key]; exists {
-			// Проверяем WinMore
-			if pinnacleTotal.WinMore >= 1.02 && pinnacleTotal.WinMore <= 35 {
-				common["Time2 Second Team Total More "+key] = [2]float64{sansabetTotal.WinMore, pinnacleTotal.WinMore}
-				log.Printf("[DEBUG] Найден общий исход Time2 Second Team Totals More: %s", key)
-			}
-			// Проверяем WinLess
-			if pinnacleTotal.WinLess >= 1.02 && pinnacleTotal.WinLess <= 35 {
-				common["Time2 Second Team Total Less "+key] = [2]float64{sansabetTotal.WinLess, pinnacleTotal.WinLess}
-				log.Printf("[DEBUG] Найден общий исход Time2 Second Team Totals Less: %s", key)
-			}
-		}
+// Точка, записанная back изменений назад (0 - последняя)
+func (r *PriceRing) at(back int) (PricePoint, bool) {
+	if r == nil || back >= r.count {
+		return PricePoint{}, false
 	}
+	return r.points[(r.next-1-back+priceHistorySize)%priceHistorySize], true
+}
 
-	// Нормализуем гандикапы второго тайма
-	normalizedSansaTime2Handicap := make(map[string]struct {
-		Win1 float64 `json:"Win1"`
-		Win2 float64 `json:"Win2"`
-	})
-	normalizedPinnacleTime2Handicap := make(map[string]struct {
-		Win1 float64 `json:"Win1"`
-		Win2 float64 `json:"Win2"`
-	})
-	for key, value := range sansabetOdds.Time2Handicap {
-		normalizedKey := normalizeTotal(key)
-		normalizedSansaTime2Handicap[normalizedKey] = value
+// Время последнего изменения цены
+func (r *PriceRing) lastMoveAt() (time.Time, bool) {
+	if _, ok := r.at(1); !ok {
+		return time.Time{}, false
+	}
+	last, _ := r.at(0)
+	return last.At, true
+}
+
+// Сводка движения цены для фронтенда
+func (r *PriceRing) movement(now time.Time) BookMovement {
+	m := BookMovement{LastMoveAgo: -1}
+	last, ok := r.at(0)
+	if !ok {
+		return m
 	}
-	for key, value := range pinnacleOdds.Time2Handicap {
-		normalizedKey := normalizeTotal(key)
-		normalizedPinnacleTime2Handicap[normalizedKey] = value
+	m.Price = last.Price
+	m.Moves = r.count - 1
+	if previous, ok := r.at(1); ok {
+		m.LastMoveAgo = now.Sub(last.At).Seconds()
+		m.LastMove = last.Price - previous.Price
 	}
+	return m
+}
 
-	for key, sansabetHandicap := range normalizedSansaTime2Handicap {
-		if pinnacleHandicap, exists := normalizedPinnacleTime2Handicap[key]; exists {
-			// Проверяем Win1
-			if pinnacleHandicap.Win1 >= 1.02 && pinnacleHandicap.Win1 <= 35 {
-				common["Time2 Handicap Win1 "+key] = [2]float64{sansabetHandicap.Win1, pinnacleHandicap.Win1}
-				log.Printf("[DEBUG] Найден общий исход Time2 Handicap Win1: %s", key)
-			}
-			// Проверяем Win2
-			if pinnacleHandicap.Win2 >= 1.02 && pinnacleHandicap.Win2 <= 35 {
-				common["Time2 Handicap Win2 "+key] = [2]float64{sansabetHandicap.Win2, pinnacleHandicap.Win2}
-				log.Printf("[DEBUG] Найден общий исход Time2 Handicap Win2: %s", key)
-			}
+// Поиск общих исходов: один и тот же рынок, линия и сторона у обоих
+// букмекеров при допустимой цене Pinnacle
+func findCommonOutcomes(sansabetOdds, pinnacleOdds map[MarketOutcome]float64) map[MarketOutcome][2]float64 {
+	common := make(map[MarketOutcome][2]float64)
+
+	for outcome, sansabetValue := range sansabetOdds {
+		if pinnacleValue, exists := pinnacleOdds[outcome]; exists && pinnacleValue >= 1.02 && pinnacleValue <= 35 {
+			common[outcome] = [2]float64{sansabetValue, pinnacleValue}
 		}
 	}
 
-	//log.Printf("[DEBUG] Общие исходы: %+v", common)
 	return common
 }
 
-// Главная функция
 func main() {
+	var err error
+	if config, err = loadConfig(); err != nil {
+		log.Fatalf("Ошибка загрузки настроек: %v", err)
+	}
+	if err := setupLogging(config.Logging); err != nil {
+		log.Fatalf("Ошибка настройки журнала: %v", err)
+	}
+
 	initDB()
 	startAnalyzer()
 	select {}
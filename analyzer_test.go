@@ -0,0 +1,1002 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Запуск: go test -race analyzer.go analyzer_test.go
+
+func TestMain(m *testing.M) {
+	// Журналы нужны всем функциям анализатора; в тестах пишем только ошибки
+	if err := setupLogging(LoggingConfig{Level: "error", Format: "text"}); err != nil {
+		panic(err)
+	}
+	go state.run()
+	os.Exit(m.Run())
+}
+
+// Хранилище SQLite во временном каталоге с применёнными миграциями
+func newTestRepository(t testing.TB) *SQLTeamRepository {
+	t.Helper()
+	repo, err := NewSQLiteTeamRepository(filepath.Join(t.TempDir(), "teams.db"))
+	if err != nil {
+		t.Fatalf("открытие SQLite: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	if err := repo.Migrate(); err != nil {
+		t.Fatalf("миграции: %v", err)
+	}
+	return repo
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	repo := newTestRepository(t)
+	if err := repo.Migrate(); err != nil {
+		t.Fatalf("повторный Migrate: %v", err)
+	}
+	version, err := repo.currentSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, _ := loadMigrations("sqlite")
+	if want := migrations[len(migrations)-1].Version; version != want {
+		t.Fatalf("версия схемы %d, ожидалась %d", version, want)
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	repo := newTestRepository(t)
+	broken := Migration{Version: 9999, Name: "broken", SQL: `
+        CREATE TABLE half_applied (id INTEGER);
+        INSERT INTO sports (name) VALUES ('Rollback');
+        INSERT INTO no_such_table VALUES (1);`}
+
+	if err := repo.applyMigration(broken); err == nil {
+		t.Fatal("ожидалась ошибка миграции")
+	}
+
+	var tables, sports, versions int
+	repo.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_applied'").Scan(&tables)
+	repo.db.QueryRow("SELECT COUNT(*) FROM sports WHERE name = 'Rollback'").Scan(&sports)
+	repo.db.QueryRow("SELECT COUNT(*) FROM schema_version WHERE version = 9999").Scan(&versions)
+	if tables != 0 || sports != 0 || versions != 0 {
+		t.Fatalf("миграция применена частично: таблица %d, данные %d, версия %d", tables, sports, versions)
+	}
+
+	fixed := broken
+	fixed.SQL = "CREATE TABLE half_applied (id INTEGER)"
+	if err := repo.applyMigration(fixed); err != nil {
+		t.Fatalf("повторный запуск исправленной миграции: %v", err)
+	}
+}
+
+// Связанные команды одного матча: Rotor и Spartak в лигах обоих источников
+func seedLinkedTeams(t testing.TB, repo *SQLTeamRepository) {
+	t.Helper()
+	for _, team := range []string{"Rotor", "Spartak"} {
+		pinnacleId, err := repo.InsertTeam("Pinnacle", team, "Russia - Premier League", "Soccer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.InsertTeam("Sansabet", team, "Rusija 1", "Soccer"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.LinkTeam(team, pinnacleId); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Кэш команд поверх тестового хранилища
+func useTestRepository(t testing.TB, repo *SQLTeamRepository) {
+	t.Helper()
+	teamRepo = repo
+	if err := teamCache.load(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Те же проверки команд, что делает сообщение Sansabet, запросами к базе
+// (как до появления кэша): наличие обеих команд и связанная команда
+// Pinnacle через алиас
+func lookupTeamsInDB(repo *SQLTeamRepository, home, away, league, sport string) error {
+	for _, team := range []string{home, away} {
+		var exists bool
+		err := repo.db.QueryRow(`
+            SELECT EXISTS(
+                SELECT 1 FROM sansabet_teams st
+                JOIN sansabet_leagues sl ON st.league_id = sl.id
+                JOIN sports s ON st.sport_id = s.id
+                WHERE st.name = ? AND sl.name = ? AND s.name = ?
+            )`, team, league, sport).Scan(&exists)
+		if err != nil {
+			return err
+		}
+
+		var pinnacleTeam string
+		err = repo.db.QueryRow(`
+            SELECT pa.name
+            FROM team_aliases sa
+            JOIN sports s ON sa.sport_id = s.id
+            JOIN team_aliases pa ON pa.canonical_team_id = sa.canonical_team_id AND pa.source = 'Pinnacle'
+            WHERE sa.source = 'Sansabet' AND sa.name = ? AND s.name = ?
+            ORDER BY pa.id LIMIT 1`, team, sport).Scan(&pinnacleTeam)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Те же проверки через кэш
+func lookupTeamsInCache(home, away, league, sport string) error {
+	for _, team := range []string{home, away} {
+		if !teamExists("Sansabet", team, league, sport) {
+			return sql.ErrNoRows
+		}
+		if _, err := getLinkedPinnacleTeam(team, sport); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkTeamLookups(b *testing.B) {
+	repo := newTestRepository(b)
+	seedLinkedTeams(b, repo)
+	useTestRepository(b, repo)
+
+	b.Run("cache", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := lookupTeamsInCache("Rotor", "Spartak", "Rusija 1", "Soccer"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("sqlite", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := lookupTeamsInDB(repo, "Rotor", "Spartak", "Rusija 1", "Soccer"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Сообщение Sansabet для матча связанных команд
+const testSansabetMessage = `{"Source":"Sansabet","HandicapConvention":"from_kickoff_home_line","MatchName":"Rotor : Spartak","LeagueName":"Rusija 1","MatchId":"222",
+"Win1x2":{"Win1":1.65,"WinNone":3.8,"Win2":6},
+"Totals":{"2.5":{"WinMore":2.05,"WinLess":1.75},"2.25":{"WinMore":1.9,"WinLess":1.8}},
+"Handicap":{"-0.5":{"Win1":1.65,"Win2":0}}}`
+
+// Полная обработка сообщения парсера, когда команды уже есть в кэше:
+// в базу не ходим, сравнение с запросами к базе - в BenchmarkTeamLookups
+func BenchmarkSaveMatchData(b *testing.B) {
+	repo := newTestRepository(b)
+	seedLinkedTeams(b, repo)
+	useTestRepository(b, repo)
+	msg := []byte(testSansabetMessage)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		saveMatchData("Sansabet", msg)
+	}
+}
+
+func TestFoldGeneralCI(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"Málaga", "Malaga", true},
+		{"MÁLAGA", "malaga", true},
+		{"Atlético Madrid", "ATLETICO MADRID", true},
+		{"Beşiktaş", "Besiktas", true},
+		{"Fortuna Düsseldorf", "Fortuna Dusseldorf", true},
+		{"Straße", "Strase", true},
+		{"Rotor ", "Rotor", true},
+		{"Spartak", "Spartak Moscow", false},
+		{"Ajax", "Ajax II", false},
+	}
+	for _, test := range tests {
+		if got := foldGeneralCI(test.a) == foldGeneralCI(test.b); got != test.equal {
+			t.Errorf("%q и %q: равны %v, ожидалось %v", test.a, test.b, got, test.equal)
+		}
+	}
+}
+
+// Кэш должен считать одинаковыми ровно те названия, что и уникальный индекс
+// базы: иначе промах кэша приводит к повторной вставке, а ложное попадание -
+// к команде, которой нет в базе
+func TestTeamCacheMatchesDatabaseCollation(t *testing.T) {
+	repo := newTestRepository(t)
+	useTestRepository(t, repo)
+
+	const league, sport = "Primera", "Soccer"
+	if _, err := repo.InsertTeam("Sansabet", "Málaga", league, sport); err != nil {
+		t.Fatal(err)
+	}
+	teamCache.addTeam("Sansabet", "Málaga", league, sport, 0)
+
+	for _, name := range []string{"MáLAGA", "málaga", "Malaga", "MÁLAGA", "Malaga B"} {
+		cached := teamCache.hasTeam("Sansabet", name, league, sport)
+		_, err := repo.InsertTeam("Sansabet", name, league, sport)
+		if inDB := err != nil; cached != inDB {
+			t.Errorf("%q: в кэше %v, в базе %v (%v)", name, cached, inDB, err)
+		}
+		if err == nil {
+			teamCache.addTeam("Sansabet", name, league, sport, 0)
+		}
+	}
+}
+
+func TestSuggestLeagueMatches(t *testing.T) {
+	stat := func(sansabetId, pinnacleId, linked int) LeagueLinkStat {
+		return LeagueLinkStat{
+			SansabetLeagueId: sansabetId,
+			SansabetLeague:   fmt.Sprintf("S%d", sansabetId),
+			PinnacleLeagueId: pinnacleId,
+			PinnacleLeague:   fmt.Sprintf("P%d", pinnacleId),
+			LinkedTeams:      linked,
+		}
+	}
+	type pair struct{ sansabet, pinnacle int }
+
+	tests := []struct {
+		name        string
+		stats       []LeagueLinkStat
+		existing    []LeagueMatch
+		suggested   []pair
+		conflicted  []pair
+		conflictNum int
+	}{
+		{
+			name:      "три связанные команды",
+			stats:     []LeagueLinkStat{stat(1, 10, 3)},
+			suggested: []pair{{1, 10}},
+		},
+		{
+			name:  "меньше порога",
+			stats: []LeagueLinkStat{stat(1, 10, 2)},
+		},
+		{
+			name:     "пара уже есть",
+			stats:    []LeagueLinkStat{stat(1, 10, 5)},
+			existing: []LeagueMatch{{PinnacleLeagueId: 10, SansabetLeagueId: 1}},
+		},
+		{
+			name:      "одна команда из кубка не конфликт",
+			stats:     []LeagueLinkStat{stat(1, 10, 4), stat(1, 20, 1), stat(2, 10, 1)},
+			suggested: []pair{{1, 10}},
+		},
+		{
+			name:        "лига Sansabet разошлась по двум лигам Pinnacle",
+			stats:       []LeagueLinkStat{stat(1, 10, 4), stat(1, 20, 3)},
+			conflicted:  []pair{{1, 10}, {1, 20}},
+			conflictNum: 1,
+		},
+		{
+			name:        "две лиги Sansabet в одной лиге Pinnacle",
+			stats:       []LeagueLinkStat{stat(1, 10, 3), stat(2, 10, 3), stat(3, 30, 3)},
+			suggested:   []pair{{3, 30}},
+			conflicted:  []pair{{1, 10}, {2, 10}},
+			conflictNum: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := suggestLeagueMatches(test.stats, test.existing, 3)
+			suggested := map[pair]bool{}
+			conflicted := map[pair]bool{}
+			for _, suggestion := range result.Suggestions {
+				p := pair{suggestion.SansabetLeagueId, suggestion.PinnacleLeagueId}
+				if suggestion.Conflicted {
+					conflicted[p] = true
+				} else {
+					suggested[p] = true
+				}
+			}
+			if len(suggested) != len(test.suggested) || len(conflicted) != len(test.conflicted) {
+				t.Fatalf("предложения %v, конфликтные %v; ожидались %v и %v", suggested, conflicted, test.suggested, test.conflicted)
+			}
+			for _, p := range test.suggested {
+				if !suggested[p] {
+					t.Errorf("нет предложения %v", p)
+				}
+			}
+			for _, p := range test.conflicted {
+				if !conflicted[p] {
+					t.Errorf("пара %v не отмечена конфликтной", p)
+				}
+			}
+			if len(result.Conflicts) != test.conflictNum {
+				t.Errorf("конфликтов %d, ожидалось %d", len(result.Conflicts), test.conflictNum)
+			}
+		})
+	}
+}
+
+// Одинаковые названия в разных видах спорта - разные команды: связь
+// футбольного клуба не должна находиться для баскетбольного
+func TestAliasesAreKeyedBySport(t *testing.T) {
+	repo := newTestRepository(t)
+	useTestRepository(t, repo)
+
+	pinnacleId, err := repo.InsertTeam("Pinnacle", "Partizan", "Serbia - Super Liga", "Soccer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sport := range []string{"Soccer", "Basketball"} {
+		if _, err := repo.InsertTeam("Sansabet", "Partizan", "Srbija 1", sport); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := teamCache.load(); err != nil {
+		t.Fatal(err)
+	}
+	pinnacleTeam, err := getPinnacleTeam("Partizan", "Serbia - Super Liga", "Soccer")
+	if err != nil || pinnacleTeam.Id != pinnacleId {
+		t.Fatalf("команда Pinnacle: %+v, %v", pinnacleTeam, err)
+	}
+	if err := updateTeamPinnacleId("Partizan", pinnacleTeam); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fromDB := range []bool{false, true} {
+		if fromDB {
+			if err := teamCache.load(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if name, err := getLinkedPinnacleTeam("Partizan", "Soccer"); err != nil || name != "Partizan" {
+			t.Errorf("футбол (из базы %v): %q, %v", fromDB, name, err)
+		}
+		if name, err := getLinkedPinnacleTeam("Partizan", "Basketball"); err == nil {
+			t.Errorf("баскетбол (из базы %v) связан с %q", fromDB, name)
+		}
+	}
+}
+
+// Недостающая команда связывается с командой Pinnacle из лиги найденного
+// матча Pinnacle, а не с первой командой с таким названием
+func TestMissingTeamLinksToTeamOfPinnacleMatch(t *testing.T) {
+	repo := newTestRepository(t)
+	useTestRepository(t, repo)
+
+	insert := func(source, team, league, sport string) int {
+		id, err := repo.InsertTeam(source, team, league, sport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		teamCache.addTeam(source, team, league, sport, id)
+		return id
+	}
+	insert("Pinnacle", "Dynamo", "Russia - VTB League", "Basketball")
+	soccerDynamo := insert("Pinnacle", "Dynamo", "Russia - Premier League", "Soccer")
+	spartak := insert("Pinnacle", "Spartak", "Russia - Premier League", "Soccer")
+	insert("Sansabet", "Dinamo", "Rusija 1", "Soccer")
+	insert("Sansabet", "Spartak", "Rusija 1", "Soccer")
+	if err := updateTeamPinnacleId("Spartak", StoredTeam{Id: spartak, Name: "Spartak", Sport: "Soccer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pinnacleKey := generateMatchKey("Dynamo", "Spartak")
+	state.do(func(st *analyzerState) {
+		st.matchData["Pinnacle"][pinnacleKey] = &MatchData{
+			Data:       `{"MatchId":"111","MatchName":"Dynamo vs Spartak","LeagueName":"Russia - Premier League"}`,
+			LastUpdate: time.Now(),
+		}
+	})
+	t.Cleanup(func() {
+		state.do(func(st *analyzerState) { st.removeMatch("Pinnacle", pinnacleKey) })
+	})
+
+	// Связывание идёт вне владельца состояния, пара создаётся внутри
+	parsedMsg := &ParsedMessage{
+		MatchId: "333", MatchName: "Dinamo : Spartak", Home: "Dinamo", Away: "Spartak",
+		LeagueName: "Rusija 1", Sport: "Soccer",
+	}
+	home, away := resolvePinnacleTeams(parsedMsg)
+	if home != "Dynamo" || away != "Spartak" {
+		t.Fatalf("команды Pinnacle: %q, %q", home, away)
+	}
+	var pairs int
+	state.do(func(st *analyzerState) {
+		st.updateMatchPairs(parsedMsg, home, away)
+		for _, pair := range st.matchPairs {
+			// Ключ пары - ID событий и дата создания
+			if pair.Key == "333|111|"+pair.CreatedAt.Format("2006-01-02") {
+				pairs++
+			}
+		}
+	})
+	if pairs != 1 {
+		t.Fatalf("пар %d, ожидалась 1", pairs)
+	}
+	var linkedId int
+	repo.db.QueryRow("SELECT pinnacle_team_id FROM sansabet_teams WHERE name = 'Dinamo'").Scan(&linkedId)
+	if linkedId != soccerDynamo {
+		t.Errorf("Dinamo связан с командой Pinnacle %d, ожидалась %d", linkedId, soccerDynamo)
+	}
+	if name, err := getLinkedPinnacleTeam("Dinamo", "Soccer"); err != nil || name != "Dynamo" {
+		t.Errorf("связанная команда: %q, %v", name, err)
+	}
+}
+
+// Ошибка на середине связывания не оставляет в базе части связи
+func TestLinkTeamIsAtomic(t *testing.T) {
+	repo := newTestRepository(t)
+
+	pinnacleId, err := repo.InsertTeam("Pinnacle", "Rotor", "Russia - Cup", "Soccer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.InsertTeam("Sansabet", "Rotor", "Rusija Kup", "Soccer"); err != nil {
+		t.Fatal(err)
+	}
+	// Запись алиаса Sansabet падает после того, как связь и каноническая команда уже записаны
+	if _, err := repo.db.Exec(`
+        CREATE TRIGGER fail_sansabet_alias BEFORE INSERT ON team_aliases
+        WHEN NEW.source = 'Sansabet'
+        BEGIN SELECT RAISE(ABORT, 'alias failure'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.LinkTeam("Rotor", pinnacleId); err == nil {
+		t.Fatal("ожидалась ошибка связывания")
+	}
+
+	var linked, canonical, aliases int
+	repo.db.QueryRow("SELECT COUNT(*) FROM sansabet_teams WHERE pinnacle_team_id IS NOT NULL").Scan(&linked)
+	repo.db.QueryRow("SELECT COUNT(*) FROM canonical_teams").Scan(&canonical)
+	repo.db.QueryRow("SELECT COUNT(*) FROM team_aliases").Scan(&aliases)
+	if linked != 0 || canonical != 0 || aliases != 0 {
+		t.Fatalf("связь записана частично: связей %d, канонических команд %d, алиасов %d", linked, canonical, aliases)
+	}
+
+	repo.db.Exec("DROP TRIGGER fail_sansabet_alias")
+	if _, err := repo.LinkTeam("Rotor", pinnacleId); err != nil {
+		t.Fatalf("повторное связывание: %v", err)
+	}
+	// Повторная связь с той же командой не ошибка
+	if _, err := repo.LinkTeam("Rotor", pinnacleId); err != nil {
+		t.Fatalf("связывание существующей связи: %v", err)
+	}
+}
+
+// Маржа считается по полному рынку Pinnacle, даже если у Sansabet есть
+// только часть исходов; без полного рынка - errMarginUnavailable
+func TestCalculateMARGIN(t *testing.T) {
+	tests := []struct {
+		name     string
+		sansabet string
+		pinnacle string
+		margin   float64
+		err      error
+	}{
+		{
+			name:     "1x2 полный рынок",
+			sansabet: `{"Win1x2":{"Win1":1.65}}`,
+			pinnacle: `{"Win1x2":{"Win1":1.6,"WinNone":3.9,"Win2":6.5}}`,
+			margin:   1/1.6 + 1/3.9 + 1/6.5,
+		},
+		{
+			name:     "тотал, у Sansabet только больше",
+			sansabet: `{"Totals":{"2.5":{"WinMore":2.05}}}`,
+			pinnacle: `{"Totals":{"2.50":{"WinMore":1.95,"WinLess":1.9},"3.00":{"WinMore":2.6,"WinLess":1.5}}}`,
+			margin:   1/1.95 + 1/1.9,
+		},
+		{
+			name:     "тотал, у Sansabet только меньше",
+			sansabet: `{"Totals":{"2.5":{"WinLess":1.75}}}`,
+			pinnacle: `{"Totals":{"2.5":{"WinMore":1.95,"WinLess":1.9}}}`,
+			margin:   1/1.95 + 1/1.9,
+		},
+		{
+			name:     "фора",
+			sansabet: `{"Handicap":{"-0.5":{"Win1":1.65,"Win2":0}}}`,
+			pinnacle: `{"Handicap":{"-0.5":{"Win1":1.6,"Win2":2.4},"0.5":{"Win1":1.17,"Win2":5.6}}}`,
+			margin:   1/1.6 + 1/2.4,
+		},
+		{
+			name:     "четвертная фора",
+			sansabet: `{"Handicap":{"-0.25":{"Win2":2.1}}}`,
+			pinnacle: `{"Handicap":{"-0.25":{"Win1":1.8,"Win2":2.05},"-0.5":{"Win1":2.0,"Win2":1.85}}}`,
+			margin:   1/1.8 + 1/2.05,
+		},
+		{
+			name:     "1x2 без ничьей у Pinnacle",
+			sansabet: `{"Win1x2":{"Win1":1.65}}`,
+			pinnacle: `{"Win1x2":{"Win1":1.6,"Win2":6.5}}`,
+			err:      errMarginUnavailable,
+		},
+		{
+			name:     "тотал без второй стороны у Pinnacle",
+			sansabet: `{"Totals":{"2.5":{"WinMore":2.05}}}`,
+			pinnacle: `{"Totals":{"2.5":{"WinMore":1.95},"3":{"WinLess":1.5}}}`,
+			err:      errMarginUnavailable,
+		},
+		{
+			name:     "фора с закрытой стороной у Pinnacle",
+			sansabet: `{"Handicap":{"-0.25":{"Win1":1.85}}}`,
+			pinnacle: `{"Handicap":{"-0.25":{"Win1":1.8,"Win2":1}}}`,
+			err:      errMarginUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sansabetOdds, err := parseMarketOutcomes(test.sansabet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pinnacleOdds, err := parseMarketOutcomes(test.pinnacle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			common := findCommonOutcomes(sansabetOdds, pinnacleOdds)
+			if len(common) != 1 {
+				t.Fatalf("общих исходов %d, ожидался 1: %v", len(common), common)
+			}
+
+			for outcome := range common {
+				margin, err := calculateMARGIN(outcome, pinnacleOdds)
+				if test.err != nil {
+					if err != test.err {
+						t.Fatalf("%s: ошибка %v, ожидалась %v (маржа %v)", outcome.Name(), err, test.err, margin)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", outcome.Name(), err)
+				}
+				if math.Abs(margin-test.margin) > 1e-9 {
+					t.Errorf("%s: маржа %.6f, ожидалась %.6f", outcome.Name(), margin, test.margin)
+				}
+			}
+		})
+	}
+}
+
+// Справедливая вероятность первой стороны двусторонней линии
+func fairFirst(first, second float64) float64 {
+	return (1 / first) / (1/first + 1/second)
+}
+
+func TestExpectedRefund(t *testing.T) {
+	// Линии форы Pinnacle (фора хозяев): -1.5, -0.5, 0.5, 1.5
+	pinnacle := `{"Handicap":{"-1.5":{"Win1":3.2,"Win2":1.35},"-0.5":{"Win1":1.9,"Win2":1.95},"0.5":{"Win1":1.3,"Win2":3.5},"1.5":{"Win1":1.1,"Win2":6.5}},
+"Totals":{"1.5":{"WinMore":1.3,"WinLess":3.4},"2.5":{"WinMore":1.95,"WinLess":1.9}}}`
+	// Вероятность итога ровно на целой линии - разность соседних половинных
+	pushAt0 := fairFirst(1.3, 3.5) - fairFirst(1.9, 1.95)
+	pushAtMinus1 := fairFirst(1.9, 1.95) - fairFirst(3.2, 1.35)
+	pushAt1 := fairFirst(1.1, 6.5) - fairFirst(1.3, 3.5)
+	pushAt2Goals := fairFirst(1.3, 3.4) - fairFirst(1.95, 1.9)
+
+	handicap := findMarketSpec("", MarketTypeHandicap, "")
+	totals := findMarketSpec("", MarketTypeTotal, "")
+	tests := []struct {
+		name    string
+		outcome MarketOutcome
+		refund  float64
+	}{
+		{"целая 0", MarketOutcome{handicap, "0", "Win1"}, pushAt0},
+		{"целая 0, гости", MarketOutcome{handicap, "0", "Win2"}, pushAt0},
+		{"целая -1", MarketOutcome{handicap, "-1", "Win1"}, pushAtMinus1},
+		{"целая +1", MarketOutcome{handicap, "1", "Win2"}, pushAt1},
+		{"половинная -0.5", MarketOutcome{handicap, "-0.5", "Win1"}, 0},
+		{"половинная +0.5", MarketOutcome{handicap, "0.5", "Win2"}, 0},
+		{"четвертная -0.25", MarketOutcome{handicap, "-0.25", "Win1"}, pushAt0 / 2},
+		{"четвертная +0.25", MarketOutcome{handicap, "0.25", "Win1"}, pushAt0 / 2},
+		{"четвертная -0.75", MarketOutcome{handicap, "-0.75", "Win1"}, pushAtMinus1 / 2},
+		{"четвертная +0.75", MarketOutcome{handicap, "0.75", "Win2"}, pushAt1 / 2},
+		{"целый тотал 2", MarketOutcome{totals, "2", "More"}, pushAt2Goals},
+		{"четвертный тотал 2.25", MarketOutcome{totals, "2.25", "Less"}, pushAt2Goals / 2},
+		{"ставка без ничьей - фора 0", MarketOutcome{findMarketSpec("", MarketTypeDrawNoBet, ""), "", "Win2"}, pushAt0},
+		{"нет соседних линий", MarketOutcome{handicap, "2", "Win1"}, 0},
+		{"нет соседних линий, четвертная", MarketOutcome{handicap, "-1.75", "Win1"}, 0},
+	}
+
+	pinnacleOdds, err := parseMarketOutcomes(pinnacle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			refund := expectedRefund(test.outcome, pinnacleOdds)
+			if math.Abs(refund-test.refund) > 1e-9 {
+				t.Errorf("%s: возврат %.6f, ожидался %.6f", test.outcome.Name(), refund, test.refund)
+			}
+		})
+	}
+}
+
+// ROI с возвратом - ROI без возврата, умноженный на (1 - ExpectedRefund)
+func TestCalculateROIWithRefund(t *testing.T) {
+	tests := []struct {
+		name     string
+		sansabet float64
+		fair     float64
+		refund   float64
+	}{
+		{"без возврата", 2.1, 1.95, 0},
+		{"четвертная линия", 2.1, 1.95, 0.06},
+		{"целая линия", 1.8, 1.7, 0.25},
+		{"отрицательный ROI", 1.6, 1.75, 0.12},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := calculateROI(test.sansabet, 1.9, test.fair, DevigMultiplicative, 0)
+			withRefund := calculateROI(test.sansabet, 1.9, test.fair, DevigMultiplicative, test.refund)
+			if withRefund.ExpectedRefund != test.refund || withRefund.Edge != base.Edge {
+				t.Fatalf("составляющие: возврат %v, edge %v (без возврата %v)", withRefund.ExpectedRefund, withRefund.Edge, base.Edge)
+			}
+			if want := base.ROI * (1 - test.refund); math.Abs(withRefund.ROI-want) > 1e-9 {
+				t.Errorf("ROI %.6f, ожидался %.6f", withRefund.ROI, want)
+			}
+		})
+	}
+}
+
+// Эталонные вероятности посчитаны отдельной реализацией каждого способа.
+// Для двух исходов способ Шина совпадает с аддитивным.
+func TestDevigMethods(t *testing.T) {
+	tests := []struct {
+		name     string
+		odds     []float64
+		expected map[string][]float64
+	}{
+		{
+			name: "2 исхода",
+			odds: []float64{1.9, 2.0},
+			expected: map[string][]float64{
+				DevigMultiplicative: {0.512821, 0.487179},
+				DevigAdditive:       {0.513158, 0.486842},
+				DevigPower:          {0.513320, 0.486680},
+				DevigShin:           {0.513158, 0.486842},
+				DevigOddsRatio:      {0.513167, 0.486833},
+			},
+		},
+		{
+			name: "3 исхода",
+			odds: []float64{2.5, 3.4, 3.0},
+			expected: map[string][]float64{
+				DevigMultiplicative: {0.389313, 0.286260, 0.324427},
+				DevigAdditive:       {0.390850, 0.284967, 0.324183},
+				DevigPower:          {0.390773, 0.285092, 0.324135},
+				DevigShin:           {0.390458, 0.285297, 0.324244},
+				DevigOddsRatio:      {0.390142, 0.285627, 0.324231},
+			},
+		},
+		{
+			name: "3 исхода с явным фаворитом",
+			odds: []float64{1.25, 6.0, 11.0},
+			expected: map[string][]float64{
+				DevigMultiplicative: {0.756447, 0.157593, 0.085960},
+				DevigAdditive:       {0.780808, 0.147475, 0.071717},
+				DevigPower:          {0.784325, 0.142181, 0.073495},
+				DevigShin:           {0.774548, 0.149826, 0.075626},
+				DevigOddsRatio:      {0.774436, 0.146515, 0.079048},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for method, expected := range test.expected {
+			t.Run(test.name+"/"+method, func(t *testing.T) {
+				probabilities := devigMethods[method](test.odds)
+				if len(probabilities) != len(expected) {
+					t.Fatalf("вероятности %v", probabilities)
+				}
+				sum := 0.0
+				for i, p := range probabilities {
+					sum += p
+					if math.Abs(p-expected[i]) > 1e-6 {
+						t.Errorf("вероятность %d: %.6f, ожидалась %.6f", i, p, expected[i])
+					}
+				}
+				if math.Abs(sum-1) > 1e-9 {
+					t.Errorf("сумма вероятностей %.12f", sum)
+				}
+			})
+		}
+	}
+}
+
+// Способ рынка из devig.markets, остальные рынки - devig.default. Если
+// способ неприменим (аддитивный дал отрицательную вероятность), цена
+// считается пропорциональным снятием.
+func TestDevigMethodFor(t *testing.T) {
+	// Настройки меняются внутри владельца состояния: он читает их при
+	// пересчёте пар
+	var saved DevigConfig
+	state.do(func(*analyzerState) {
+		saved = config.Devig
+		config.Devig = DevigConfig{Default: DevigAdditive, Markets: map[string]string{MarketTypeTotal: DevigShin}}
+	})
+	defer state.do(func(*analyzerState) { config.Devig = saved })
+
+	for marketType, want := range map[string]string{
+		MarketTypeTotal:     DevigShin,
+		MarketType1x2:       DevigAdditive,
+		MarketTypeHandicap:  DevigAdditive,
+		MarketTypeDrawNoBet: DevigAdditive,
+	} {
+		if method := devigMethodFor(marketType); method != want {
+			t.Errorf("%s: способ %q, ожидался %q", marketType, method, want)
+		}
+	}
+
+	pinnacleOdds, err := parseMarketOutcomes(`{"Win1x2":{"Win1":1.2,"WinNone":4,"Win2":60}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcome := MarketOutcome{Market: findMarketSpec("", MarketType1x2, ""), Side: "Win2"}
+	fair, method, err := fairOdds(outcome, pinnacleOdds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 1 / devigMultiplicative([]float64{1.2, 4, 60})[2]
+	if method != DevigMultiplicative || math.Abs(fair-want) > 1e-9 {
+		t.Errorf("цена %.4f способом %q, ожидалась %.4f пропорциональным", fair, method, want)
+	}
+}
+
+// Сообщение Pinnacle для того же матча, что testSansabetMessage
+const testPinnacleMessage = `{"Source":"Pinnacle","HandicapConvention":"from_kickoff_home_line","MatchName":"Rotor vs Spartak","LeagueName":"Russia - Premier League","MatchId":"111","HomeScore":1,"AwayScore":0,
+"Win1x2":{"Win1":1.6,"WinNone":3.9,"Win2":6.5},
+"Totals":{"2.50":{"WinMore":1.95,"WinLess":1.9},"2.25":{"WinMore":1.8,"WinLess":2.05}},
+"Handicap":{"-0.5":{"Win1":1.6,"Win2":2.4}}}`
+
+// Очереди парсеров и таймер отправки запускаются один раз на все тесты
+var (
+	startIngestOnce sync.Once
+	testIngest      *parserIngest
+)
+
+func startTestIngest() *parserIngest {
+	startIngestOnce.Do(func() {
+		testIngest = newParserIngest("Sansabet", "Pinnacle")
+		testIngest.start()
+		go frontendTickLoop(testIngest)
+	})
+	return testIngest
+}
+
+func dialTestServer(t *testing.T, server *httptest.Server, path, token string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, header)
+	if err != nil {
+		t.Fatalf("подключение к %s: %v", path, err)
+	}
+	return conn
+}
+
+// Настройки доступа на время теста
+func useTestAuth(t *testing.T, auth AuthConfig) {
+	t.Helper()
+	saved := config.Auth
+	config.Auth = auth
+	t.Cleanup(func() { config.Auth = saved })
+}
+
+// Оба парсера и несколько клиентов фронтенда работают одновременно, как в
+// проде. Смысл теста - прогон под -race: состояние меняется только через
+// владельца, связывание команд и запись в базу идут вне его.
+func TestConcurrentParsersAndFrontend(t *testing.T) {
+	repo := newTestRepository(t)
+	seedLinkedTeams(t, repo)
+	// Rotor, Spartak и Zenit связаны, Dinamo свяжется по матчу Pinnacle во
+	// время теста
+	zenit, err := repo.InsertTeam("Pinnacle", "Zenit", "Russia - Premier League", "Soccer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.InsertTeam("Sansabet", "Zenit", "Rusija 1", "Soccer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.LinkTeam("Zenit", zenit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.InsertTeam("Pinnacle", "Dynamo", "Russia - Premier League", "Soccer"); err != nil {
+		t.Fatal(err)
+	}
+	useTestRepository(t, repo)
+	ingest := startTestIngest()
+	useTestAuth(t, AuthConfig{
+		ParserTokens: map[string]string{"Sansabet": "sansabet-token", "Pinnacle": "pinnacle-token"},
+		APIKeys:      []string{"frontend-key"},
+	})
+
+	parsers := map[string]*httptest.Server{}
+	for _, source := range []string{"Sansabet", "Pinnacle"} {
+		parsers[source] = httptest.NewServer(parserHandler(source, ingest.queues[source]))
+		defer parsers[source].Close()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/output", requireAPIKey(frontendHandler))
+	mux.HandleFunc("/admin/pairs", requireAPIKey(pairsHandler))
+	mux.HandleFunc("/admin/clients", requireAPIKey(clientsHandler))
+	mux.HandleFunc("/admin/ingest", requireAPIKey(ingestHandler(ingest)))
+	frontend := httptest.NewServer(mux)
+	defer frontend.Close()
+
+	messages := map[string][]string{
+		"Pinnacle": {testPinnacleMessage, strings.NewReplacer("Rotor", "Dynamo", "Spartak", "Zenit", `"111"`, `"112"`).Replace(testPinnacleMessage)},
+		"Sansabet": {testSansabetMessage, strings.NewReplacer("Rotor", "Dinamo", "Spartak", "Zenit", `"222"`, `"223"`).Replace(testSansabetMessage)},
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for source, sourceMessages := range messages {
+		for i := 0; i < 3; i++ {
+			conn := dialTestServer(t, parsers[source], "/", config.Auth.ParserTokens[source])
+			wg.Add(1)
+			go func(conn *websocket.Conn, sourceMessages []string) {
+				defer wg.Done()
+				defer conn.Close()
+				for n := 0; ; n++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(sourceMessages[n%len(sourceMessages)])); err != nil {
+						t.Errorf("отправка сообщения парсера: %v", err)
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}(conn, sourceMessages)
+		}
+	}
+
+	// Запросы к /admin идут параллельно с подключениями
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, path := range []string{"/admin/pairs", "/admin/clients", "/admin/ingest"} {
+				request, _ := http.NewRequest(http.MethodGet, frontend.URL+path, nil)
+				request.Header.Set("Authorization", "Bearer frontend-key")
+				if resp, err := http.DefaultClient.Do(request); err == nil {
+					resp.Body.Close()
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	found := make(chan string, 4)
+	var clients sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		conn := dialTestServer(t, frontend, "/output", "frontend-key")
+		clients.Add(1)
+		go func(conn *websocket.Conn) {
+			defer clients.Done()
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				var message FrontendMessage
+				if err := json.Unmarshal(msg, &message); err != nil {
+					t.Errorf("сообщение фронтенду: %v", err)
+					return
+				}
+				if message.Type == "snapshot" && strings.Contains(string(msg), "Dinamo") && strings.Contains(string(msg), "Rotor") {
+					found <- message.Type
+					return
+				}
+				// Каждый ответ - повод запросить новый снимок
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"resync"}`)); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+	clients.Wait()
+	close(stop)
+	wg.Wait()
+
+	if len(found) != 4 {
+		t.Fatalf("снимок с обоими матчами получили %d клиентов из 4", len(found))
+	}
+	if name, err := getLinkedPinnacleTeam("Dinamo", "Soccer"); err != nil || name != "Dynamo" {
+		t.Errorf("связанная команда Dinamo: %q, %v", name, err)
+	}
+}
+
+// Без токенов и ключей доступ закрыт, пока не задан auth.insecure
+func TestAccessFailsClosed(t *testing.T) {
+	useTestAuth(t, AuthConfig{})
+	parser := httptest.NewServer(parserHandler("Sansabet", newIngestQueue("Sansabet")))
+	defer parser.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/logging", requireAPIKey(loggingHandler))
+	mux.HandleFunc("/output", requireAPIKey(frontendHandler))
+	admin := httptest.NewServer(mux)
+	defer admin.Close()
+
+	parserURL := "ws" + strings.TrimPrefix(parser.URL, "http")
+	outputURL := "ws" + strings.TrimPrefix(admin.URL, "http") + "/output"
+	if _, resp, err := websocket.DefaultDialer.Dial(parserURL, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("парсер без настроенного токена подключился: %v", err)
+	}
+	post := func() int {
+		resp, err := http.Post(admin.URL+"/admin/logging", "application/json", strings.NewReader(`{"level": "error"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(); code != http.StatusForbidden {
+		t.Errorf("изменяющий запрос без ключей: %d, ожидался 403", code)
+	}
+	// Чтение тоже закрыто: поток коэффициентов и /admin без ключей недоступны
+	if _, resp, err := websocket.DefaultDialer.Dial(outputURL, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("/output без настроенных ключей подключился: %v", err)
+	}
+	resp, err := http.Get(admin.URL + "/admin/logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /admin/logging без настроенных ключей: %d, ожидался 403", resp.StatusCode)
+	}
+
+	// Ключ в адресе обычного запроса не принимается, только в заголовке
+	config.Auth.APIKeys = []string{"frontend-key"}
+	resp, err = http.Get(admin.URL + "/admin/logging?token=frontend-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("ключ в ?token= обычного запроса: %d, ожидался 401", resp.StatusCode)
+	}
+	// При подключении WebSocket ключ в адресе принимается
+	conn, _, err := websocket.DefaultDialer.Dial(outputURL+"?token=frontend-key", nil)
+	if err != nil {
+		t.Fatalf("/output с ключом в ?token=: %v", err)
+	}
+	conn.Close()
+
+	config.Auth = AuthConfig{Insecure: true}
+	if code := post(); code != http.StatusOK {
+		t.Errorf("изменяющий запрос при auth.insecure: %d, ожидался 200", code)
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(parserURL, nil)
+	if err != nil {
+		t.Fatalf("парсер при auth.insecure: %v", err)
+	}
+	conn.Close()
+	conn, _, err = websocket.DefaultDialer.Dial(outputURL, nil)
+	if err != nil {
+		t.Fatalf("/output при auth.insecure: %v", err)
+	}
+	conn.Close()
+}
@@ -2,18 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Константы для Pinnacle API
@@ -32,11 +39,43 @@ const (
 
 // Структура для исходов
 type Outcome struct {
-	Outcome  string  `json:"Outcome"`
-	Pinnacle float64 `json:"Pinnacle"`
-	ROI      float64 `json:"ROI"`
-	MARGIN   float64 `json:"MARGIN"`
-	Sansabet float64 `json:"Sansabet"`
+	Outcome        string          `json:"Outcome"`
+	Pinnacle       float64         `json:"Pinnacle"`
+	ROI            float64         `json:"ROI"`
+	MARGIN         float64         `json:"MARGIN"`
+	Sansabet       float64         `json:"Sansabet"`
+	FairOdds       float64         `json:"FairOdds"`
+	DevigMethod    string          `json:"DevigMethod"`
+	ExpectedRefund float64         `json:"ExpectedRefund"`
+	ROIBreakdown   *ROIBreakdown   `json:"ROIBreakdown,omitempty"` // Составляющие ROI от анализатора
+	Movement       json.RawMessage `json:"Movement,omitempty"`     // Сигналы движения линии от анализатора
+	MaxStake       float64         `json:"MaxStake"`               // Максимальная ставка Pinnacle, 0 - неизвестна
+}
+
+// Составляющие расчета ROI (см. ROIBreakdown в analyzer.go)
+type ROIBreakdown struct {
+	Formula        string            `json:"Formula"`
+	Sansabet       float64           `json:"Sansabet"`
+	Pinnacle       float64           `json:"Pinnacle"`
+	FairOdds       float64           `json:"FairOdds"`
+	DevigMethod    string            `json:"DevigMethod"`
+	ExtraPercent   float64           `json:"ExtraPercent"`
+	ExtraBand      *ExtraPercentBand `json:"ExtraBand"`
+	FixedCosts     float64           `json:"FixedCosts"`
+	Scale          float64           `json:"Scale"`
+	ExpectedRefund float64           `json:"ExpectedRefund"`
+	Edge           float64           `json:"Edge"`
+	ROI            float64           `json:"ROI"`
+	MaxStake       float64           `json:"MaxStake"`
+	Confidence     float64           `json:"Confidence"`
+	WeightedROI    float64           `json:"WeightedROI"`
+}
+
+// Диапазон коэффициента Pinnacle и надбавка для него
+type ExtraPercentBand struct {
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	ExtraPercent float64 `json:"extraPercent"`
 }
 
 // Структура для данных матча
@@ -99,8 +138,9 @@ var (
 	calculatorData *RequestData = nil
 	clients                     = make(map[*websocket.Conn]bool) // Подключенные клиенты
 	upgrader                    = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true }, // Разрешаем все запросы
+		CheckOrigin: originAllowed, // Только страницы из CALCULATOR_ALLOWED_ORIGINS
 	}
+	accessConfig                = loadAccessConfig()
 	logFile                     = "calculator_log.txt"
 	pinnacleAPI    *PinnacleAPI // Для работы с Pinnacle API
 	pinnacleStatus = PinnacleStatus{
@@ -113,16 +153,289 @@ var (
 	betHistoryFile = "bet_history.json"
 )
 
-// Middleware для добавления CORS-заголовков
+// Метрики Prometheus, /metrics на порту 7500
+var (
+	metricBetsLogged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "calculator_bets_logged_total",
+		Help: "Записи в bets.log: attempt - попытка ставки, accepted - принятая ставка",
+	}, []string{"type"})
+	// 0 до первого ответа GetMatchOdds: недоступность Pinnacle при запуске
+	// не должна выглядеть как доступность
+	metricPinnacleAvailable = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "calculator_pinnacle_available",
+		Help: "1, если Pinnacle отдал коэффициенты текущего матча",
+	})
+	metricPinnacleDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "calculator_pinnacle_request_duration_seconds",
+		Help:    "Длительность запросов коэффициентов к Pinnacle",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5},
+	})
+	metricPinnacleErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "calculator_pinnacle_errors_total",
+		Help: "Ошибки запросов коэффициентов к Pinnacle",
+	})
+	metricWSClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "calculator_ws_clients",
+		Help: "Подключенные клиенты WebSocket",
+	})
+)
+
+// Обновление статуса Pinnacle и метрики доступности
+func setPinnacleStatus(available bool, errText string) {
+	pinnacleStatus.IsAvailable = available
+	pinnacleStatus.Error = errText
+	pinnacleStatus.LastUpdate = time.Now()
+	if available {
+		metricPinnacleAvailable.Set(1)
+	} else {
+		metricPinnacleAvailable.Set(0)
+	}
+}
+
+// Доступ к калькулятору из переменных окружения:
+// CALCULATOR_API_KEYS - ключи через запятую ("Authorization: Bearer <ключ>",
+// ?token= - только для /ws), CALCULATOR_ALLOWED_ORIGINS - страницы через
+// запятую, CALCULATOR_TLS_CERT и CALCULATOR_TLS_KEY - сертификат и ключ для
+// HTTPS. Без ключей отклоняются все маршруты, без списка страниц - все
+// запросы браузера с Origin; CALCULATOR_INSECURE=1 снимает оба запрета -
+// только для локальной разработки.
+type AccessConfig struct {
+	APIKeys        []string
+	AllowedOrigins []string
+	TLSCert        string
+	TLSKey         string
+	Insecure       bool
+}
+
+func splitList(value string) []string {
+	result := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func loadAccessConfig() AccessConfig {
+	return AccessConfig{
+		APIKeys:        splitList(os.Getenv("CALCULATOR_API_KEYS")),
+		AllowedOrigins: splitList(os.Getenv("CALCULATOR_ALLOWED_ORIGINS")),
+		TLSCert:        os.Getenv("CALCULATOR_TLS_CERT"),
+		TLSKey:         os.Getenv("CALCULATOR_TLS_KEY"),
+		Insecure:       os.Getenv("CALCULATOR_INSECURE") == "1" || os.Getenv("CALCULATOR_INSECURE") == "true",
+	}
+}
+
+// Origin браузера из CALCULATOR_ALLOWED_ORIGINS. Запросы без Origin идут
+// не из браузера и проверяются только ключом. Пустой список запрещает все
+// страницы.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(accessConfig.AllowedOrigins) == 0 {
+		return accessConfig.Insecure
+	}
+	for _, allowed := range accessConfig.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Ключ запроса: заголовок Authorization. Параметр token - только при
+// подключении WebSocket (браузерный WebSocket не умеет задавать заголовки),
+// в адресах обычных запросов ключ попадал бы в журналы.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// Без CALCULATOR_API_KEYS ключ не подходит никакой, если не задан
+// CALCULATOR_INSECURE
+func apiKeyAllowed(token string) bool {
+	if len(accessConfig.APIKeys) == 0 {
+		return accessConfig.Insecure
+	}
+	for _, key := range accessConfig.APIKeys {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Журнал: уровень LOG_LEVEL (debug, info, warn, error, по умолчанию info),
+// формат LOG_FORMAT (text или json) и уровни модулей LOG_MODULES
+// ("bets=debug,ws=warn"). Уровни меняются без перезапуска через
+// /admin/logging. Общие поля записей: module, match_id (Sansabet),
+// pinnacle_id, client.
+const (
+	logModuleMain     = "main"     // запуск
+	logModuleAuth     = "auth"     // доступ
+	logModuleBets     = "bets"     // расчет и история ставок
+	logModulePinnacle = "pinnacle" // запросы к API Pinnacle
+	logModuleWS       = "ws"       // клиенты WebSocket
+)
+
+var logModules = []string{logModuleMain, logModuleAuth, logModuleBets, logModulePinnacle, logModuleWS}
+
+// Текущие уровни модулей, меняются атомарно из /admin/logging
+var logLevels = func() map[string]*slog.LevelVar {
+	levels := make(map[string]*slog.LevelVar, len(logModules))
+	for _, module := range logModules {
+		levels[module] = new(slog.LevelVar)
+	}
+	return levels
+}()
+
+// Журналы модулей, создаются в setupLogging
+var (
+	logMain     *slog.Logger
+	logAuth     *slog.Logger
+	logBets     *slog.Logger
+	logPinnacle *slog.Logger
+	logWS       *slog.Logger
+)
+
+// Обработчик журнала модуля: пропускает записи не ниже уровня модуля
+type moduleHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h moduleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h moduleHandler) WithGroup(name string) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// Применение уровней: level (если задан) всем модулям, затем modules
+func applyLogLevels(level string, modules map[string]string) error {
+	levels := make(map[string]slog.Level)
+	if level != "" {
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("неизвестный уровень %q", level)
+		}
+		for _, module := range logModules {
+			levels[module] = parsed
+		}
+	}
+	for module, name := range modules {
+		if _, known := logLevels[module]; !known {
+			return fmt.Errorf("неизвестный модуль %q", module)
+		}
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("модуль %s: неизвестный уровень %q", module, name)
+		}
+		levels[module] = parsed
+	}
+	for module, parsed := range levels {
+		logLevels[module].Set(parsed)
+	}
+	return nil
+}
+
+// Журналы модулей по переменным окружения
+func setupLogging() {
+	modules := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv("LOG_MODULES"), ",") {
+		if module, level, ok := strings.Cut(strings.TrimSpace(item), "="); ok {
+			modules[module] = level
+		}
+	}
+	if err := applyLogLevels(os.Getenv("LOG_LEVEL"), modules); err != nil {
+		log.Fatalf("Ошибка настройки журнала: %v", err)
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug} // Уровень проверяет moduleHandler
+	var base slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if os.Getenv("LOG_FORMAT") == "json" {
+		base = slog.NewJSONHandler(os.Stderr, options)
+	}
+	moduleLogger := func(module string) *slog.Logger {
+		return slog.New(moduleHandler{Handler: base, level: logLevels[module]}).With("module", module)
+	}
+
+	logMain = moduleLogger(logModuleMain)
+	logAuth = moduleLogger(logModuleAuth)
+	logBets = moduleLogger(logModuleBets)
+	logPinnacle = moduleLogger(logModulePinnacle)
+	logWS = moduleLogger(logModuleWS)
+	slog.SetDefault(logMain)
+}
+
+// Уровни журнала: GET - текущие, POST {"level": "...", "modules": {...}} -
+// изменить без перезапуска
+func loggingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request struct {
+			Level   string            `json:"level"`
+			Modules map[string]string `json:"modules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := applyLogLevels(request.Level, request.Modules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logMain.Info("Уровни журнала изменены", "level", request.Level, "modules", request.Modules)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	modules := make(map[string]string, len(logLevels))
+	for module, level := range logLevels {
+		modules[module] = strings.ToLower(level.Level().String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"modules": modules})
+}
+
+// Middleware: CORS для разрешённых страниц и проверка ключа
 func enableCors(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*") // Разрешить все источники
+		if !originAllowed(r) {
+			logAuth.Warn("Запрос с неразрешённого Origin", "path", r.URL.Path, "origin", r.Header.Get("Origin"), "client", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
+		if !apiKeyAllowed(requestToken(r)) {
+			logAuth.Warn("Запрос без верного ключа", "path", r.URL.Path, "client", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 		next.ServeHTTP(w, r)
 	}
 }
@@ -152,12 +465,13 @@ func receiveHandler(w http.ResponseWriter, r *http.Request) {
 	var data RequestData
 	if err := decoder.Decode(&data); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		log.Printf("Ошибка декодирования JSON: %v", err)
+		logBets.Warn("Ошибка декодирования JSON", "path", r.URL.Path, "error", err)
 		return
 	}
 
 	calculatorData = &data // Сохраняем данные
-	log.Printf("Получены данные: %+v", calculatorData)
+	logBets.Info("Получен матч для расчета", "match_id", data.SansabetId, "pinnacle_id", data.PinnacleId,
+		"match_name", data.MatchName, "outcome", data.SelectedOutcome.Outcome)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -169,6 +483,8 @@ type CalculateBetRequest struct {
 	Edge    float64 `json:"edge"`
 	Risk    float64 `json:"risk"`
 	Bank    float64 `json:"bank"`
+	// Необязательный потолок ставки (максимальная ставка Pinnacle), 0 - без потолка
+	MaxStake float64 `json:"maxStake"`
 }
 
 // CalculateBetResponse структура для ответа с расчетом ставки
@@ -180,10 +496,7 @@ type CalculateBetResponse struct {
 
 // calculateBetHandler обработчик для расчета размера ставки
 func calculateBetHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("1. calculateBetHandler: запрос получен")
-
 	if r.Method != http.MethodPost {
-		log.Printf("2. Ошибка: неверный метод %s\n", r.Method)
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -191,31 +504,25 @@ func calculateBetHandler(w http.ResponseWriter, r *http.Request) {
 	// Читаем тело запроса для логирования
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("3. Ошибка чтения тела запроса: %v\n", err)
+		logBets.Warn("Ошибка чтения тела запроса", "path", r.URL.Path, "error", err)
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
 		return
 	}
-	log.Printf("4. Тело запроса: %s\n", string(body))
+	logBets.Debug("Запрос расчета ставки", "body", string(body))
 
 	// Создаем новый reader из сохраненного тела
 	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
 	var req CalculateBetRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("5. Ошибка декодирования JSON: %v\n", err)
+		logBets.Warn("Ошибка декодирования JSON", "path", r.URL.Path, "error", err)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("6. Параметры запроса: odds=%.2f edge=%.2f risk=%.2f bank=%.2f\n",
-		req.Odds, req.Edge, req.Risk, req.Bank)
-
 	// Рассчитываем размер ставки
-	originalAmount := getBetSize(req.Odds, req.Edge, req.Risk, req.Bank)
-	log.Printf("7. Рассчитан originalAmount: %.2f\n", originalAmount)
-
-	adjustedAmount := calculateAdjustedBetSize(req.MatchID, req.Odds, req.Edge, req.Risk, req.Bank)
-	log.Printf("8. Рассчитан adjustedAmount: %.2f\n", adjustedAmount)
+	originalAmount := getBetSize(req.Odds, req.Edge, req.Risk, req.Bank, req.MaxStake)
+	adjustedAmount := calculateAdjustedBetSize(req.MatchID, req.Odds, req.Edge, req.Risk, req.Bank, req.MaxStake)
 
 	// Рассчитываем процент оставшейся суммы
 	percentage := 100.0
@@ -229,23 +536,22 @@ func calculateBetHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		percentage = 0
 	}
-	log.Printf("9. Рассчитан percentage: %.2f%%\n", percentage)
 
 	response := CalculateBetResponse{
 		OriginalAmount: originalAmount,
 		AdjustedAmount: adjustedAmount,
 		Percentage:     percentage,
 	}
-
-	log.Printf("10. Подготовлен ответ: %+v\n", response)
+	logBets.Info("Рассчитан размер ставки", "match_id", req.MatchID, "odds", req.Odds, "edge", req.Edge,
+		"risk", req.Risk, "bank", req.Bank, "max_stake", req.MaxStake,
+		"original_amount", originalAmount, "adjusted_amount", adjustedAmount, "percentage", percentage)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("11. Ошибка кодирования ответа: %v\n", err)
+		logBets.Error("Ошибка кодирования ответа", "match_id", req.MatchID, "error", err)
 		http.Error(w, "Error encoding response", http.StatusInternalServerError)
 		return
 	}
-	log.Println("12. Ответ успешно отправлен")
 }
 
 // Обработчик для получения ставки
@@ -266,7 +572,7 @@ func betHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Сохраняем историю ставок
 	if err := betHistory.saveBetHistory(); err != nil {
-		log.Printf("Ошибка сохранения истории ставок: %v", err)
+		logBets.Error("Ошибка сохранения истории ставок", "match_id", betData.MatchId, "error", err)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -274,15 +580,6 @@ func betHandler(w http.ResponseWriter, r *http.Request) {
 
 // Эндпоинт для логирования ставок
 func logBetHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
 	if r.Method != "POST" {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
@@ -320,6 +617,11 @@ func logBetHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	betType, _ := betData["type"].(string)
+	if betType != "attempt" && betType != "accepted" {
+		betType = "other"
+	}
+	metricBetsLogged.WithLabelValues(betType).Inc()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
@@ -336,16 +638,17 @@ func broadcastData() {
 
 		data, err := json.Marshal(calculatorData)
 		if err != nil {
-			log.Printf("Ошибка сериализации данных: %v", err)
+			logWS.Error("Ошибка сериализации данных", "match_id", calculatorData.SansabetId, "error", err)
 			continue
 		}
 
 		for client := range clients {
 			err := client.WriteMessage(websocket.TextMessage, data)
 			if err != nil {
-				log.Printf("Ошибка отправки данных клиенту: %v", err)
+				logWS.Warn("Ошибка отправки данных клиенту", "client", client.RemoteAddr().String(), "error", err)
 				client.Close()
 				delete(clients, client) // Удаляем клиента из списка
+				metricWSClients.Set(float64(len(clients)))
 			}
 		}
 	}
@@ -355,20 +658,22 @@ func broadcastData() {
 func wsHandler(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Ошибка подключения WebSocket: %v", err)
+		logWS.Error("Ошибка подключения WebSocket", "client", r.RemoteAddr, "error", err)
 		return
 	}
 
 	clients[conn] = true
-	log.Println("Новый клиент подключён")
+	metricWSClients.Set(float64(len(clients)))
+	logWS.Info("Новый клиент подключён", "client", conn.RemoteAddr().String())
 
 	// Поддерживаем соединение
 	for {
 		_, _, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Ошибка чтения сообщения: %v", err)
+			logWS.Info("Клиент отключен", "client", conn.RemoteAddr().String(), "error", err)
 			conn.Close()
 			delete(clients, conn)
+			metricWSClients.Set(float64(len(clients)))
 			break
 		}
 	}
@@ -381,7 +686,7 @@ func NewPinnacleAPI(username, password, proxy string) *PinnacleAPI {
 	if proxy != "" {
 		proxyURL, err := url.Parse(proxy)
 		if err != nil {
-			log.Printf("[ERROR] Неверный URL прокси: %v\n", err)
+			logPinnacle.Error("Неверный URL прокси", "error", err)
 		} else {
 			transport.Proxy = http.ProxyURL(proxyURL)
 		}
@@ -421,14 +726,18 @@ func (api *PinnacleAPI) query(urlStr string) (map[string]interface{}, error) {
 	}
 
 	req.SetBasicAuth(api.Username, api.Password)
+	start := time.Now()
 	resp, err := api.Client.Do(req)
+	metricPinnacleDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metricPinnacleErrors.Inc()
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var result map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		metricPinnacleErrors.Inc()
 		return nil, err
 	}
 
@@ -446,9 +755,7 @@ func (api *PinnacleAPI) GetMatchOdds(matchId string) (map[string]float64, bool,
 	// Выполнение запроса
 	result, err := api.query(urlStr)
 	if err != nil {
-		pinnacleStatus.IsAvailable = false
-		pinnacleStatus.Error = err.Error()
-		pinnacleStatus.LastUpdate = time.Now()
+		setPinnacleStatus(false, err.Error())
 		return nil, false, fmt.Errorf("failed to fetch odds: %v", err)
 	}
 
@@ -461,9 +768,7 @@ func (api *PinnacleAPI) GetMatchOdds(matchId string) (map[string]float64, bool,
 					// Проверяем статус
 					status, ok := event["status"].(string)
 					if !ok || status != "OPEN" {
-						pinnacleStatus.IsAvailable = false
-						pinnacleStatus.Error = "Match is not open"
-						pinnacleStatus.LastUpdate = time.Now()
+						setPinnacleStatus(false, "Match is not open")
 						return nil, false, nil
 					}
 
@@ -560,16 +865,12 @@ func (api *PinnacleAPI) GetMatchOdds(matchId string) (map[string]float64, bool,
 
 	// Проверяем, что получили хотя бы один коэффициент
 	if len(odds) == 0 {
-		pinnacleStatus.IsAvailable = false
-		pinnacleStatus.Error = "No odds available"
-		pinnacleStatus.LastUpdate = time.Now()
+		setPinnacleStatus(false, "No odds available")
 		return nil, false, nil
 	}
 
 	// Обновляем статус успешного получения данных
-	pinnacleStatus.IsAvailable = true
-	pinnacleStatus.Error = ""
-	pinnacleStatus.LastUpdate = time.Now()
+	setPinnacleStatus(true, "")
 
 	return odds, true, nil
 }
@@ -579,7 +880,7 @@ func updateMatchOdds() {
 	if calculatorData != nil && calculatorData.PinnacleId != "" {
 		odds, available, err := pinnacleAPI.GetMatchOdds(calculatorData.PinnacleId)
 		if err != nil {
-			fmt.Printf("Error updating odds: %v\n", err)
+			logPinnacle.Error("Ошибка обновления коэффициентов", "pinnacle_id", calculatorData.PinnacleId, "error", err)
 			return
 		}
 
@@ -693,53 +994,52 @@ func (s *BetHistoryStorage) getTotalBetAmount(matchID string) float64 {
 	return 0
 }
 
-// getBetSize рассчитывает оптимальный размер ставки на основе критерия Келли
-func getBetSize(odds float64, edge float64, risk float64, bank float64) float64 {
-	log.Printf("13. getBetSize начало расчета: odds=%.2f edge=%.2f risk=%.2f bank=%.2f\n",
-		odds, edge, risk, bank)
-
+// getBetSize рассчитывает оптимальный размер ставки на основе критерия Келли.
+// maxStake > 0 ограничивает ставку сверху (максимальная ставка Pinnacle).
+func getBetSize(odds float64, edge float64, risk float64, bank float64, maxStake float64) float64 {
 	if edge < 0 {
-		log.Println("14. edge < 0, возвращаем 0")
+		logBets.Debug("Отрицательный edge, ставка 0", "edge", edge)
 		return 0
 	}
 
 	// Преобразуем edge из процентов в десятичную дробь
 	edgeDecimal := edge / 100
-	log.Printf("15. edgeDecimal=%.4f\n", edgeDecimal)
 
 	// Рассчитываем фактор внутри логарифма
 	logFactor := 1 - (1 / (odds / (1 + edgeDecimal)))
-	log.Printf("16. logFactor=%.4f\n", logFactor)
 
 	// Рассчитываем процент от банкролла для ставки
 	betSizePercent := math.Log10(logFactor) / math.Log10(math.Pow(10, -risk))
-	log.Printf("17. betSizePercent=%.4f\n", betSizePercent)
 
 	// Проверяем, что результат имеет смысл
 	if betSizePercent < 0 || betSizePercent > 1 {
-		log.Printf("18. betSizePercent=%.4f вне диапазона [0,1], возвращаем 0\n", betSizePercent)
+		logBets.Debug("Доля банка вне диапазона [0,1], ставка 0", "odds", odds, "edge", edge, "risk", risk, "bet_size_percent", betSizePercent)
 		return 0
 	}
 
 	// Рассчитываем фактический размер ставки
 	betSize := betSizePercent * bank
-	log.Printf("19. betSize=%.2f\n", betSize)
 
 	// Округляем до ближайшего числа, кратного 5
 	roundedBetSize := math.Round(betSize/5) * 5
-	log.Printf("20. roundedBetSize=%.2f\n", roundedBetSize)
 
+	// Ставка не больше лимита: округляем лимит вниз до кратного 5
+	if maxStake > 0 && roundedBetSize > maxStake {
+		roundedBetSize = math.Floor(maxStake/5) * 5
+		logBets.Debug("Ставка ограничена maxStake", "max_stake", maxStake, "bet_size", roundedBetSize)
+	}
+
+	logBets.Debug("Размер ставки по Келли", "odds", odds, "edge", edge, "risk", risk, "bank", bank,
+		"log_factor", logFactor, "bet_size_percent", betSizePercent, "bet_size", roundedBetSize)
 	return roundedBetSize
 }
 
-func calculateAdjustedBetSize(matchID string, odds float64, edge float64, risk float64, bank float64) float64 {
+func calculateAdjustedBetSize(matchID string, odds float64, edge float64, risk float64, bank float64, maxStake float64) float64 {
 	// Получаем базовый размер ставки
-	baseBetSize := getBetSize(odds, edge, risk, bank)
-	log.Printf("Базовый размер ставки (baseBetSize): %.2f\n", baseBetSize)
+	baseBetSize := getBetSize(odds, edge, risk, bank, maxStake)
 
 	// Получаем процент уже поставленных денег на матч
 	totalBetAmount := betHistory.getTotalBetAmount(matchID)
-	log.Printf("Процент уже поставленных ставок (totalBetAmount): %.2f%%\n", totalBetAmount)
 
 	// Вычисляем оставшийся процент от базовой суммы ставки
 	remainingPercentage := 100.0
@@ -751,23 +1051,22 @@ func calculateAdjustedBetSize(matchID string, odds float64, edge float64, risk f
 			remainingPercentage = 100.0
 		}
 	}
-	log.Printf("Оставшийся процент (remainingPercentage): %.2f%%\n", remainingPercentage)
 
 	// Корректируем размер ставки
 	adjustedBetSize := baseBetSize * remainingPercentage / 100.0
-	log.Printf("Скорректированный размер ставки (adjustedBetSize): %.2f\n", adjustedBetSize)
 
 	// Округляем до ближайшего числа, кратного 5
 	adjustedBetSize = math.Round(adjustedBetSize/5) * 5
-	log.Printf("Округленный скорректированный размер ставки: %.2f\n", adjustedBetSize)
+	logBets.Debug("Ставка с учетом истории матча", "match_id", matchID, "base_bet_size", baseBetSize,
+		"total_bet_amount", totalBetAmount, "remaining_percentage", remainingPercentage, "bet_size", adjustedBetSize)
 
 	return adjustedBetSize
 }
 
 func main() {
 	// Настраиваем логирование
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	fmt.Println("Запуск сервера...")
+	setupLogging()
+	logMain.Info("Запуск сервера")
 
 	// Инициализируем историю ставок
 	betHistory = &BetHistoryStorage{
@@ -787,16 +1086,37 @@ func main() {
 	pinnacleAPI = NewPinnacleAPI(PINNACLE_USERNAME, PINNACLE_PASSWORD, PROXY)
 
 	// Настраиваем маршруты
-	http.HandleFunc("/ws", wsHandler)
+	http.HandleFunc("/ws", enableCors(wsHandler))
 	http.HandleFunc("/receive", enableCors(receiveHandler))
 	http.HandleFunc("/calculate_bet", enableCors(calculateBetHandler))
 	http.HandleFunc("/bet", enableCors(betHandler))
 	http.HandleFunc("/log_bet", enableCors(logBetHandler))
 	http.HandleFunc("/pinnacle_status", enableCors(pinnacleStatusHandler))
+	http.HandleFunc("/metrics", enableCors(promhttp.Handler().ServeHTTP))
+	http.HandleFunc("/admin/logging", enableCors(loggingHandler))
+
+	if accessConfig.Insecure {
+		logAuth.Warn("CALCULATOR_INSECURE: без CALCULATOR_API_KEYS и CALCULATOR_ALLOWED_ORIGINS калькулятор открыт для всех")
+	} else {
+		if len(accessConfig.APIKeys) == 0 {
+			logAuth.Error("CALCULATOR_API_KEYS не заданы: все запросы отклоняются (для разработки - CALCULATOR_INSECURE=1)")
+		}
+		if len(accessConfig.AllowedOrigins) == 0 {
+			logAuth.Error("CALCULATOR_ALLOWED_ORIGINS не заданы: запросы браузера отклоняются (для разработки - CALCULATOR_INSECURE=1)")
+		}
+	}
 
 	// Запускаем сервер
-	fmt.Println("Сервер запущен на порту 7500")
+	logMain.Info("Сервер запущен", "port", 7500, "tls", accessConfig.TLSCert != "")
+	if accessConfig.TLSCert != "" && accessConfig.TLSKey != "" {
+		if err := http.ListenAndServeTLS(":7500", accessConfig.TLSCert, accessConfig.TLSKey, nil); err != nil {
+			logMain.Error("Ошибка запуска сервера", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err := http.ListenAndServe(":7500", nil); err != nil {
-		log.Fatal("ListenAndServe:", err)
+		logMain.Error("Ошибка запуска сервера", "error", err)
+		os.Exit(1)
 	}
 }
@@ -1,7 +1,7 @@
 package main
 
 import (
-    "log"
+    "log/slog"
     "os"
     "os/exec"
     "path/filepath"
@@ -9,12 +9,20 @@ import (
 )
 
 func main() {
+    // Журнал в том же формате, что и у дочерних процессов (LOG_FORMAT=json).
+    // LOG_LEVEL, LOG_FORMAT и LOG_MODULES наследуют парсеры и калькулятор,
+    // анализатор берёт настройки из секции logging своего файла настроек.
+    if os.Getenv("LOG_FORMAT") == "json" {
+        slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+    }
+
     // Убедимся, что папка logs существует
     if err := os.MkdirAll("logs", 0755); err != nil {
-        log.Fatalf("Ошибка создания папки logs: %v", err)
+        slog.Error("Ошибка создания папки logs", "error", err)
+        os.Exit(1)
     }
 
-    log.Println("Запуск основного приложения")
+    slog.Info("Запуск основного приложения")
 
     // Запуск парсеров
     go startProcess("go run parse_sansabet.go", "Sansabet Parser")
@@ -39,16 +47,17 @@ func startProcess(command string, name string) {
         // Открываем файл логов
         logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
         if err != nil {
-            log.Fatalf("Ошибка создания файла логов для %s: %v", name, err)
+            slog.Error("Ошибка создания файла логов", "process", name, "error", err)
+            os.Exit(1)
         }
         defer logFile.Close()
 
-        log.Printf("Запуск процесса %s", name)
+        slog.Info("Запуск процесса", "process", name)
         cmd := exec.Command("sh", "-c", command) // Используем "sh -c", чтобы обрабатывать команды
         cmd.Stdout = logFile                    // Перенаправляем stdout в файл
         cmd.Stderr = logFile                    // Перенаправляем stderr в файл
         if err := cmd.Run(); err != nil {
-            log.Printf("%s завершился с ошибкой: %v. Перезапуск через 5 секунд.", name, err)
+            slog.Error("Процесс завершился с ошибкой, перезапуск через 5 секунд", "process", name, "error", err)
         }
         time.Sleep(5 * time.Second) // Перезапуск через 5 секунд
     }
@@ -40,7 +40,7 @@ class Matching {
 
     public function CreateLeagueMatch($pinnacleLeagueId, $sansabetLeagueId){
         $query = "
-            INSERT INTO league_matches (pinnacle_league_id, sansabet_league_id)
+            INSERT IGNORE INTO league_matches (pinnacle_league_id, sansabet_league_id)
             VALUES (:pinnacle_id, :sansabet_id)";
         $stmt = $this->Mysql->prepare($query);
         return $stmt->execute([
@@ -76,6 +76,12 @@ class Matching {
             FROM sansabet_teams st
             WHERE st.league_id = :league_id 
             AND st.pinnacle_team_id IS NULL
+            AND NOT EXISTS (
+                SELECT 1 FROM team_aliases ta
+                WHERE ta.source = 'Sansabet'
+                AND ta.sport_id = st.sport_id
+                AND ta.name = st.name
+            )
             ORDER BY st.name";
         $stmt = $this->Mysql->prepare($query);
         $stmt->execute([':league_id' => $sansabetLeagueId]);
@@ -98,16 +104,103 @@ class Matching {
         return $data;
     }
 
+    // Связь записывается как алиас канонической команды, поэтому действует
+    // во всех лигах, где встречается это написание команды Sansabet
     public function CreateTeamMatch($pinnacleTeamId, $sansabetTeamId){
-        $query = "
-            UPDATE sansabet_teams 
-            SET pinnacle_team_id = :pinnacle_id
-            WHERE id = :sansabet_id";
-        $stmt = $this->Mysql->prepare($query);
-        return $stmt->execute([
-            ':pinnacle_id' => $pinnacleTeamId,
-            ':sansabet_id' => $sansabetTeamId
+        $stmt = $this->Mysql->prepare("SELECT name, sport_id FROM pinnacle_teams WHERE id = :id");
+        $stmt->execute([':id' => $pinnacleTeamId]);
+        $pinnacleTeam = $stmt->fetch(PDO::FETCH_ASSOC);
+
+        $stmt = $this->Mysql->prepare("SELECT name, sport_id FROM sansabet_teams WHERE id = :id");
+        $stmt->execute([':id' => $sansabetTeamId]);
+        $sansabetTeam = $stmt->fetch(PDO::FETCH_ASSOC);
+
+        if (!$pinnacleTeam || !$sansabetTeam) {
+            return false;
+        }
+
+        $this->Mysql->beginTransaction();
+        try {
+            // Каноническая команда по написанию Pinnacle
+            $stmt = $this->Mysql->prepare("
+                SELECT canonical_team_id FROM team_aliases
+                WHERE source = 'Pinnacle' AND sport_id = :sport_id AND name = :name");
+            $stmt->execute([':sport_id' => $pinnacleTeam['sport_id'], ':name' => $pinnacleTeam['name']]);
+            $canonicalId = $stmt->fetchColumn();
+
+            if (!$canonicalId) {
+                $stmt = $this->Mysql->prepare("
+                    INSERT INTO canonical_teams (sport_id, name) VALUES (:sport_id, :name)
+                    ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)");
+                $stmt->execute([':sport_id' => $pinnacleTeam['sport_id'], ':name' => $pinnacleTeam['name']]);
+                $canonicalId = $this->Mysql->lastInsertId();
+                $this->SetAlias($canonicalId, $pinnacleTeam['sport_id'], 'Pinnacle', $pinnacleTeam['name']);
+            }
+
+            $this->SetAlias($canonicalId, $pinnacleTeam['sport_id'], 'Sansabet', $sansabetTeam['name']);
+
+            $stmt = $this->Mysql->prepare("
+                UPDATE sansabet_teams 
+                SET pinnacle_team_id = :pinnacle_id
+                WHERE name = :name AND sport_id = :sport_id");
+            $stmt->execute([
+                ':pinnacle_id' => $pinnacleTeamId,
+                ':name' => $sansabetTeam['name'],
+                ':sport_id' => $sansabetTeam['sport_id']
+            ]);
+
+            $this->Mysql->commit();
+        } catch (Exception $e) {
+            $this->Mysql->rollBack();
+            throw $e;
+        }
+
+        $this->NotifyAnalyzer();
+        return true;
+    }
+
+    private function SetAlias($canonicalId, $sportId, $source, $name){
+        $stmt = $this->Mysql->prepare("
+            INSERT INTO team_aliases (canonical_team_id, sport_id, source, name)
+            VALUES (:canonical_id, :sport_id, :source, :name)
+            ON DUPLICATE KEY UPDATE canonical_team_id = VALUES(canonical_team_id)");
+        $stmt->execute([
+            ':canonical_id' => $canonicalId,
+            ':sport_id' => $sportId,
+            ':source' => $source,
+            ':name' => $name
+        ]);
+    }
+
+    // Предложения пар лиг и конфликты, которые анализатор находит по связанным командам
+    public function GetLeagueSuggestions(){
+        $context = stream_context_create([
+            'http' => ['method' => 'GET', 'timeout' => 2, 'header' => $this->AnalyzerAuthHeader()]
         ]);
+        $response = @file_get_contents($this->AnalyzerURL() . '/admin/league_suggestions', false, $context);
+        if ($response === false) {
+            return null;
+        }
+        return json_decode($response, true);
+    }
+
+    // Анализатор держит связи команд в кэше - просим его перечитать базу
+    public function NotifyAnalyzer(){
+        $context = stream_context_create([
+            'http' => ['method' => 'POST', 'timeout' => 1, 'header' => $this->AnalyzerAuthHeader()]
+        ]);
+        @file_get_contents($this->AnalyzerURL() . '/admin/reload_teams', false, $context);
+    }
+
+    // Адрес /admin анализатора (ANALYZER_ADMIN_URL, https:// при TLS)
+    private function AnalyzerURL(){
+        return getenv('ANALYZER_ADMIN_URL') ?: 'http://localhost:7300';
+    }
+
+    // Ключ из auth.apiKeys анализатора (ANALYZER_API_KEY)
+    private function AnalyzerAuthHeader(){
+        $key = getenv('ANALYZER_API_KEY');
+        return $key ? "Authorization: Bearer $key\r\n" : '';
     }
 }
 
@@ -136,6 +229,7 @@ if (isset($_GET['create_team_pair'])) {
 // Получение данных
 $leagueData = $matching->GetAllLeagues();
 $leaguePairs = $matching->GetLeaguePairs();
+$leagueSuggestions = $mode === 'league' ? $matching->GetLeagueSuggestions() : null;
 
 // Получение команд только если выбрана пара лиг
 $teamData = [];
@@ -235,6 +329,16 @@ if (isset($_GET['league_pair']) && !empty($_GET['league_pair'])) {
             margin-bottom: 20px;
             color: #1976D2;
         }
+        .warning {
+            background: #FFF3E0;
+            padding: 10px;
+            border-radius: 4px;
+            margin-bottom: 20px;
+            color: #E65100;
+        }
+        .suggestions li {
+            margin-bottom: 6px;
+        }
     </style>
 </head>
 <body>
@@ -292,6 +396,42 @@ if (isset($_GET['league_pair']) && !empty($_GET['league_pair'])) {
                     </div>
                     <button type="submit">Создать пару лиг</button>
                 </form>
+
+                <?php if ($leagueSuggestions === null): ?>
+                    <div class="warning">Анализатор недоступен, предложения пар лиг не загружены.</div>
+                <?php else: ?>
+                    <?php if (!empty($leagueSuggestions['Suggestions'])): ?>
+                        <h3 class="header">Предложенные пары лиг (по связанным командам)</h3>
+                        <ul class="suggestions">
+                            <?php foreach ($leagueSuggestions['Suggestions'] as $suggestion): ?>
+                                <li>
+                                    <?php echo htmlspecialchars($suggestion['SansabetLeague'] . ' ↔ ' . $suggestion['PinnacleLeague']); ?>
+                                    (связанных команд: <?php echo (int)$suggestion['LinkedTeams']; ?>)
+                                    <?php if ($suggestion['Conflicted']): ?>- <strong>есть конфликт</strong><?php endif; ?>
+                                    <a href="?mode=league&create_league_pair=1&sansabet_league_id=<?php echo (int)$suggestion['SansabetLeagueId']; ?>&pinnacle_league_id=<?php echo (int)$suggestion['PinnacleLeagueId']; ?>">создать</a>
+                                </li>
+                            <?php endforeach; ?>
+                        </ul>
+                    <?php endif; ?>
+                    <?php if (!empty($leagueSuggestions['Conflicts'])): ?>
+                        <div class="warning">
+                            <strong>Конфликты:</strong> связанные команды одной лиги относятся к разным лигам другого источника.
+                            <ul>
+                                <?php foreach ($leagueSuggestions['Conflicts'] as $conflict): ?>
+                                    <li>
+                                        <?php
+                                        $parts = [];
+                                        foreach ($conflict['Candidates'] as $candidate) {
+                                            $parts[] = $candidate['SansabetLeague'] . ' ↔ ' . $candidate['PinnacleLeague'] . ' (' . (int)$candidate['LinkedTeams'] . ')';
+                                        }
+                                        echo htmlspecialchars(implode('; ', $parts));
+                                        ?>
+                                    </li>
+                                <?php endforeach; ?>
+                            </ul>
+                        </div>
+                    <?php endif; ?>
+                <?php endif; ?>
             </div>
         <?php else: ?>
             <div class="content">
@@ -1,9 +1,4 @@
--- Удаляем существующую базу данных если она есть
-DROP DATABASE IF EXISTS matchingTeams;
-
--- Создаем базу данных заново
-CREATE DATABASE matchingTeams;
-USE matchingTeams;
+-- Исходная схема базы сопоставления команд (то, что раньше создавал manualMatch.sql)
 
 -- Таблица видов спорта
 CREATE TABLE IF NOT EXISTS sports (
@@ -64,17 +59,13 @@ CREATE TABLE IF NOT EXISTS sansabet_teams (
     FOREIGN KEY (pinnacle_team_id) REFERENCES pinnacle_teams(id)
 ) ENGINE=InnoDB;
 
--- Создаем уникальные индексы
+-- Уникальные индексы
 CREATE UNIQUE INDEX sports_uniq ON sports(name);
 CREATE UNIQUE INDEX pinnacle_leagues_uniq ON pinnacle_leagues(sport_id, name);
 CREATE UNIQUE INDEX sansabet_leagues_uniq ON sansabet_leagues(sport_id, name);
 CREATE UNIQUE INDEX pinnacle_teams_uniq ON pinnacle_teams(sport_id, league_id, name);
 CREATE UNIQUE INDEX sansabet_teams_uniq ON sansabet_teams(sport_id, league_id, name);
 
--- Создаем дополнительные индексы для оптимизации
+-- Дополнительные индексы для оптимизации
 CREATE INDEX league_matches_pinnacle ON league_matches(pinnacle_league_id);
 CREATE INDEX league_matches_sansabet ON league_matches(sansabet_league_id);
-
--- Создаем пользователя и даем ему права
-CREATE USER IF NOT EXISTS 'matchingTeams'@'localhost' IDENTIFIED BY 'local_password';
-GRANT ALL ON matchingTeams.* TO 'matchingTeams'@'localhost';
@@ -0,0 +1,48 @@
+-- Исходная схема для SQLite (та же структура, что в 0001_initial_schema.sql)
+
+CREATE TABLE IF NOT EXISTS sports (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    name       TEXT NOT NULL COLLATE NOCASE
+);
+
+CREATE TABLE IF NOT EXISTS pinnacle_leagues (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    sport_id   INTEGER NOT NULL REFERENCES sports(id),
+    name       TEXT NOT NULL COLLATE NOCASE
+);
+
+CREATE TABLE IF NOT EXISTS sansabet_leagues (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    sport_id   INTEGER NOT NULL REFERENCES sports(id),
+    name       TEXT NOT NULL COLLATE NOCASE
+);
+
+CREATE TABLE IF NOT EXISTS league_matches (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    pinnacle_league_id  INTEGER NOT NULL REFERENCES pinnacle_leagues(id),
+    sansabet_league_id  INTEGER NOT NULL REFERENCES sansabet_leagues(id)
+);
+
+CREATE TABLE IF NOT EXISTS pinnacle_teams (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    sport_id   INTEGER NOT NULL REFERENCES sports(id),
+    league_id  INTEGER NOT NULL REFERENCES pinnacle_leagues(id),
+    name       TEXT NOT NULL COLLATE NOCASE
+);
+
+CREATE TABLE IF NOT EXISTS sansabet_teams (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    sport_id         INTEGER NOT NULL REFERENCES sports(id),
+    league_id        INTEGER NOT NULL REFERENCES sansabet_leagues(id),
+    name             TEXT NOT NULL COLLATE NOCASE,
+    pinnacle_team_id INTEGER REFERENCES pinnacle_teams(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS sports_uniq ON sports(name);
+CREATE UNIQUE INDEX IF NOT EXISTS pinnacle_leagues_uniq ON pinnacle_leagues(sport_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS sansabet_leagues_uniq ON sansabet_leagues(sport_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS pinnacle_teams_uniq ON pinnacle_teams(sport_id, league_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS sansabet_teams_uniq ON sansabet_teams(sport_id, league_id, name);
+
+CREATE INDEX IF NOT EXISTS league_matches_pinnacle ON league_matches(pinnacle_league_id);
+CREATE INDEX IF NOT EXISTS league_matches_sansabet ON league_matches(sansabet_league_id);
@@ -0,0 +1,58 @@
+-- Уникальность команды в пределах лиги: (league_id, name).
+-- Перед созданием индексов схлопываем дубликаты, сохраняя уже созданные связи.
+
+-- Переносим ссылки Sansabet с дубликатов Pinnacle на первую запись
+UPDATE sansabet_teams st
+JOIN pinnacle_teams dup ON st.pinnacle_team_id = dup.id
+JOIN (
+    SELECT league_id, name, MIN(id) AS keep_id
+    FROM pinnacle_teams
+    GROUP BY league_id, name
+    HAVING COUNT(*) > 1
+) k ON k.league_id = dup.league_id AND k.name = dup.name
+SET st.pinnacle_team_id = k.keep_id
+WHERE dup.id <> k.keep_id;
+
+-- Удаляем дубликаты Pinnacle
+DELETE dup FROM pinnacle_teams dup
+JOIN (
+    SELECT league_id, name, MIN(id) AS keep_id
+    FROM pinnacle_teams
+    GROUP BY league_id, name
+    HAVING COUNT(*) > 1
+) k ON k.league_id = dup.league_id AND k.name = dup.name
+WHERE dup.id <> k.keep_id;
+
+-- Если связь была только у дубликата Sansabet, переносим её на первую запись
+UPDATE sansabet_teams keep_row
+JOIN (
+    SELECT league_id, name, MIN(id) AS keep_id, MAX(pinnacle_team_id) AS pinnacle_team_id
+    FROM sansabet_teams
+    GROUP BY league_id, name
+    HAVING COUNT(*) > 1
+) k ON keep_row.id = k.keep_id
+SET keep_row.pinnacle_team_id = COALESCE(keep_row.pinnacle_team_id, k.pinnacle_team_id);
+
+-- Удаляем дубликаты Sansabet
+DELETE dup FROM sansabet_teams dup
+JOIN (
+    SELECT league_id, name, MIN(id) AS keep_id
+    FROM sansabet_teams
+    GROUP BY league_id, name
+    HAVING COUNT(*) > 1
+) k ON k.league_id = dup.league_id AND k.name = dup.name
+WHERE dup.id <> k.keep_id;
+
+CREATE UNIQUE INDEX pinnacle_teams_league_name_uniq ON pinnacle_teams(league_id, name);
+CREATE UNIQUE INDEX sansabet_teams_league_name_uniq ON sansabet_teams(league_id, name);
+
+-- InnoDB удалил неявный индекс внешнего ключа sport_id, когда появился
+-- *_teams_uniq (sport_id, league_id, name), и теперь внешний ключ держится
+-- только на нём. Без отдельного индекса по sport_id удаление старых индексов
+-- падает с ошибкой 1553.
+CREATE INDEX pinnacle_teams_sport_idx ON pinnacle_teams(sport_id);
+CREATE INDEX sansabet_teams_sport_idx ON sansabet_teams(sport_id);
+
+-- Старые индексы (sport_id, league_id, name) теперь избыточны
+DROP INDEX pinnacle_teams_uniq ON pinnacle_teams;
+DROP INDEX sansabet_teams_uniq ON sansabet_teams;
@@ -0,0 +1,35 @@
+-- Уникальность команды в пределах лиги для SQLite.
+-- Дубликаты схлопываем так же, как в MySQL-версии, сохраняя связи.
+
+UPDATE sansabet_teams
+SET pinnacle_team_id = (
+    SELECT MIN(keep.id)
+    FROM pinnacle_teams dup
+    JOIN pinnacle_teams keep ON keep.league_id = dup.league_id AND keep.name = dup.name
+    WHERE dup.id = sansabet_teams.pinnacle_team_id
+)
+WHERE pinnacle_team_id IS NOT NULL;
+
+DELETE FROM pinnacle_teams
+WHERE id NOT IN (SELECT MIN(id) FROM pinnacle_teams GROUP BY league_id, name);
+
+UPDATE sansabet_teams
+SET pinnacle_team_id = (
+    SELECT MAX(dup.pinnacle_team_id)
+    FROM sansabet_teams dup
+    WHERE dup.league_id = sansabet_teams.league_id AND dup.name = sansabet_teams.name
+)
+WHERE pinnacle_team_id IS NULL;
+
+DELETE FROM sansabet_teams
+WHERE id NOT IN (SELECT MIN(id) FROM sansabet_teams GROUP BY league_id, name);
+
+CREATE UNIQUE INDEX IF NOT EXISTS pinnacle_teams_league_name_uniq ON pinnacle_teams(league_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS sansabet_teams_league_name_uniq ON sansabet_teams(league_id, name);
+
+-- Индексы по sport_id, как в схеме MySQL
+CREATE INDEX IF NOT EXISTS pinnacle_teams_sport_idx ON pinnacle_teams(sport_id);
+CREATE INDEX IF NOT EXISTS sansabet_teams_sport_idx ON sansabet_teams(sport_id);
+
+DROP INDEX IF EXISTS pinnacle_teams_uniq;
+DROP INDEX IF EXISTS sansabet_teams_uniq;
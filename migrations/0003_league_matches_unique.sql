@@ -0,0 +1,15 @@
+-- Пара лиг хранится один раз; пары, созданные анализатором по связанным
+-- командам, помечаются auto_created = 1.
+
+DELETE dup FROM league_matches dup
+JOIN (
+    SELECT pinnacle_league_id, sansabet_league_id, MIN(id) AS keep_id
+    FROM league_matches
+    GROUP BY pinnacle_league_id, sansabet_league_id
+    HAVING COUNT(*) > 1
+) k ON k.pinnacle_league_id = dup.pinnacle_league_id AND k.sansabet_league_id = dup.sansabet_league_id
+WHERE dup.id <> k.keep_id;
+
+ALTER TABLE league_matches ADD COLUMN auto_created TINYINT(1) NOT NULL DEFAULT 0;
+
+CREATE UNIQUE INDEX league_matches_uniq ON league_matches(pinnacle_league_id, sansabet_league_id);
@@ -0,0 +1,9 @@
+-- Пара лиг хранится один раз; пары, созданные анализатором по связанным
+-- командам, помечаются auto_created = 1.
+
+DELETE FROM league_matches
+WHERE id NOT IN (SELECT MIN(id) FROM league_matches GROUP BY pinnacle_league_id, sansabet_league_id);
+
+ALTER TABLE league_matches ADD COLUMN auto_created INTEGER NOT NULL DEFAULT 0;
+
+CREATE UNIQUE INDEX IF NOT EXISTS league_matches_uniq ON league_matches(pinnacle_league_id, sansabet_league_id);
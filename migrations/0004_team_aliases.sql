@@ -0,0 +1,45 @@
+-- Канонические команды и их написания (алиасы) у обоих источников.
+-- Связь задаётся один раз для команды, а не для каждой лиги отдельно:
+-- все строки sansabet_teams с тем же названием находятся через алиас.
+
+CREATE TABLE IF NOT EXISTS canonical_teams (
+    id         BIGINT NOT NULL AUTO_INCREMENT,
+    sport_id   BIGINT NOT NULL,
+    name       VARCHAR(200) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (sport_id) REFERENCES sports(id)
+) ENGINE=InnoDB;
+
+CREATE TABLE IF NOT EXISTS team_aliases (
+    id                BIGINT NOT NULL AUTO_INCREMENT,
+    canonical_team_id BIGINT NOT NULL,
+    sport_id          BIGINT NOT NULL,
+    source            VARCHAR(20) NOT NULL,
+    name              VARCHAR(200) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (canonical_team_id) REFERENCES canonical_teams(id),
+    FOREIGN KEY (sport_id) REFERENCES sports(id)
+) ENGINE=InnoDB;
+
+CREATE UNIQUE INDEX canonical_teams_uniq ON canonical_teams(sport_id, name);
+CREATE UNIQUE INDEX team_aliases_uniq ON team_aliases(source, sport_id, name);
+CREATE INDEX team_aliases_canonical ON team_aliases(canonical_team_id);
+
+-- Переносим существующие связи: каноническая команда называется как в Pinnacle.
+-- INSERT IGNORE делает перенос повторяемым, если прошлый запуск прервался.
+INSERT IGNORE INTO canonical_teams (sport_id, name)
+SELECT DISTINCT pt.sport_id, pt.name
+FROM sansabet_teams st
+JOIN pinnacle_teams pt ON st.pinnacle_team_id = pt.id;
+
+INSERT IGNORE INTO team_aliases (canonical_team_id, sport_id, source, name)
+SELECT ct.id, ct.sport_id, 'Pinnacle', ct.name
+FROM canonical_teams ct;
+
+-- Если одно написание Sansabet было связано с разными командами, берём первую
+INSERT IGNORE INTO team_aliases (canonical_team_id, sport_id, source, name)
+SELECT MIN(ct.id), st.sport_id, 'Sansabet', st.name
+FROM sansabet_teams st
+JOIN pinnacle_teams pt ON st.pinnacle_team_id = pt.id
+JOIN canonical_teams ct ON ct.sport_id = pt.sport_id AND ct.name = pt.name
+GROUP BY st.sport_id, st.name;
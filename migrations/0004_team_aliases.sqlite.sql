@@ -0,0 +1,35 @@
+-- Канонические команды и алиасы для SQLite (то же, что в 0004_team_aliases.sql)
+
+CREATE TABLE IF NOT EXISTS canonical_teams (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    sport_id   INTEGER NOT NULL REFERENCES sports(id),
+    name       TEXT NOT NULL COLLATE NOCASE
+);
+
+CREATE TABLE IF NOT EXISTS team_aliases (
+    id                INTEGER PRIMARY KEY AUTOINCREMENT,
+    canonical_team_id INTEGER NOT NULL REFERENCES canonical_teams(id),
+    sport_id          INTEGER NOT NULL REFERENCES sports(id),
+    source            TEXT NOT NULL,
+    name              TEXT NOT NULL COLLATE NOCASE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS canonical_teams_uniq ON canonical_teams(sport_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS team_aliases_uniq ON team_aliases(source, sport_id, name);
+CREATE INDEX IF NOT EXISTS team_aliases_canonical ON team_aliases(canonical_team_id);
+
+INSERT INTO canonical_teams (sport_id, name)
+SELECT DISTINCT pt.sport_id, pt.name
+FROM sansabet_teams st
+JOIN pinnacle_teams pt ON st.pinnacle_team_id = pt.id;
+
+INSERT INTO team_aliases (canonical_team_id, sport_id, source, name)
+SELECT ct.id, ct.sport_id, 'Pinnacle', ct.name
+FROM canonical_teams ct;
+
+INSERT INTO team_aliases (canonical_team_id, sport_id, source, name)
+SELECT MIN(ct.id), st.sport_id, 'Sansabet', st.name
+FROM sansabet_teams st
+JOIN pinnacle_teams pt ON st.pinnacle_team_id = pt.id
+JOIN canonical_teams ct ON ct.sport_id = pt.sport_id AND ct.name = pt.name
+GROUP BY st.sport_id, st.name;
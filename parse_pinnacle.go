@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Константы конфигурации
@@ -24,6 +33,15 @@ const (
 	SINCE            = 0 // важный параметр, чтобы цены передавались актуальные
 )
 
+// Соглашение о линиях гандикапа, общее для обоих парсеров и анализатора:
+// линия считается от начала матча (с учётом уже забитых голов), ключ карты
+// Handicap - линия хозяев, Win1 - хозяева с этой линией, Win2 - гости с
+// противоположной. Обе стороны одной линии лежат в одной записи.
+const HandicapConvention = "from_kickoff_home_line"
+
+// Сколько хранить снимок рынков матча, пропавшего из фида
+const marketTrackTTL = 10 * time.Minute
+
 // Замените на ваши данные
 const (
 	PINNACLE_USERNAME = "AG1677099"
@@ -36,8 +54,221 @@ var (
 	analyzerConnection *websocket.Conn
 	matchesData        = make(map[int64]MatchData)
 	matchesDataMutex   sync.RWMutex
+
+	marketTracks      = make(map[string]*marketTrack) // MatchId -> последний снимок рынков
+	marketTracksMutex sync.Mutex
+)
+
+// Метрики Prometheus, /metrics на METRICS_ADDR (по умолчанию localhost:9102)
+var (
+	metricUpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "parser_upstream_request_duration_seconds",
+		Help:    "Длительность запросов к API букмекера",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+	}, []string{"source", "endpoint"})
+	metricUpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "parser_upstream_errors_total",
+		Help: "Ошибки запросов к API букмекера",
+	}, []string{"source", "endpoint"})
+	metricMessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "parser_messages_sent_total",
+		Help: "Сообщения, отправленные анализатору",
+	}, []string{"source"})
+	metricSendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "parser_send_errors_total",
+		Help: "Ошибки отправки сообщений анализатору",
+	}, []string{"source"})
+	metricLiveMatches = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "parser_live_matches",
+		Help: "Матчи в лайве по данным букмекера",
+	}, []string{"source"})
+)
+
+// Учет результата отправки сообщения анализатору
+func observeSend(err error) {
+	if err != nil {
+		metricSendErrors.WithLabelValues("Pinnacle").Inc()
+		return
+	}
+	metricMessagesSent.WithLabelValues("Pinnacle").Inc()
+}
+
+// HTTP-сервер метрик и уровней журнала парсера
+func serveMetrics() {
+	address := os.Getenv("METRICS_ADDR")
+	if address == "" {
+		address = "localhost:9102"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/admin/logging", requireAnalyzerToken(loggingHandler))
+	if os.Getenv("ANALYZER_TOKEN") == "" {
+		logMain.Warn("ANALYZER_TOKEN не задан: /admin/logging отклоняет все запросы")
+	}
+	logMain.Info("Служебный сервер запущен", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logMain.Error("Служебный сервер остановлен", "error", err)
+	}
+}
+
+// /admin/logging меняет уровни журнала, поэтому METRICS_ADDR, открытый не
+// только на localhost, не должен давать это любому: нужен тот же токен, что
+// и для подключения к анализатору ("Authorization: Bearer $ANALYZER_TOKEN").
+// Без ANALYZER_TOKEN запросы отклоняются.
+func requireAnalyzerToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ANALYZER_TOKEN")
+		header := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(header), []byte("Bearer "+token)) != 1 {
+			logMain.Warn("Запрос к /admin/logging без верного токена", "client", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Журнал: уровень LOG_LEVEL (debug, info, warn, error, по умолчанию info),
+// формат LOG_FORMAT (text или json) и уровни модулей LOG_MODULES
+// ("upstream=debug,analyzer=warn"). Уровни меняются без перезапуска через
+// /admin/logging. Общие поля записей: module, source, match_id.
+const (
+	logModuleMain     = "main"     // запуск и служебный HTTP-сервер
+	logModuleUpstream = "upstream" // запросы к API Pinnacle
+	logModuleAnalyzer = "analyzer" // подключение и отправка в анализатор
+)
+
+var logModules = []string{logModuleMain, logModuleUpstream, logModuleAnalyzer}
+
+// Текущие уровни модулей, меняются атомарно из /admin/logging
+var logLevels = func() map[string]*slog.LevelVar {
+	levels := make(map[string]*slog.LevelVar, len(logModules))
+	for _, module := range logModules {
+		levels[module] = new(slog.LevelVar)
+	}
+	return levels
+}()
+
+// Журналы модулей, создаются в setupLogging
+var (
+	logMain     *slog.Logger
+	logUpstream *slog.Logger
+	logAnalyzer *slog.Logger
 )
 
+// Обработчик журнала модуля: пропускает записи не ниже уровня модуля
+type moduleHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h moduleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h moduleHandler) WithGroup(name string) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// Применение уровней: level (если задан) всем модулям, затем modules
+func applyLogLevels(level string, modules map[string]string) error {
+	levels := make(map[string]slog.Level)
+	if level != "" {
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("неизвестный уровень %q", level)
+		}
+		for _, module := range logModules {
+			levels[module] = parsed
+		}
+	}
+	for module, name := range modules {
+		if _, known := logLevels[module]; !known {
+			return fmt.Errorf("неизвестный модуль %q", module)
+		}
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("модуль %s: неизвестный уровень %q", module, name)
+		}
+		levels[module] = parsed
+	}
+	for module, parsed := range levels {
+		logLevels[module].Set(parsed)
+	}
+	return nil
+}
+
+// Журналы модулей по переменным окружения
+func setupLogging() {
+	modules := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv("LOG_MODULES"), ",") {
+		if module, level, ok := strings.Cut(strings.TrimSpace(item), "="); ok {
+			modules[module] = level
+		}
+	}
+	if err := applyLogLevels(os.Getenv("LOG_LEVEL"), modules); err != nil {
+		log.Fatalf("Ошибка настройки журнала: %v", err)
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug} // Уровень проверяет moduleHandler
+	var base slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if os.Getenv("LOG_FORMAT") == "json" {
+		base = slog.NewJSONHandler(os.Stderr, options)
+	}
+	moduleLogger := func(module string) *slog.Logger {
+		return slog.New(moduleHandler{Handler: base, level: logLevels[module]}).With("module", module, "source", "Pinnacle")
+	}
+
+	logMain = moduleLogger(logModuleMain)
+	logUpstream = moduleLogger(logModuleUpstream)
+	logAnalyzer = moduleLogger(logModuleAnalyzer)
+	slog.SetDefault(logMain)
+}
+
+// Уровни журнала: GET - текущие, POST {"level": "...", "modules": {...}} -
+// изменить без перезапуска
+func loggingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request struct {
+			Level   string            `json:"level"`
+			Modules map[string]string `json:"modules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := applyLogLevels(request.Level, request.Modules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logMain.Info("Уровни журнала изменены", "level", request.Level, "modules", request.Modules)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	modules := make(map[string]string, len(logLevels))
+	for module, level := range logLevels {
+		modules[module] = strings.ToLower(level.Level().String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"modules": modules})
+}
+
+// Сообщение о матче, который закончился или пропал из фида
+type RemovedGame struct {
+	Source    string `json:"Source"`
+	MatchId   string `json:"MatchId"`
+	MatchName string `json:"MatchName"`
+	Removed   bool   `json:"Removed"`
+}
+
 type OneGame struct {
 	Source     string `json:"Source"`
 	Name       string `json:"Name"`
@@ -50,6 +281,8 @@ type OneGame struct {
 	MatchId    string `json:"MatchId"`
 	LeagueId   string `json:"LeagueId"`
 
+	HandicapConvention string `json:"HandicapConvention"`
+
 	Win1x2           Win1x2Struct           `json:"Win1x2"`
 	Totals           map[string]WinLessMore `json:"Totals"`
 	Handicap         map[string]WinHandicap `json:"Handicap"`
@@ -67,6 +300,24 @@ type OneGame struct {
 	Time2Handicap         map[string]WinHandicap `json:"Time2Handicap"`
 	Time2FirstTeamTotals  map[string]WinLessMore `json:"Time2FirstTeam"`
 	Time2SecondTeamTotals map[string]WinLessMore `json:"Time2SecondTeam"`
+
+	// В прямом фиде Pinnacle этих рынков нет: анализатор выводит ставку без
+	// ничьей и двойной шанс из гандикапов 0 и ±0.5, а "обе забьют" - из
+	// индивидуального тотала 0.5, если одна из команд уже забила
+	DoubleChance     DoubleChanceStruct     `json:"DoubleChance"`
+	DrawNoBet        DrawNoBetStruct        `json:"DrawNoBet"`
+	BothTeamsToScore BothTeamsToScoreStruct `json:"BothTeamsToScore"`
+
+	Markets map[string]MarketState `json:"Markets"` // Поле рынка -> состояние
+	Limits  map[string]float64     `json:"Limits"`  // Поле рынка -> максимальная ставка Pinnacle
+}
+
+// Состояние рынка для анализатора: когда цены рынка последний раз менялись
+// и приостановлен ли он. Парсер пересылает полный снимок матча на каждом
+// опросе, поэтому время изменения считается по самим ценам рынка.
+type MarketState struct {
+	LastChanged int64 `json:"LastChanged"` // Unix-время в миллисекундах
+	Suspended   bool  `json:"Suspended"`
 }
 
 type WinLessMore struct {
@@ -85,6 +336,22 @@ type Win1x2Struct struct {
 	Win2    float64 `json:"Win2"`
 }
 
+type DoubleChanceStruct struct {
+	Win1X float64 `json:"Win1X"`
+	Win12 float64 `json:"Win12"`
+	WinX2 float64 `json:"WinX2"`
+}
+
+type DrawNoBetStruct struct {
+	Win1 float64 `json:"Win1"`
+	Win2 float64 `json:"Win2"`
+}
+
+type BothTeamsToScoreStruct struct {
+	Yes float64 `json:"Yes"`
+	No  float64 `json:"No"`
+}
+
 type MatchData struct {
 	Home      string
 	Away      string
@@ -106,7 +373,7 @@ func NewPinnacleAPI(username, password, proxy string) *PinnacleAPI {
 	if proxy != "" {
 		proxyURL, err := url.Parse(proxy)
 		if err != nil {
-			fmt.Printf("[ERROR] Неверный URL прокси: %v\n", err)
+			logUpstream.Error("Неверный URL прокси", "error", err)
 		} else {
 			transport.Proxy = http.ProxyURL(proxyURL)
 		}
@@ -127,7 +394,7 @@ func NewPinnacleAPI(username, password, proxy string) *PinnacleAPI {
 func (api *PinnacleAPI) buildURL(endpoint string, params map[string]string) string {
 	u, err := url.Parse(PINNACLE_API_URL + endpoint)
 	if err != nil {
-		fmt.Printf("[ERROR] Ошибка парсинга URL: %v\n", err)
+		logUpstream.Error("Ошибка парсинга URL", "endpoint", endpoint, "error", err)
 		return ""
 	}
 
@@ -141,7 +408,20 @@ func (api *PinnacleAPI) buildURL(endpoint string, params map[string]string) stri
 	return u.String()
 }
 
-func (api *PinnacleAPI) query(urlStr string) (map[string]interface{}, error) {
+func (api *PinnacleAPI) query(urlStr string) (result map[string]interface{}, err error) {
+	// Метка endpoint - последний сегмент пути (fixtures, odds)
+	endpoint := "unknown"
+	if parsed, parseErr := url.Parse(urlStr); parseErr == nil {
+		endpoint = path.Base(parsed.Path)
+	}
+	start := time.Now()
+	defer func() {
+		metricUpstreamDuration.WithLabelValues("Pinnacle", endpoint).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metricUpstreamErrors.WithLabelValues("Pinnacle", endpoint).Inc()
+		}
+	}()
+
 	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
 		return nil, err
@@ -157,17 +437,15 @@ func (api *PinnacleAPI) query(urlStr string) (map[string]interface{}, error) {
 	}
 	defer resp.Body.Close()
 
-	// fmt.Printf("[LOG] Запрос к URL: %s\n", urlStr)
-	// fmt.Printf("[LOG] Статус ответа: %d\n", resp.StatusCode)
-
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("[DEBUG] Raw API response: %s\n", string(body))
+	if logUpstream.Enabled(context.Background(), slog.LevelDebug) {
+		logUpstream.Debug("Ответ API", "endpoint", endpoint, "status", resp.StatusCode, "elapsed", time.Since(start), "body", string(body))
+	}
 
-	var result map[string]interface{}
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, err
 	}
@@ -186,18 +464,16 @@ func fetchMatches(api *PinnacleAPI) error {
 	urlStr := api.buildURL("v1/fixtures", params)
 	data, err := api.query(urlStr)
 	if err != nil {
-		fmt.Printf("[ERROR] Ошибка при получении матчей: %v\n", err)
-		return err
+		return fmt.Errorf("ошибка получения матчей: %v", err)
 	}
 
 	leagues, ok := data["league"].([]interface{})
 	if !ok {
-		fmt.Println("[ERROR] Не удалось загрузить данные матчей.")
 		return fmt.Errorf("отсутствует ключ 'league' в ответе")
 	}
 
 	matchesDataMutex.Lock()
-	defer matchesDataMutex.Unlock()
+	previous := matchesData
 	matchesData = make(map[int64]MatchData)
 
 	for _, leagueInterface := range leagues {
@@ -244,15 +520,53 @@ func fetchMatches(api *PinnacleAPI) error {
 		}
 	}
 
+	// Матчи, пропавшие из лайва, снимаем в анализаторе
+	var removed []RemovedGame
+	for eventID, match := range previous {
+		if _, still := matchesData[eventID]; !still {
+			removed = append(removed, RemovedGame{
+				Source:    "Pinnacle",
+				MatchId:   fmt.Sprintf("%d", eventID),
+				MatchName: fmt.Sprintf("%s vs %s", match.Home, match.Away),
+				Removed:   true,
+			})
+		}
+	}
+	metricLiveMatches.WithLabelValues("Pinnacle").Set(float64(len(matchesData)))
+	matchesDataMutex.Unlock()
+
+	for _, game := range removed {
+		sendRemoval(game)
+	}
+
 	return nil
 }
 
+// Сообщение анализатору о снятом матче
+func sendRemoval(game RemovedGame) {
+	jsonResult, err := json.Marshal(game)
+	if err != nil {
+		logAnalyzer.Error("Не удалось сформировать JSON снятого матча", "match_id", game.MatchId, "error", err)
+		return
+	}
+
+	logAnalyzer.Info("Матч снят, сообщаем анализатору", "match_id", game.MatchId, "match_name", game.MatchName)
+	err = analyzerConnection.WriteMessage(websocket.TextMessage, jsonResult)
+	observeSend(err)
+	if err != nil {
+		logAnalyzer.Error("Ошибка отправки сообщения", "match_id", game.MatchId, "error", err)
+	}
+
+	marketTracksMutex.Lock()
+	delete(marketTracks, game.MatchId)
+	marketTracksMutex.Unlock()
+}
+
 // Функция обработки данных матча
 func processMatchData(eventData map[string]interface{}) (*OneGame, error) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("[ERROR] Panic in processMatchData: %v\n", r)
-			fmt.Printf("Event data: %v\n", eventData)
+			logUpstream.Error("Паника при обработке матча", "panic", r, "event", eventData)
 		}
 	}()
 
@@ -273,7 +587,7 @@ func processMatchData(eventData map[string]interface{}) (*OneGame, error) {
 		awayTeam = matchData.Away
 		leagueName = matchData.League
 	} else {
-		// fmt.Printf("[WARNING] Событие %d не найдено в matchesData.\n", eventID)
+		logUpstream.Debug("Событие не найдено в списке матчей", "match_id", fmt.Sprintf("%d", eventID))
 		homeTeam = "Неизвестная команда"
 		awayTeam = "Неизвестная команда"
 		leagueName = "Неизвестная лига"
@@ -317,6 +631,8 @@ func processMatchData(eventData map[string]interface{}) (*OneGame, error) {
 	if !ok || len(periods) == 0 {
 		return nil, fmt.Errorf("данные о периодах отсутствуют или пусты")
 	}
+	suspended := make(map[string]bool)
+	limits := make(map[string]float64)
 
 	for _, periodInterface := range periods {
 		periodMap, ok := periodInterface.(map[string]interface{})
@@ -324,15 +640,19 @@ func processMatchData(eventData map[string]interface{}) (*OneGame, error) {
 			continue
 		}
 
-		// Проверка статуса периода
+		// Определение типа периода
+		periodNumber, _ := periodMap["number"].(float64)
+
+		// Проверка статуса периода: цены закрытого периода не передаются,
+		// а его рынки отмечаются приостановленными
 		statusFloat, _ := periodMap["status"].(float64)
 		if int(statusFloat) != 1 {
+			for _, field := range periodMarketFields[int(periodNumber)] {
+				suspended[field] = true
+			}
 			continue
 		}
 
-		// Определение типа периода
-		periodNumber, _ := periodMap["number"].(float64)
-
 		// Указатели на исходы
 		var Win1x2P *Win1x2Struct
 		var TotalsP *map[string]WinLessMore
@@ -361,6 +681,16 @@ func processMatchData(eventData map[string]interface{}) (*OneGame, error) {
 			SecondTeamTotalsP = &Time2SecondTeamTotals
 		}
 
+		// Максимальные ставки периода: maxMoneyline, maxTotal, maxSpread и
+		// maxTeamTotal для рынков в порядке periodMarketFields
+		if fields, ok := periodMarketFields[int(periodNumber)]; ok {
+			for i, limitKey := range []string{"maxMoneyline", "maxTotal", "maxSpread", "maxTeamTotal", "maxTeamTotal"} {
+				if limit, ok := periodMap[limitKey].(float64); ok && limit > 0 {
+					limits[fields[i]] = limit
+				}
+			}
+		}
+
 		// Извлечение коэффициентов
 		if moneyline, ok := periodMap["moneyline"].(map[string]interface{}); ok {
 			if odds, exists := moneyline["home"]; exists {
@@ -389,22 +719,12 @@ func processMatchData(eventData map[string]interface{}) (*OneGame, error) {
 				homeOdds, _ := spreadMap["home"].(float64)
 				awayOdds, _ := spreadMap["away"].(float64)
 
+				// Живой спред Pinnacle считается от текущего счёта (hdp - линия
+				// хозяев), переводим его в линию от начала матча
 				homeLine := strconv.FormatFloat((score2-score1)+hdp, 'f', -1, 64)
-				awayLine := strconv.FormatFloat((score1-score2)+(-1*hdp), 'f', -1, 64)
-
-				if _, ok := (*HandicapP)[homeLine]; !ok {
-					(*HandicapP)[homeLine] = WinHandicap{}
-				}
 
 				(*HandicapP)[homeLine] = WinHandicap{
 					Win1: homeOdds,
-				}
-
-				if _, ok := (*HandicapP)[awayLine]; !ok {
-					(*HandicapP)[awayLine] = WinHandicap{}
-				}
-
-				(*HandicapP)[awayLine] = WinHandicap{
 					Win2: awayOdds,
 				}
 			}
@@ -455,42 +775,34 @@ func processMatchData(eventData map[string]interface{}) (*OneGame, error) {
 				}
 			}
 		}
-
-		// Присвоение коэффициентов матчу
-		nOneGame.Source = "Pinnacle"
-		nOneGame.Win1x2 = Win1x2
-		nOneGame.Totals = Totals
-		nOneGame.Handicap = Handicap
-		nOneGame.FirstTeamTotals = FirstTeamTotals
-		nOneGame.SecondTeamTotals = SecondTeamTotals
-
-		nOneGame.Time1Win1x2 = Time1Win1x2
-		nOneGame.Time1Totals = Time1Totals
-		nOneGame.Time1Handicap = Time1Handicap
-		nOneGame.Time1FirstTeamTotals = Time1FirstTeamTotals
-		nOneGame.Time1SecondTeamTotals = Time1SecondTeamTotals
-
-		nOneGame.Time2Win1x2 = Time2Win1x2
-		nOneGame.Time2Totals = Time2Totals
-		nOneGame.Time2Handicap = Time2Handicap
-		nOneGame.Time2FirstTeamTotals = Time2FirstTeamTotals
-		nOneGame.Time2SecondTeamTotals = Time2SecondTeamTotals
-
-		// Преобразование в JSON и отправка
-		jsonResult, err := json.MarshalIndent(nOneGame, "", "    ")
-		if err != nil {
-			fmt.Printf("[ERROR] Не удалось преобразовать данные в JSON: %v\n", err)
-			continue
-		}
-
-		// Отправка данных в анализатор
-		fmt.Printf("[LOG] Отправляем сообщение в анализатор (Full Match): %s\n", string(jsonResult))
-		err = analyzerConnection.WriteMessage(websocket.TextMessage, jsonResult)
-		if err != nil {
-			log.Printf("Ошибка отправки сообщения: %v", err)
-		}
 	}
 
+	// Присвоение коэффициентов матчу. Снимок отправляет getLiveOdds целиком,
+	// после отметки состояния рынков и лимитов: промежуточные сообщения по
+	// периодам без Markets анализатор не смог бы проверить на приостановку
+	nOneGame.Source = "Pinnacle"
+	nOneGame.HandicapConvention = HandicapConvention
+	nOneGame.Win1x2 = Win1x2
+	nOneGame.Totals = Totals
+	nOneGame.Handicap = Handicap
+	nOneGame.FirstTeamTotals = FirstTeamTotals
+	nOneGame.SecondTeamTotals = SecondTeamTotals
+
+	nOneGame.Time1Win1x2 = Time1Win1x2
+	nOneGame.Time1Totals = Time1Totals
+	nOneGame.Time1Handicap = Time1Handicap
+	nOneGame.Time1FirstTeamTotals = Time1FirstTeamTotals
+	nOneGame.Time1SecondTeamTotals = Time1SecondTeamTotals
+
+	nOneGame.Time2Win1x2 = Time2Win1x2
+	nOneGame.Time2Totals = Time2Totals
+	nOneGame.Time2Handicap = Time2Handicap
+	nOneGame.Time2FirstTeamTotals = Time2FirstTeamTotals
+	nOneGame.Time2SecondTeamTotals = Time2SecondTeamTotals
+
+	stampMarkets(&nOneGame, suspended)
+	nOneGame.Limits = limits
+
 	return &nOneGame, nil
 }
 
@@ -506,14 +818,12 @@ func getLiveOdds(api *PinnacleAPI) error {
 	urlStr := api.buildURL("v1/odds", params)
 	data, err := api.query(urlStr)
 	if err != nil {
-		fmt.Printf("[ERROR] Ошибка получения коэффициентов: %v\n", err)
-		return err
+		return fmt.Errorf("ошибка получения коэффициентов: %v", err)
 	}
 
 	leagues, ok := data["leagues"].([]interface{})
 	if !ok {
-		fmt.Println("[ERROR] Ключ 'leagues' отсутствует в ответе.")
-		fmt.Printf("Ответ: %v\n", data)
+		logUpstream.Debug("Ответ без ключа 'leagues'", "endpoint", "odds", "response", data)
 		return fmt.Errorf("отсутствует ключ 'leagues' в ответе")
 	}
 
@@ -525,7 +835,6 @@ func getLiveOdds(api *PinnacleAPI) error {
 
 		events, ok := leagueMap["events"].([]interface{})
 		if !ok {
-			// fmt.Printf("[WARNING] В лиге отсутствуют события.\n")
 			continue
 		}
 
@@ -537,49 +846,168 @@ func getLiveOdds(api *PinnacleAPI) error {
 
 			nOneGame, err := processMatchData(eventMap)
 			if err != nil {
-				// fmt.Printf("[WARNING] Не удалось обработать событие: %v\n", err)
+				logUpstream.Warn("Не удалось обработать событие", "error", err)
 				continue
 			}
 
 			// Преобразование в JSON
 			jsonResult, err := json.MarshalIndent(nOneGame, "", "    ")
 			if err != nil {
-				// fmt.Printf("[ERROR] Не удалось преобразовать данные в JSON: %v\n", err)
+				logAnalyzer.Error("Не удалось сформировать JSON матча", "match_id", nOneGame.MatchId, "error", err)
 				continue
 			}
 
 			// Отправка данных в анализатор
-			fmt.Printf("[LOG] Отправляем сообщение в анализатор: %s\n", string(jsonResult))
+			if logAnalyzer.Enabled(context.Background(), slog.LevelDebug) {
+				logAnalyzer.Debug("Отправляем сообщение в анализатор", "match_id", nOneGame.MatchId, "body", string(jsonResult))
+			}
 			err = analyzerConnection.WriteMessage(websocket.TextMessage, jsonResult)
+			observeSend(err)
 			if err != nil {
-				log.Printf("Ошибка отправки сообщения: %v", err)
+				logAnalyzer.Error("Ошибка отправки сообщения", "match_id", nOneGame.MatchId, "error", err)
 			}
-
-			fmt.Println(string(jsonResult))
 		}
 	}
 
 	return nil
 }
 
+// Поля OneGame с рынками каждого периода Pinnacle (0 - матч, 1 и 2 - таймы)
+var periodMarketFields = map[int][]string{
+	0: {"Win1x2", "Totals", "Handicap", "FirstTeamTotals", "SecondTeamTotals"},
+	1: {"Time1Win1x2", "Time1Totals", "Time1Handicap", "Time1FirstTeam", "Time1SecondTeam"},
+	2: {"Time2Win1x2", "Time2Totals", "Time2Handicap", "Time2FirstTeam", "Time2SecondTeam"},
+}
+
+// Поля OneGame с рынками, для которых передаётся MarketState
+var marketFields = []string{
+	"Win1x2", "Totals", "Handicap", "FirstTeamTotals", "SecondTeamTotals",
+	"Time1Win1x2", "Time1Totals", "Time1Handicap", "Time1FirstTeam", "Time1SecondTeam",
+	"Time2Win1x2", "Time2Totals", "Time2Handicap", "Time2FirstTeam", "Time2SecondTeam",
+	"DoubleChance", "DrawNoBet", "BothTeamsToScore",
+}
+
+// Последний снимок цен рынков матча
+type marketTrack struct {
+	prices      map[string]string // поле рынка -> JSON цен
+	hadPrices   map[string]bool   // у рынка уже были цены
+	lastChanged map[string]time.Time
+	lastSeen    time.Time
+}
+
+// Заполнение game.Markets. Рынок приостановлен, если это явно передал
+// букмекер (suspended), если цена закрыта (1.00 и ниже) или если цены
+// у рынка были, а в этом снимке пропали.
+func stampMarkets(game *OneGame, suspended map[string]bool) {
+	data, err := json.Marshal(game)
+	if err != nil {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+
+	now := time.Now()
+	marketTracksMutex.Lock()
+	defer marketTracksMutex.Unlock()
+
+	for matchId, track := range marketTracks {
+		if now.Sub(track.lastSeen) > marketTrackTTL {
+			delete(marketTracks, matchId)
+		}
+	}
+	track, exists := marketTracks[game.MatchId]
+	if !exists {
+		track = &marketTrack{
+			prices:      make(map[string]string),
+			hadPrices:   make(map[string]bool),
+			lastChanged: make(map[string]time.Time),
+		}
+		marketTracks[game.MatchId] = track
+	}
+	track.lastSeen = now
+
+	game.Markets = make(map[string]MarketState, len(marketFields))
+	for _, field := range marketFields {
+		raw := string(fields[field])
+		if previous, seen := track.prices[field]; !seen || previous != raw {
+			track.prices[field] = raw
+			track.lastChanged[field] = now
+		}
+		priced, locked := marketPrices(fields[field])
+		game.Markets[field] = MarketState{
+			LastChanged: track.lastChanged[field].UnixMilli(),
+			Suspended:   suspended[field] || locked || (!priced && track.hadPrices[field]),
+		}
+		if priced {
+			track.hadPrices[field] = true
+		}
+	}
+}
+
+// Есть ли у рынка цены и есть ли среди них закрытые
+func marketPrices(raw json.RawMessage) (priced, locked bool) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return false, false
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case float64:
+			if v > 0 {
+				priced = true
+			}
+			if v > 0 && v <= 1 {
+				locked = true
+			}
+		}
+	}
+	walk(value)
+	return priced, locked
+}
+
 // Функция подключения к анализатору
+// Адрес анализатора (ANALYZER_URL, wss:// при TLS) и токен парсера
+// (ANALYZER_TOKEN, auth.parserTokens в настройках анализатора)
+func analyzerEndpoint() (string, http.Header) {
+	address := os.Getenv("ANALYZER_URL")
+	if address == "" {
+		address = "ws://localhost:7200"
+	}
+	header := http.Header{}
+	if token := os.Getenv("ANALYZER_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return address, header
+}
+
 func connectToAnalyzer() {
+	address, header := analyzerEndpoint()
 	for {
 		var err error
-		analyzerConnection, _, err = websocket.DefaultDialer.Dial("ws://localhost:7200", nil)
+		analyzerConnection, _, err = websocket.DefaultDialer.Dial(address, header)
 		if err != nil {
-			log.Printf("[ERROR] Ошибка подключения к анализатору: %v", err)
+			logAnalyzer.Error("Ошибка подключения к анализатору", "address", address, "error", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		// log.Printf("[DEBUG] Подключение к анализатору установлено")
+		logAnalyzer.Info("Подключение к анализатору установлено", "address", address)
 		break
 	}
 }
 
 // Основная функция
 func main() {
+	setupLogging()
+	logMain.Info("Парсер запущен")
 	api := NewPinnacleAPI(PINNACLE_USERNAME, PINNACLE_PASSWORD, PROXY)
+	go serveMetrics()
 
 	// Подключение к анализатору
 	connectToAnalyzer()
@@ -587,11 +1015,11 @@ func main() {
 
 	for {
 		if err := fetchMatches(api); err != nil {
-			fmt.Printf("[ERROR] Ошибка в цикле (fetchMatches): %v\n", err)
+			logUpstream.Error("Ошибка обновления списка матчей", "endpoint", "fixtures", "error", err)
 		}
 
 		if err := getLiveOdds(api); err != nil {
-			fmt.Printf("[ERROR] Ошибка в цикле (getLiveOdds): %v\n", err)
+			logUpstream.Error("Ошибка получения коэффициентов", "endpoint", "odds", "error", err)
 		}
 
 		time.Sleep(2 * time.Second)
@@ -3,17 +3,24 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Константы для URL запросов
@@ -22,6 +29,15 @@ const (
 	matchEventURL = "https://apilive.sansabet.com/api/LiveOdds/GetByParIDs?SLID=%d&ParIDs=%d"
 )
 
+// Соглашение о линиях гандикапа, общее для обоих парсеров и анализатора:
+// линия считается от начала матча (с учётом уже забитых голов), ключ карты
+// Handicap - линия хозяев, Win1 - хозяева с этой линией, Win2 - гости с
+// противоположной. Обе стороны одной линии лежат в одной записи.
+const HandicapConvention = "from_kickoff_home_line"
+
+// Сколько хранить снимок рынков матча, пропавшего из фида
+const marketTrackTTL = 10 * time.Minute
+
 // Глобальные переменные
 var (
 	analyzerConnection *websocket.Conn
@@ -30,9 +46,230 @@ var (
 	SlidAll      int64 = 0
 	ListGames          = make(map[int64]OneGame)
 	ListGamesMux sync.RWMutex
+
+	marketTracks      = make(map[string]*marketTrack) // MatchId -> последний снимок рынков
+	marketTracksMutex sync.Mutex
+)
+
+// Метрики Prometheus, /metrics на METRICS_ADDR (по умолчанию localhost:9101)
+var (
+	metricUpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "parser_upstream_request_duration_seconds",
+		Help:    "Длительность запросов к API букмекера",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+	}, []string{"source", "endpoint"})
+	metricUpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "parser_upstream_errors_total",
+		Help: "Ошибки запросов к API букмекера",
+	}, []string{"source", "endpoint"})
+	metricMessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "parser_messages_sent_total",
+		Help: "Сообщения, отправленные анализатору",
+	}, []string{"source"})
+	metricSendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "parser_send_errors_total",
+		Help: "Ошибки отправки сообщений анализатору",
+	}, []string{"source"})
+	metricLiveMatches = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "parser_live_matches",
+		Help: "Матчи в лайве по данным букмекера",
+	}, []string{"source"})
+)
+
+// Учет запроса к API Sansabet: endpoint - GetAll или GetByParIDs
+func observeUpstream(endpoint string, start time.Time, err error) {
+	metricUpstreamDuration.WithLabelValues("Sansabet", endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricUpstreamErrors.WithLabelValues("Sansabet", endpoint).Inc()
+	}
+}
+
+// Учет результата отправки сообщения анализатору
+func observeSend(err error) {
+	if err != nil {
+		metricSendErrors.WithLabelValues("Sansabet").Inc()
+		return
+	}
+	metricMessagesSent.WithLabelValues("Sansabet").Inc()
+}
+
+// HTTP-сервер метрик и уровней журнала парсера
+func serveMetrics() {
+	address := os.Getenv("METRICS_ADDR")
+	if address == "" {
+		address = "localhost:9101"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/admin/logging", requireAnalyzerToken(loggingHandler))
+	if os.Getenv("ANALYZER_TOKEN") == "" {
+		logMain.Warn("ANALYZER_TOKEN не задан: /admin/logging отклоняет все запросы")
+	}
+	logMain.Info("Служебный сервер запущен", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logMain.Error("Служебный сервер остановлен", "error", err)
+	}
+}
+
+// /admin/logging меняет уровни журнала, поэтому METRICS_ADDR, открытый не
+// только на localhost, не должен давать это любому: нужен тот же токен, что
+// и для подключения к анализатору ("Authorization: Bearer $ANALYZER_TOKEN").
+// Без ANALYZER_TOKEN запросы отклоняются.
+func requireAnalyzerToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ANALYZER_TOKEN")
+		header := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(header), []byte("Bearer "+token)) != 1 {
+			logMain.Warn("Запрос к /admin/logging без верного токена", "client", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Журнал: уровень LOG_LEVEL (debug, info, warn, error, по умолчанию info),
+// формат LOG_FORMAT (text или json) и уровни модулей LOG_MODULES
+// ("upstream=debug,analyzer=warn"). Уровни меняются без перезапуска через
+// /admin/logging. Общие поля записей: module, source, match_id.
+const (
+	logModuleMain     = "main"     // запуск и служебный HTTP-сервер
+	logModuleUpstream = "upstream" // запросы к API Sansabet
+	logModuleAnalyzer = "analyzer" // подключение и отправка в анализатор
 )
 
+var logModules = []string{logModuleMain, logModuleUpstream, logModuleAnalyzer}
+
+// Текущие уровни модулей, меняются атомарно из /admin/logging
+var logLevels = func() map[string]*slog.LevelVar {
+	levels := make(map[string]*slog.LevelVar, len(logModules))
+	for _, module := range logModules {
+		levels[module] = new(slog.LevelVar)
+	}
+	return levels
+}()
+
+// Журналы модулей, создаются в setupLogging
+var (
+	logMain     *slog.Logger
+	logUpstream *slog.Logger
+	logAnalyzer *slog.Logger
+)
+
+// Обработчик журнала модуля: пропускает записи не ниже уровня модуля
+type moduleHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h moduleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h moduleHandler) WithGroup(name string) slog.Handler {
+	return moduleHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// Применение уровней: level (если задан) всем модулям, затем modules
+func applyLogLevels(level string, modules map[string]string) error {
+	levels := make(map[string]slog.Level)
+	if level != "" {
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("неизвестный уровень %q", level)
+		}
+		for _, module := range logModules {
+			levels[module] = parsed
+		}
+	}
+	for module, name := range modules {
+		if _, known := logLevels[module]; !known {
+			return fmt.Errorf("неизвестный модуль %q", module)
+		}
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("модуль %s: неизвестный уровень %q", module, name)
+		}
+		levels[module] = parsed
+	}
+	for module, parsed := range levels {
+		logLevels[module].Set(parsed)
+	}
+	return nil
+}
+
+// Журналы модулей по переменным окружения
+func setupLogging() {
+	modules := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv("LOG_MODULES"), ",") {
+		if module, level, ok := strings.Cut(strings.TrimSpace(item), "="); ok {
+			modules[module] = level
+		}
+	}
+	if err := applyLogLevels(os.Getenv("LOG_LEVEL"), modules); err != nil {
+		log.Fatalf("Ошибка настройки журнала: %v", err)
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug} // Уровень проверяет moduleHandler
+	var base slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if os.Getenv("LOG_FORMAT") == "json" {
+		base = slog.NewJSONHandler(os.Stderr, options)
+	}
+	moduleLogger := func(module string) *slog.Logger {
+		return slog.New(moduleHandler{Handler: base, level: logLevels[module]}).With("module", module, "source", "Sansabet")
+	}
+
+	logMain = moduleLogger(logModuleMain)
+	logUpstream = moduleLogger(logModuleUpstream)
+	logAnalyzer = moduleLogger(logModuleAnalyzer)
+	slog.SetDefault(logMain)
+}
+
+// Уровни журнала: GET - текущие, POST {"level": "...", "modules": {...}} -
+// изменить без перезапуска
+func loggingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request struct {
+			Level   string            `json:"level"`
+			Modules map[string]string `json:"modules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := applyLogLevels(request.Level, request.Modules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logMain.Info("Уровни журнала изменены", "level", request.Level, "modules", request.Modules)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	modules := make(map[string]string, len(logLevels))
+	for module, level := range logLevels {
+		modules[module] = strings.ToLower(level.Level().String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"modules": modules})
+}
+
 // Структуры данных
+// Сообщение о матче, который закончился или пропал из фида
+type RemovedGame struct {
+	Source    string `json:"Source"`
+	MatchId   string `json:"MatchId"`
+	MatchName string `json:"MatchName"`
+	Removed   bool   `json:"Removed"`
+}
+
 type OneGame struct {
 	Source     string `json:"Source"`
 	Name       string `json:"Name"`
@@ -43,6 +280,8 @@ type OneGame struct {
 	MatchId    string `json:"MatchId"`
 	LeagueId   string `json:"LeagueId"`
 
+	HandicapConvention string `json:"HandicapConvention"`
+
 	Win1x2           Win1x2Struct           `json:"Win1x2"`
 	Totals           map[string]WinLessMore `json:"Totals"`
 	Handicap         map[string]WinHandicap `json:"Handicap"`
@@ -60,6 +299,20 @@ type OneGame struct {
 	Time2Handicap         map[string]WinHandicap `json:"Time2Handicap"`
 	Time2FirstTeamTotals  map[string]WinLessMore `json:"Time2FirstTeam"`
 	Time2SecondTeamTotals map[string]WinLessMore `json:"Time2SecondTeam"`
+
+	DoubleChance     DoubleChanceStruct     `json:"DoubleChance"`
+	DrawNoBet        DrawNoBetStruct        `json:"DrawNoBet"`
+	BothTeamsToScore BothTeamsToScoreStruct `json:"BothTeamsToScore"`
+
+	Markets map[string]MarketState `json:"Markets"` // Поле рынка -> состояние
+}
+
+// Состояние рынка для анализатора: когда цены рынка последний раз менялись
+// и приостановлен ли он. Парсер пересылает полный снимок матча на каждом
+// опросе, поэтому время изменения считается по самим ценам рынка.
+type MarketState struct {
+	LastChanged int64 `json:"LastChanged"` // Unix-время в миллисекундах
+	Suspended   bool  `json:"Suspended"`
 }
 
 type WinLessMore struct {
@@ -78,6 +331,22 @@ type Win1x2Struct struct {
 	Win2    float64 `json:"Win2"`
 }
 
+type DoubleChanceStruct struct {
+	Win1X float64 `json:"Win1X"`
+	Win12 float64 `json:"Win12"`
+	WinX2 float64 `json:"WinX2"`
+}
+
+type DrawNoBetStruct struct {
+	Win1 float64 `json:"Win1"`
+	Win2 float64 `json:"Win2"`
+}
+
+type BothTeamsToScoreStruct struct {
+	Yes float64 `json:"Yes"`
+	No  float64 `json:"No"`
+}
+
 // Вспомогательные функции
 func InterfaceToInt64(inVal interface{}) int64 {
 	if resInt, ok := inVal.(float64); ok {
@@ -93,14 +362,10 @@ func StringToInt64(inVal string) int64 {
 	return -1
 }
 
-func DebugLog(str string) {
-	// fmt.Println(str)
-}
-
 // Основная функция парсинга одного матча
 func ParseOneGame(nGameKey int64, nGame OneGame) {
-	// DebugLog(fmt.Sprintf("Начало анализа Slid: %d Pid: %d", nGame.Slid, nGame.Pid))
 	start := time.Now() // Начало замера времени
+	matchId := strconv.FormatInt(nGame.Pid, 10)
 
 	client := &http.Client{}
 	// мы заменили слид на ноль, чтобы получать данные даже если цены не изменились
@@ -123,30 +388,30 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
 
 	res, err := client.Do(req)
+	observeUpstream("GetByParIDs", start, err)
 	elapsed := time.Since(start)
-	log.Printf("[INFO] Время получения данных для матча (Slid: %d, Pid: %d): %s", nGame.Slid, nGame.Pid, elapsed)
 
 	if err != nil {
-		DebugLog(fmt.Sprintf("Ошибка запроса: %v", err))
+		logUpstream.Error("Ошибка запроса матча", "endpoint", "GetByParIDs", "match_id", matchId, "error", err)
 		return
 	}
 	defer res.Body.Close()
 
 	if res.Body == nil {
-		DebugLog(fmt.Sprintf("Нет данных по запросу о матче. Slid %d Pid %d", nGame.Slid, nGame.Pid))
+		logUpstream.Warn("Нет данных по запросу о матче", "endpoint", "GetByParIDs", "match_id", matchId)
 		return
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		DebugLog(fmt.Sprintf("Ошибка чтения тела ответа: %v", err))
+		logUpstream.Error("Ошибка чтения тела ответа", "endpoint", "GetByParIDs", "match_id", matchId, "error", err)
 		return
 	}
 
 	b := bytes.NewBuffer(body)
 	r, err := gzip.NewReader(b)
 	if err != nil {
-		DebugLog(fmt.Sprintf("Ошибка создания gzip reader: %v", err))
+		logUpstream.Error("Ошибка создания gzip reader", "endpoint", "GetByParIDs", "match_id", matchId, "error", err)
 		return
 	}
 	defer r.Close()
@@ -154,14 +419,16 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 	var resB bytes.Buffer
 	_, err = resB.ReadFrom(r)
 	if err != nil {
-		DebugLog(fmt.Sprintf("Ошибка чтения из gzip reader: %v", err))
+		logUpstream.Error("Ошибка чтения из gzip reader", "endpoint", "GetByParIDs", "match_id", matchId, "error", err)
 		return
 	}
 
 	resData := resB.Bytes()
-	log.Printf("[DEBUG] Полученные данные для матча (Slid: %d, Pid: %d): %s", nGame.Slid, nGame.Pid, string(resData))
+	if logUpstream.Enabled(context.Background(), slog.LevelDebug) {
+		logUpstream.Debug("Получены данные матча", "endpoint", "GetByParIDs", "match_id", matchId, "elapsed", elapsed, "body", string(resData))
+	}
 	if len(resData) == 0 {
-		log.Printf("[WARNING] Пустой ответ для матча (Slid: %d, Pid: %d)", nGame.Slid, nGame.Pid)
+		logUpstream.Warn("Пустой ответ для матча", "endpoint", "GetByParIDs", "match_id", matchId)
 		return
 	}
 
@@ -169,13 +436,13 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 	var mapAllInterface []interface{}
 	jsonErr := json.Unmarshal(resData, &mapAllInterface)
 	if jsonErr != nil {
-		// DebugLog(fmt.Sprintf("Ошибка разбора JSON: %v", jsonErr))
+		logUpstream.Error("Ошибка разбора JSON матча", "endpoint", "GetByParIDs", "match_id", matchId, "error", jsonErr)
 		return
 	}
 
 	// Проверка на пустой ответ
 	if len(mapAllInterface) == 0 {
-		// DebugLog(fmt.Sprintf("Пустой ответ от сервера для матча. Slid %d Pid %d", nGame.Slid, nGame.Pid))
+		logUpstream.Debug("Пустой список в ответе для матча", "endpoint", "GetByParIDs", "match_id", matchId)
 		return
 	}
 
@@ -189,16 +456,22 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 	nOneGame.Slid = InterfaceToInt64(mapHInterface["SLID"])
 	nOneGame.MatchName, _ = mapHInterface["ParNaziv"].(string)
 	nOneGame.Source = "Sansabet"
+	nOneGame.HandicapConvention = HandicapConvention
 	nOneGame.MatchId = strconv.FormatInt(nOneGame.Pid, 10)
 	nOneGame.LeagueId = "0"
 
+	// Матч могли снять, пока шёл запрос
 	ListGamesMux.Lock()
+	if _, ok := ListGames[nGameKey]; !ok {
+		ListGamesMux.Unlock()
+		return
+	}
 	ListGames[nGameKey] = nOneGame
 	ListGamesMux.Unlock()
 
 	// Проверка наличия коэффициентов
 	if mapCoreItemInterface["M"] == nil {
-		// DebugLog(fmt.Sprintf("Нет коэффициентов для матча. Slid %d Pid %d", nGame.Slid, nGame.Pid))
+		logUpstream.Debug("Нет коэффициентов для матча", "match_id", matchId)
 		return
 	}
 
@@ -222,6 +495,10 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 	Time2FirstTeamTotals := make(map[string]WinLessMore)
 	Time2SecondTeamTotals := make(map[string]WinLessMore)
 
+	DoubleChance := DoubleChanceStruct{}
+	DrawNoBet := DrawNoBetStruct{}
+	BothTeamsToScore := BothTeamsToScoreStruct{}
+
 	// Парсинг коэффициентов
 	for _, nKoef := range mapKoeffInterface {
 		nKoefMap := nKoef.(map[string]interface{})
@@ -287,9 +564,12 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 				nK := SecondTeamTotals[detailBet]
 				nK.WinMore = nValBetMap["O"].(float64)
 				SecondTeamTotals[detailBet] = nK
+			// Гандикап Sansabet задаётся от начала матча: хозяева выигрывают
+			// при разнице голов больше -B, гости - меньше -B, поэтому
+			// линия хозяев для Win1 равна B-0.5, для Win2 - B+0.5
 			case 121:
 				conv, _ := strconv.ParseFloat(detailBet, 64)
-				detailBet = strconv.FormatFloat(conv-0.5, 'f', 1, 64)
+				detailBet = strconv.FormatFloat(conv-0.5, 'f', -1, 64)
 				if _, ok := Handicap[detailBet]; !ok {
 					Handicap[detailBet] = WinHandicap{}
 				}
@@ -298,7 +578,7 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 				Handicap[detailBet] = nK
 			case 123:
 				conv, _ := strconv.ParseFloat(detailBet, 64)
-				detailBet = strconv.FormatFloat((-1*conv)-0.5, 'f', 1, 64)
+				detailBet = strconv.FormatFloat(conv+0.5, 'f', -1, 64)
 				if _, ok := Handicap[detailBet]; !ok {
 					Handicap[detailBet] = WinHandicap{}
 				}
@@ -308,26 +588,32 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 
 			// double chance
 			case 83:
-				if _, ok := Handicap["0.5"]; !ok {
-					Handicap["0.5"] = WinHandicap{}
-				}
-				nK := Handicap["0.5"]
-				nK.Win1 = nValBetMap["O"].(float64)
-				Handicap["0.5"] = nK
+				DoubleChance.Win1X = nValBetMap["O"].(float64)
+			case 84:
+				DoubleChance.Win12 = nValBetMap["O"].(float64)
 			case 85:
-				if _, ok := Handicap["0.5"]; !ok {
-					Handicap["0.5"] = WinHandicap{}
-				}
-				nK := Handicap[detailBet]
-				nK.Win2 = nValBetMap["O"].(float64)
-				Handicap["0.5"] = nK
-
-			// rest of the match
+				DoubleChance.WinX2 = nValBetMap["O"].(float64)
+
+			// draw no bet
+			case 711:
+				DrawNoBet.Win1 = nValBetMap["O"].(float64)
+			case 713:
+				DrawNoBet.Win2 = nValBetMap["O"].(float64)
+
+			// both teams to score
+			case 772:
+				BothTeamsToScore.Yes = nValBetMap["O"].(float64)
+			case 773:
+				BothTeamsToScore.No = nValBetMap["O"].(float64)
+
+			// rest of the match: победа в оставшейся части матча при счёте R
+			// равна гандикапу от начала матча с линией хозяев (score2-score1)-0.5
+			// для Win1 и (score2-score1)+0.5 для Win2
 			case 734:
 				scores := strings.Split(nKoefMap["R"].(string), "-")
 				score1, _ := strconv.ParseFloat(scores[0], 64)
 				score2, _ := strconv.ParseFloat(scores[1], 64)
-				hcpLine := strconv.FormatFloat((score2-score1)-0.5, 'f', 1, 64)
+				hcpLine := strconv.FormatFloat((score2-score1)-0.5, 'f', -1, 64)
 				if _, ok := Handicap[hcpLine]; !ok {
 					Handicap[hcpLine] = WinHandicap{}
 				}
@@ -338,7 +624,7 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 				scores := strings.Split(nKoefMap["R"].(string), "-")
 				score1, _ := strconv.ParseFloat(scores[0], 64)
 				score2, _ := strconv.ParseFloat(scores[1], 64)
-				hcpLine := strconv.FormatFloat((score1-score2)-0.5, 'f', 1, 64)
+				hcpLine := strconv.FormatFloat((score2-score1)+0.5, 'f', -1, 64)
 				if _, ok := Handicap[hcpLine]; !ok {
 					Handicap[hcpLine] = WinHandicap{}
 				}
@@ -401,7 +687,7 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 				scores := strings.Split(nKoefMap["R"].(string), "-")
 				score1, _ := strconv.ParseFloat(scores[0], 64)
 				score2, _ := strconv.ParseFloat(scores[1], 64)
-				hcpLine := strconv.FormatFloat((score2-score1)-0.5, 'f', 1, 64)
+				hcpLine := strconv.FormatFloat((score2-score1)-0.5, 'f', -1, 64)
 				if _, ok := Time1Handicap[hcpLine]; !ok {
 					Time1Handicap[hcpLine] = WinHandicap{}
 				}
@@ -412,7 +698,7 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 				scores := strings.Split(nKoefMap["R"].(string), "-")
 				score1, _ := strconv.ParseFloat(scores[0], 64)
 				score2, _ := strconv.ParseFloat(scores[1], 64)
-				hcpLine := strconv.FormatFloat((score1-score2)-0.5, 'f', 1, 64)
+				hcpLine := strconv.FormatFloat((score2-score1)+0.5, 'f', -1, 64)
 				if _, ok := Time1Handicap[hcpLine]; !ok {
 					Time1Handicap[hcpLine] = WinHandicap{}
 				}
@@ -467,33 +753,40 @@ func ParseOneGame(nGameKey int64, nGame OneGame) {
 	nOneGame.Time2FirstTeamTotals = Time2FirstTeamTotals
 	nOneGame.Time2SecondTeamTotals = Time2SecondTeamTotals
 
+	nOneGame.DoubleChance = DoubleChance
+	nOneGame.DrawNoBet = DrawNoBet
+	nOneGame.BothTeamsToScore = BothTeamsToScore
+	stampMarkets(&nOneGame, nil)
+
 	// Преобразование в JSON
 	jsonResult, err := json.MarshalIndent(nOneGame, "", "    ")
 	if err != nil {
-		// DebugLog(fmt.Sprintf("Не удалось сформировать JSON для матча. Slid %d Pid %d", nGame.Slid, nGame.Pid))
+		logAnalyzer.Error("Не удалось сформировать JSON матча", "match_id", matchId, "error", err)
 		return
 	}
 
-	fmt.Println(string(jsonResult))
-
 	// Отправка данных в анализатор
-	fmt.Printf("[LOG] Отправляем сообщение в анализатор: %s\n", string(jsonResult))
+	if logAnalyzer.Enabled(context.Background(), slog.LevelDebug) {
+		logAnalyzer.Debug("Отправляем сообщение в анализатор", "match_id", matchId, "body", string(jsonResult))
+	}
 	analyzerConnMutex.Lock()
 	err = analyzerConnection.WriteMessage(websocket.TextMessage, jsonResult)
 	analyzerConnMutex.Unlock()
+	observeSend(err)
 	if err != nil {
-		log.Printf("Ошибка отправки сообщения: %v", err)
+		logAnalyzer.Error("Ошибка отправки сообщения", "match_id", matchId, "error", err)
 	}
 
 	// Обновление списка игр
 	ListGamesMux.Lock()
-	ListGames[nGameKey] = nOneGame
+	if _, ok := ListGames[nGameKey]; ok {
+		ListGames[nGameKey] = nOneGame
+	}
 	ListGamesMux.Unlock()
 }
 
 // Функция парсинга всех игр
 func ParseGames() {
-	// DebugLog("Запуск парсинга всех матчей")
 	ListGamesMux.RLock()
 	defer ListGamesMux.RUnlock()
 	for nGameKey, nGame := range ListGames {
@@ -503,7 +796,7 @@ func ParseGames() {
 
 // Функция получения всех событий
 func ParseEvents() {
-	// DebugLog("Получение данных о всех матчах")
+	start := time.Now()
 	client := &http.Client{}
 	req, _ := http.NewRequest("GET", fmt.Sprintf(allEventURL, SlidAll), nil)
 
@@ -523,27 +816,28 @@ func ParseEvents() {
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
 
 	res, err := client.Do(req)
+	observeUpstream("GetAll", start, err)
 	if err != nil {
-		// DebugLog(fmt.Sprintf("Ошибка запроса: %v", err))
+		logUpstream.Error("Ошибка запроса списка матчей", "endpoint", "GetAll", "error", err)
 		return
 	}
 	defer res.Body.Close()
 
 	if res.Body == nil {
-		// DebugLog("Нет ответа от сервера для всех матчей")
+		logUpstream.Warn("Нет ответа на запрос списка матчей", "endpoint", "GetAll")
 		return
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		// DebugLog(fmt.Sprintf("Ошибка чтения тела ответа: %v", err))
+		logUpstream.Error("Ошибка чтения тела ответа", "endpoint", "GetAll", "error", err)
 		return
 	}
 
 	b := bytes.NewBuffer(body)
 	r, err := gzip.NewReader(b)
 	if err != nil {
-		// DebugLog(fmt.Sprintf("Ошибка создания gzip reader: %v", err))
+		logUpstream.Error("Ошибка создания gzip reader", "endpoint", "GetAll", "error", err)
 		return
 	}
 	defer r.Close()
@@ -551,7 +845,7 @@ func ParseEvents() {
 	var resB bytes.Buffer
 	_, err = resB.ReadFrom(r)
 	if err != nil {
-		// DebugLog(fmt.Sprintf("Ошибка чтения из gzip reader: %v", err))
+		logUpstream.Error("Ошибка чтения из gzip reader", "endpoint", "GetAll", "error", err)
 		return
 	}
 	resData := resB.Bytes()
@@ -559,7 +853,7 @@ func ParseEvents() {
 	var mapAllInterface []interface{}
 	jsonErr := json.Unmarshal(resData, &mapAllInterface)
 	if jsonErr != nil {
-		// DebugLog("Не удалось разобрать JSON с данными всех матчей")
+		logUpstream.Error("Ошибка разбора JSON списка матчей", "endpoint", "GetAll", "error", jsonErr)
 		return
 	}
 
@@ -587,8 +881,20 @@ func ParseEvents() {
 			nTime = StringToInt64(tMap["M"].(string))
 		}
 
-		// Фильтрация по времени матча (лайв)
+		// Фильтрация по времени матча (лайв); матч, вышедший из лайва, снимаем
 		if nTime <= 0 || nTime >= 90 {
+			ListGamesMux.Lock()
+			game, ok := ListGames[nPid]
+			delete(ListGames, nPid)
+			ListGamesMux.Unlock()
+			if ok && game.MatchName != "" {
+				sendRemoval(RemovedGame{
+					Source:    "Sansabet",
+					MatchId:   game.MatchId,
+					MatchName: game.MatchName,
+					Removed:   true,
+				})
+			}
 			continue
 		}
 
@@ -602,7 +908,33 @@ func ParseEvents() {
 		}
 		ListGamesMux.Unlock()
 	}
-	// DebugLog(fmt.Sprintf("Обновление SLID: %d, количество матчей: %d", SlidAll, len(ListGames)))
+	ListGamesMux.RLock()
+	liveMatches := len(ListGames)
+	ListGamesMux.RUnlock()
+	metricLiveMatches.WithLabelValues("Sansabet").Set(float64(liveMatches))
+	logUpstream.Debug("Список матчей обновлен", "endpoint", "GetAll", "slid", SlidAll, "live_matches", liveMatches)
+}
+
+// Сообщение анализатору о снятом матче
+func sendRemoval(game RemovedGame) {
+	jsonResult, err := json.Marshal(game)
+	if err != nil {
+		logAnalyzer.Error("Не удалось сформировать JSON снятого матча", "match_id", game.MatchId, "error", err)
+		return
+	}
+
+	logAnalyzer.Info("Матч снят, сообщаем анализатору", "match_id", game.MatchId, "match_name", game.MatchName)
+	analyzerConnMutex.Lock()
+	err = analyzerConnection.WriteMessage(websocket.TextMessage, jsonResult)
+	analyzerConnMutex.Unlock()
+	observeSend(err)
+	if err != nil {
+		logAnalyzer.Error("Ошибка отправки сообщения", "match_id", game.MatchId, "error", err)
+	}
+
+	marketTracksMutex.Lock()
+	delete(marketTracks, game.MatchId)
+	marketTracksMutex.Unlock()
 }
 
 // Запуск парсинга событий
@@ -621,30 +953,141 @@ func ParseGamesStart() {
 	}
 }
 
+// Поля OneGame с рынками, для которых передаётся MarketState
+var marketFields = []string{
+	"Win1x2", "Totals", "Handicap", "FirstTeamTotals", "SecondTeamTotals",
+	"Time1Win1x2", "Time1Totals", "Time1Handicap", "Time1FirstTeam", "Time1SecondTeam",
+	"Time2Win1x2", "Time2Totals", "Time2Handicap", "Time2FirstTeam", "Time2SecondTeam",
+	"DoubleChance", "DrawNoBet", "BothTeamsToScore",
+}
+
+// Последний снимок цен рынков матча
+type marketTrack struct {
+	prices      map[string]string // поле рынка -> JSON цен
+	hadPrices   map[string]bool   // у рынка уже были цены
+	lastChanged map[string]time.Time
+	lastSeen    time.Time
+}
+
+// Заполнение game.Markets. Рынок приостановлен, если это явно передал
+// букмекер (suspended), если цена закрыта (1.00 и ниже) или если цены
+// у рынка были, а в этом снимке пропали.
+func stampMarkets(game *OneGame, suspended map[string]bool) {
+	data, err := json.Marshal(game)
+	if err != nil {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+
+	now := time.Now()
+	marketTracksMutex.Lock()
+	defer marketTracksMutex.Unlock()
+
+	for matchId, track := range marketTracks {
+		if now.Sub(track.lastSeen) > marketTrackTTL {
+			delete(marketTracks, matchId)
+		}
+	}
+	track, exists := marketTracks[game.MatchId]
+	if !exists {
+		track = &marketTrack{
+			prices:      make(map[string]string),
+			hadPrices:   make(map[string]bool),
+			lastChanged: make(map[string]time.Time),
+		}
+		marketTracks[game.MatchId] = track
+	}
+	track.lastSeen = now
+
+	game.Markets = make(map[string]MarketState, len(marketFields))
+	for _, field := range marketFields {
+		raw := string(fields[field])
+		if previous, seen := track.prices[field]; !seen || previous != raw {
+			track.prices[field] = raw
+			track.lastChanged[field] = now
+		}
+		priced, locked := marketPrices(fields[field])
+		game.Markets[field] = MarketState{
+			LastChanged: track.lastChanged[field].UnixMilli(),
+			Suspended:   suspended[field] || locked || (!priced && track.hadPrices[field]),
+		}
+		if priced {
+			track.hadPrices[field] = true
+		}
+	}
+}
+
+// Есть ли у рынка цены и есть ли среди них закрытые
+func marketPrices(raw json.RawMessage) (priced, locked bool) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return false, false
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case float64:
+			if v > 0 {
+				priced = true
+			}
+			if v > 0 && v <= 1 {
+				locked = true
+			}
+		}
+	}
+	walk(value)
+	return priced, locked
+}
+
 // Функция подключения к анализатору
+// Адрес анализатора (ANALYZER_URL, wss:// при TLS) и токен парсера
+// (ANALYZER_TOKEN, auth.parserTokens в настройках анализатора)
+func analyzerEndpoint() (string, http.Header) {
+	address := os.Getenv("ANALYZER_URL")
+	if address == "" {
+		address = "ws://localhost:7100"
+	}
+	header := http.Header{}
+	if token := os.Getenv("ANALYZER_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return address, header
+}
+
 func connectToAnalyzer() {
+	address, header := analyzerEndpoint()
 	for {
 		var err error
-		analyzerConnection, _, err = websocket.DefaultDialer.Dial("ws://localhost:7100", nil)
+		analyzerConnection, _, err = websocket.DefaultDialer.Dial(address, header)
 		if err != nil {
-			log.Printf("[ERROR] Ошибка подключения к анализатору: %v", err)
+			logAnalyzer.Error("Ошибка подключения к анализатору", "address", address, "error", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
-		// log.Printf("[DEBUG] Подключение к анализатору установлено")
+		logAnalyzer.Info("Подключение к анализатору установлено", "address", address)
 		break
 	}
 }
 
 // Основная функция
 func main() {
-	// DebugLog("Старт скрипта")
+	setupLogging()
+	logMain.Info("Парсер запущен")
 	ListGames = make(map[int64]OneGame)
 
 	// Подключение к анализатору
 	connectToAnalyzer()
 	defer analyzerConnection.Close()
 
+	go serveMetrics()
+
 	// Запуск парсинга в горутинах
 	go ParseEventsStart()
 	go ParseGamesStart()